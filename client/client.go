@@ -0,0 +1,267 @@
+// Package client provides a goroutine-safe client of memcache-server
+// with a connection pool, pipelining and automatic reconnect.
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultPoolSize = 10
+const defaultDialTimeout = 5 * time.Second
+
+// ErrClosed is returned by commands of a closed Client.
+var ErrClosed = errors.New("ERROR: client is closed")
+
+// ErrNotExist is returned by typed commands if the key
+// or the item they work with doesn't exist.
+var ErrNotExist = errors.New("ERROR: key not exists")
+
+// Error is an error reply of the server, like "ERR syntax error".
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// notExistReply is the error reply of commands
+// which need an existing key.
+const notExistReply Error = "ERR key not exists"
+
+// Options holds settings of a Client.
+type Options struct {
+	// Addr is host:port of the server.
+	Addr string
+
+	// DB is the database selected on every new connection.
+	DB int
+
+	// PoolSize limits the number of open connections,
+	// 10 by default. Commands wait for a free connection
+	// when all of them are busy.
+	PoolSize int
+
+	// DialTimeout limits connecting to the server
+	// unless the context is done earlier, 5s by default.
+	DialTimeout time.Duration
+}
+
+// Client is a pool of connections to the server. It is safe
+// for concurrent use. A connection which fails is closed and
+// a new one is dialed for the next command. A command which
+// finds an idle connection closed by the server is retried
+// once on a new connection if it is read-only or nothing of
+// it has been sent, so a write is never executed twice.
+// Pipelines are never retried.
+type Client struct {
+	opts  Options
+	slots chan struct{} // a token for every open connection
+	idle  chan *conn
+
+	mu     sync.Mutex // guards closed and returning to idle
+	closed bool
+}
+
+// New creates a client of the server with opts.
+// Connections are dialed when they are needed.
+func New(opts Options) *Client {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = defaultPoolSize
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = defaultDialTimeout
+	}
+	return &Client{
+		opts:  opts,
+		slots: make(chan struct{}, opts.PoolSize),
+		idle:  make(chan *conn, opts.PoolSize),
+	}
+}
+
+// Close closes idle connections of c. Busy ones are
+// closed when their commands finish.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.close()
+			<-c.slots
+		default:
+			return nil
+		}
+	}
+}
+
+// Do sends command with args to the server and returns its
+// reply: nil, string, int64, []interface{} or error. Error
+// replies of the server are returned as Error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.roundTrip(ctx, [][]string{args}, true)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// roundTrip sends cmds in one batch and reads their replies.
+// If retry is set and the connection turns out to be closed
+// by the server, cmds are sent once more on a new connection
+// unless they may have been executed.
+func (c *Client) roundTrip(ctx context.Context, cmds [][]string, retry bool) ([]interface{}, error) {
+	for {
+		cn, reused, err := c.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sent := cn.out.n
+		replies, err := cn.roundTrip(ctx, cmds)
+		c.put(cn, err != nil)
+		if err == nil || !retry || !reused || ctx.Err() != nil || !isClosedByPeer(err) {
+			return replies, err
+		}
+		if cn.out.n != sent && !readOnly(cmds) {
+			// the server may have got the commands before
+			// closing the connection
+			return nil, err
+		}
+		retry = false
+	}
+}
+
+// readOnlyCommands are commands which may be sent
+// twice as they don't change data.
+var readOnlyCommands = map[string]bool{
+	"ping":          true,
+	"get":           true,
+	"mget":          true,
+	"getrange":      true,
+	"strlen":        true,
+	"lget":          true,
+	"lgetit":        true,
+	"lrange":        true,
+	"llen":          true,
+	"hget":          true,
+	"hgetval":       true,
+	"hmget":         true,
+	"hexists":       true,
+	"hkeys":         true,
+	"hvals":         true,
+	"hlen":          true,
+	"hscan":         true,
+	"smembers":      true,
+	"sismember":     true,
+	"scard":         true,
+	"sinter":        true,
+	"sunion":        true,
+	"sdiff":         true,
+	"zrange":        true,
+	"zrangebyscore": true,
+	"zrevrange":     true,
+	"zscore":        true,
+	"zrank":         true,
+	"zcard":         true,
+	"zcount":        true,
+	"keys":          true,
+	"scan":          true,
+	"exists":        true,
+	"type":          true,
+	"ttl":           true,
+	"pttl":          true,
+	"expiretime":    true,
+	"pexpiretime":   true,
+	"dbsize":        true,
+}
+
+// readOnly reports whether all cmds are read-only.
+func readOnly(cmds [][]string) bool {
+	for _, args := range cmds {
+		if len(args) == 0 || !readOnlyCommands[strings.ToLower(args[0])] {
+			return false
+		}
+	}
+	return true
+}
+
+// get takes an idle connection or dials a new one
+// and reports whether the connection has been used.
+// It waits while all connections are busy.
+func (c *Client) get(ctx context.Context) (*conn, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, false, ErrClosed
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, true, nil
+	default:
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, true, nil
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	cn, err := c.dial(ctx)
+	if err != nil {
+		<-c.slots
+		return nil, false, err
+	}
+	return cn, false, nil
+}
+
+// put returns cn to the pool or closes it if it is broken.
+func (c *Client) put(cn *conn, broken bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if broken || c.closed {
+		cn.close()
+		<-c.slots
+		return
+	}
+	c.idle <- cn
+}
+
+// dial connects to the server and selects the database.
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := newConn(nc)
+	if c.opts.DB != 0 {
+		replies, err := cn.roundTrip(ctx, [][]string{{"select", strconv.Itoa(c.opts.DB)}})
+		if err == nil {
+			err, _ = replies[0].(error)
+		}
+		if err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// isClosedByPeer reports whether err means that
+// the server has closed the connection.
+func isClosedByPeer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
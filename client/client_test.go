@@ -0,0 +1,257 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"redis-like/server"
+)
+
+// startServer serves an in-process server on addr
+// until the returned function is called.
+func startServer(t *testing.T, addr string) (net.Addr, func()) {
+	t.Helper()
+	srv, err := server.New(server.Config{Addr: "test"})
+	if err != nil {
+		t.Fatalf("server error: %v", err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	go srv.Serve(ln)
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+		})
+	}
+	t.Cleanup(stop)
+	return ln.Addr(), stop
+}
+
+// newTestClient returns a client of a new in-process server.
+func newTestClient(t *testing.T, opts Options) *Client {
+	t.Helper()
+	addr, _ := startServer(t, "127.0.0.1:0")
+	opts.Addr = addr.String()
+	c := New(opts)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestTypedCommands(t *testing.T) {
+	c := newTestClient(t, Options{})
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping error: %v", err)
+	}
+	if _, err := c.Get(ctx, "key"); err != ErrNotExist {
+		t.Fatalf("got '%v', want '%v'", err, ErrNotExist)
+	}
+	if err := c.Set(ctx, "key", "value"); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if got, err := c.Get(ctx, "key"); got != "value" || err != nil {
+		t.Fatalf("Get = %q, %v, want 'value'", got, err)
+	}
+
+	if err := c.LSet(ctx, "list", []string{"a", "b"}); err != nil {
+		t.Fatalf("LSet error: %v", err)
+	}
+	if err := c.LUpdate(ctx, "list", 1, "c"); err != nil {
+		t.Fatalf("LUpdate error: %v", err)
+	}
+	if items, err := c.LGet(ctx, "list"); fmt.Sprint(items) != "[a c]" || err != nil {
+		t.Fatalf("LGet = %v, %v, want [a c]", items, err)
+	}
+	if item, err := c.LGetIt(ctx, "list", 0); item != "a" || err != nil {
+		t.Fatalf("LGetIt = %q, %v, want 'a'", item, err)
+	}
+	if _, err := c.LGetIt(ctx, "missing", 0); err != ErrNotExist {
+		t.Fatalf("got '%v', want '%v'", err, ErrNotExist)
+	}
+	var e Error
+	if _, err := c.Get(ctx, "list"); !errors.As(err, &e) {
+		t.Fatalf("got '%v', want error reply of the server", err)
+	}
+
+	if err := c.HSet(ctx, "hash", map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatalf("HSet error: %v", err)
+	}
+	if err := c.HUpdate(ctx, "hash", "b", "3"); err != nil {
+		t.Fatalf("HUpdate error: %v", err)
+	}
+	if dict, err := c.HGet(ctx, "hash"); fmt.Sprint(dict) != "map[a:1 b:3]" || err != nil {
+		t.Fatalf("HGet = %v, %v, want map[a:1 b:3]", dict, err)
+	}
+	if _, err := c.HGetVal(ctx, "hash", "c"); err != ErrNotExist {
+		t.Fatalf("got '%v', want '%v'", err, ErrNotExist)
+	}
+
+	if err := c.Expire(ctx, "key", 100); err != nil {
+		t.Fatalf("Expire error: %v", err)
+	}
+	if ttl, err := c.TTL(ctx, "key"); ttl != 100 || err != nil {
+		t.Fatalf("TTL = %d, %v, want 100", ttl, err)
+	}
+	if err := c.Persist(ctx, "key"); err != nil {
+		t.Fatalf("Persist error: %v", err)
+	}
+	if ttl, _ := c.TTL(ctx, "key"); ttl != -1 {
+		t.Fatalf("got %d, want -1", ttl)
+	}
+	if err := c.Expire(ctx, "missing", 100); err != ErrNotExist {
+		t.Fatalf("got '%v', want '%v'", err, ErrNotExist)
+	}
+	if _, err := c.TTL(ctx, "missing"); err != ErrNotExist {
+		t.Fatalf("got '%v', want '%v'", err, ErrNotExist)
+	}
+	if n, err := c.Del(ctx, "key", "list", "missing"); n != 2 || err != nil {
+		t.Fatalf("Del = %d, %v, want 2", n, err)
+	}
+	if keys, err := c.Keys(ctx); fmt.Sprint(keys) != "[hash]" || err != nil {
+		t.Fatalf("Keys = %v, %v, want [hash]", keys, err)
+	}
+}
+
+func TestSelectedDb(t *testing.T) {
+	c := newTestClient(t, Options{DB: 1})
+	ctx := context.Background()
+	if err := c.Set(ctx, "key", "value"); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	other := New(Options{Addr: c.opts.Addr})
+	defer other.Close()
+	if _, err := other.Get(ctx, "key"); err != ErrNotExist {
+		t.Fatalf("got '%v', key should be set in database 1", err)
+	}
+	bad := New(Options{Addr: c.opts.Addr, DB: 100})
+	defer bad.Close()
+	if err := bad.Ping(ctx); err == nil {
+		t.Fatal("connection to a missing database should fail")
+	}
+}
+
+func TestConcurrentPool(t *testing.T) {
+	c := newTestClient(t, Options{PoolSize: 2})
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := c.IncrBy(ctx, "counter", 1); err != nil {
+					t.Errorf("IncrBy error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got, _ := c.Get(ctx, "counter"); got != "1000" {
+		t.Fatalf("got %s, want 1000", got)
+	}
+	if n := len(c.slots); n > 2 {
+		t.Fatalf("got %d connections, want at most 2", n)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	c := newTestClient(t, Options{})
+	p := c.Pipeline()
+	p.Queue("set", "key", "1")
+	p.Queue("incr", "key")
+	p.Queue("get", "missing")
+	p.Queue("lget", "key")
+	if p.Len() != 4 {
+		t.Fatalf("got %d queued commands, want 4", p.Len())
+	}
+	replies, err := p.Exec(context.Background())
+	if err != nil {
+		t.Fatalf("Exec error: %v", err)
+	}
+	if fmt.Sprint(replies[:3]) != "[OK 2 <nil>]" {
+		t.Fatalf("got %v, want [OK 2 <nil>]", replies[:3])
+	}
+	if _, ok := replies[3].(Error); !ok {
+		t.Fatalf("got %v, want error reply", replies[3])
+	}
+	if p.Len() != 0 {
+		t.Fatal("pipeline should be empty after Exec")
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	c := newTestClient(t, Options{PoolSize: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(ctx, "blpop", "queue", "0"); err != context.DeadlineExceeded {
+		t.Fatalf("got '%v', want '%v'", err, context.DeadlineExceeded)
+	}
+	// the interrupted connection is replaced
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping error: %v", err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Ping(canceled); err != context.Canceled {
+		t.Fatalf("got '%v', want '%v'", err, context.Canceled)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	addr, stop := startServer(t, "127.0.0.1:0")
+	c := New(Options{Addr: addr.String()})
+	defer c.Close()
+	ctx := context.Background()
+	if err := c.Set(ctx, "key", "value"); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	stop()
+	startServer(t, addr.String())
+	// the idle connection to the old server is replaced
+	if _, err := c.Get(ctx, "key"); err != ErrNotExist {
+		t.Fatalf("got '%v', want '%v' from the new server", err, ErrNotExist)
+	}
+	c.Close()
+	if err := c.Ping(ctx); err != ErrClosed {
+		t.Fatalf("got '%v', want '%v'", err, ErrClosed)
+	}
+}
+
+func TestNoRetryOfWrites(t *testing.T) {
+	addr, stop := startServer(t, "127.0.0.1:0")
+	c := New(Options{Addr: addr.String(), PoolSize: 1})
+	defer c.Close()
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping error: %v", err)
+	}
+	stop()
+	addr, stop = startServer(t, addr.String())
+	// the old server may have executed the command
+	// before closing the connection
+	if _, err := c.IncrBy(ctx, "counter", 1); !isClosedByPeer(err) {
+		t.Fatalf("got '%v', write shouldn't be retried", err)
+	}
+	if n, err := c.IncrBy(ctx, "counter", 1); n != 1 || err != nil {
+		t.Fatalf("IncrBy = %d, %v, want 1", n, err)
+	}
+
+	stop()
+	startServer(t, addr.String())
+	p := c.Pipeline()
+	p.Queue("get", "counter")
+	if _, err := p.Exec(ctx); !isClosedByPeer(err) {
+		t.Fatalf("got '%v', pipeline shouldn't be retried", err)
+	}
+}
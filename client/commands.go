@@ -0,0 +1,271 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// Typed commands mirror methods of server.DataMap. They
+// return ErrNotExist where DataMap returns its "key not
+// exists" error and Error for other errors of the server.
+
+// Ping checks that the server is available.
+func (c *Client) Ping(ctx context.Context) error {
+	return okResult(c.Do(ctx, "ping"))
+}
+
+// Set sets string by key removing its ttl.
+func (c *Client) Set(ctx context.Context, key, val string) error {
+	return okResult(c.Do(ctx, "set", key, val))
+}
+
+// PSetEx sets string by key with ttl of dur milliseconds.
+func (c *Client) PSetEx(ctx context.Context, key string, dur int64, val string) error {
+	return okResult(c.Do(ctx, "psetex", key, itoa(dur), val))
+}
+
+// Get gets string by key.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return stringResult(c.Do(ctx, "get", key))
+}
+
+// IncrBy increments integer stored by key by incr
+// and returns the new value.
+func (c *Client) IncrBy(ctx context.Context, key string, incr int64) (int64, error) {
+	return intResult(c.Do(ctx, "incrby", key, itoa(incr)))
+}
+
+// LSet sets list by key.
+func (c *Client) LSet(ctx context.Context, key string, val []string) error {
+	return okResult(c.Do(ctx, append([]string{"lset", key}, val...)...))
+}
+
+// LGet gets list by key.
+func (c *Client) LGet(ctx context.Context, key string) ([]string, error) {
+	return stringsResult(c.Do(ctx, "lget", key))
+}
+
+// LGetIt gets item of list stored by key by index.
+func (c *Client) LGetIt(ctx context.Context, key string, index int) (string, error) {
+	return stringResult(c.Do(ctx, "lgetit", key, strconv.Itoa(index)))
+}
+
+// LUpdate sets item of list stored by key by index.
+func (c *Client) LUpdate(ctx context.Context, key string, index int, value string) error {
+	return okResult(c.Do(ctx, "lupdate", key, strconv.Itoa(index), value))
+}
+
+// LPush prepends items to list stored by key
+// and returns its new length.
+func (c *Client) LPush(ctx context.Context, key string, items ...string) (int, error) {
+	n, err := intResult(c.Do(ctx, append([]string{"lpush", key}, items...)...))
+	return int(n), err
+}
+
+// RPush appends items to list stored by key
+// and returns its new length.
+func (c *Client) RPush(ctx context.Context, key string, items ...string) (int, error) {
+	n, err := intResult(c.Do(ctx, append([]string{"rpush", key}, items...)...))
+	return int(n), err
+}
+
+// LRange gets items of list stored by key from start
+// to stop inclusive, negative indexes count from the end.
+func (c *Client) LRange(ctx context.Context, key string, start, stop int) ([]string, error) {
+	return stringsResult(c.Do(ctx, "lrange", key, strconv.Itoa(start), strconv.Itoa(stop)))
+}
+
+// LLen gets length of list stored by key.
+func (c *Client) LLen(ctx context.Context, key string) (int, error) {
+	n, err := intResult(c.Do(ctx, "llen", key))
+	return int(n), err
+}
+
+// HSet sets fields of hash stored by key.
+func (c *Client) HSet(ctx context.Context, key string, val map[string]string) error {
+	args := make([]string, 0, 2+2*len(val))
+	args = append(args, "hset", key)
+	for field, value := range val {
+		args = append(args, field, value)
+	}
+	return okResult(c.Do(ctx, args...))
+}
+
+// HGet gets hash by key.
+func (c *Client) HGet(ctx context.Context, key string) (map[string]string, error) {
+	items, err := stringsResult(c.Do(ctx, "hget", key))
+	if err != nil {
+		return nil, err
+	}
+	if len(items)%2 != 0 {
+		return nil, fmt.Errorf("%v: odd number of hash items", protocolErr)
+	}
+	dict := make(map[string]string, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		dict[items[i]] = items[i+1]
+	}
+	return dict, nil
+}
+
+// HGetVal gets value of field of hash stored by key.
+func (c *Client) HGetVal(ctx context.Context, key, field string) (string, error) {
+	return stringResult(c.Do(ctx, "hgetval", key, field))
+}
+
+// HUpdate sets value of field of hash stored by key.
+func (c *Client) HUpdate(ctx context.Context, key, field, value string) error {
+	return okResult(c.Do(ctx, "hupdate", key, field, value))
+}
+
+// SAdd adds members to set stored by key and
+// returns the number of added ones.
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) (int, error) {
+	n, err := intResult(c.Do(ctx, append([]string{"sadd", key}, members...)...))
+	return int(n), err
+}
+
+// SMembers gets members of set stored by key.
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	return stringsResult(c.Do(ctx, "smembers", key))
+}
+
+// Keys gets all keys of the database.
+func (c *Client) Keys(ctx context.Context) ([]string, error) {
+	return stringsResult(c.Do(ctx, "keys"))
+}
+
+// KeysMatch gets keys of the database matching
+// glob-style pattern.
+func (c *Client) KeysMatch(ctx context.Context, pattern string) ([]string, error) {
+	return stringsResult(c.Do(ctx, "keys", pattern))
+}
+
+// Del removes keys and returns the number of removed ones.
+func (c *Client) Del(ctx context.Context, keys ...string) (int, error) {
+	n, err := intResult(c.Do(ctx, append([]string{"del"}, keys...)...))
+	return int(n), err
+}
+
+// Exists returns the number of existing keys.
+func (c *Client) Exists(ctx context.Context, keys ...string) (int, error) {
+	n, err := intResult(c.Do(ctx, append([]string{"exists"}, keys...)...))
+	return int(n), err
+}
+
+// Remove removes key.
+func (c *Client) Remove(ctx context.Context, key string) error {
+	return okResult(c.Do(ctx, "remove", key))
+}
+
+// Expire sets ttl of key to dur seconds.
+func (c *Client) Expire(ctx context.Context, key string, dur int64) error {
+	return okResult(c.Do(ctx, "expire", key, itoa(dur)))
+}
+
+// PExpire sets ttl of key to dur milliseconds.
+func (c *Client) PExpire(ctx context.Context, key string, dur int64) error {
+	return okResult(c.Do(ctx, "pexpire", key, itoa(dur)))
+}
+
+// Expireat sets expiration of key as unix time in seconds.
+func (c *Client) Expireat(ctx context.Context, key string, ttl int64) error {
+	return okResult(c.Do(ctx, "expireat", key, itoa(ttl)))
+}
+
+// PExpireat sets expiration of key as unix
+// time in milliseconds.
+func (c *Client) PExpireat(ctx context.Context, key string, ttl int64) error {
+	return okResult(c.Do(ctx, "pexpireat", key, itoa(ttl)))
+}
+
+// Persist removes ttl of key.
+func (c *Client) Persist(ctx context.Context, key string) error {
+	return okResult(c.Do(ctx, "persist", key))
+}
+
+// TTL gets remaining time to live of key in seconds.
+// It is -1 if key has no ttl.
+func (c *Client) TTL(ctx context.Context, key string) (int64, error) {
+	return ttlResult(c.Do(ctx, "ttl", key))
+}
+
+// PTTL gets remaining time to live of key in
+// milliseconds. It is -1 if key has no ttl.
+func (c *Client) PTTL(ctx context.Context, key string) (int64, error) {
+	return ttlResult(c.Do(ctx, "pttl", key))
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// okResult checks reply of a command which returns OK.
+func okResult(res interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+	if _, ok := res.(string); !ok {
+		return fmt.Errorf("%v: unexpected reply %v", protocolErr, res)
+	}
+	return nil
+}
+
+// stringResult converts reply to a string, nil
+// reply means that the key doesn't exist.
+func stringResult(res interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch x := res.(type) {
+	case nil:
+		return "", ErrNotExist
+	case string:
+		return x, nil
+	}
+	return "", fmt.Errorf("%v: unexpected reply %v", protocolErr, res)
+}
+
+// intResult converts reply to an integer.
+func intResult(res interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%v: unexpected reply %v", protocolErr, res)
+	}
+	return n, nil
+}
+
+// ttlResult converts reply of TTL or PTTL,
+// -2 means that the key doesn't exist.
+func ttlResult(res interface{}, err error) (int64, error) {
+	ttl, err := intResult(res, err)
+	if err == nil && ttl == -2 {
+		return 0, ErrNotExist
+	}
+	return ttl, err
+}
+
+// stringsResult converts array reply to strings, nil
+// reply means that the key doesn't exist.
+func stringsResult(res interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, ErrNotExist
+	}
+	items, ok := res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: unexpected reply %v", protocolErr, res)
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		if strs[i], ok = item.(string); !ok {
+			return nil, fmt.Errorf("%v: unexpected item %v", protocolErr, item)
+		}
+	}
+	return strs, nil
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var protocolErr = errors.New("ERROR: protocol error")
+
+// conn is a connection to the server speaking RESP2.
+type conn struct {
+	nc  net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	out countingWriter // counts bytes sent to nc
+}
+
+func newConn(nc net.Conn) *conn {
+	cn := &conn{nc: nc, r: bufio.NewReader(nc), out: countingWriter{w: nc}}
+	cn.w = bufio.NewWriter(&cn.out)
+	return cn
+}
+
+// countingWriter counts bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cn *conn) close() error {
+	return cn.nc.Close()
+}
+
+// roundTrip writes cmds and reads a reply for each of them.
+// Error replies are returned as values of error type,
+// the returned error means that cn is broken.
+func (cn *conn) roundTrip(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	deadline, _ := ctx.Deadline()
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// cancellation interrupts waiting for the server
+	stop := context.AfterFunc(ctx, func() {
+		cn.nc.SetDeadline(time.Unix(1, 0))
+	})
+	replies, err := cn.exchange(cmds)
+	interrupted := !stop()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// the deadline of ctx may pass before ctx is done
+		if err = ctx.Err(); err == nil {
+			err = context.DeadlineExceeded
+		}
+	}
+	if interrupted && err == nil {
+		// the deadline may be changed at any moment now,
+		// so cn can't be used anymore
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// exchange writes cmds in one batch and reads their replies.
+func (cn *conn) exchange(cmds [][]string) ([]interface{}, error) {
+	for _, args := range cmds {
+		writeCommand(cn.w, args)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		reply, err := readReply(cn.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// writeCommand encodes args as RESP array of bulk strings.
+func writeCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readLine reads a line from r without trailing CRLF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readReply reads a single RESP2 reply from r. Error replies
+// are returned as Error values, a reply about a missing key
+// is returned as ErrNotExist.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%v: empty reply", protocolErr)
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		if e := Error(line[1:]); e != notExistReply {
+			return e, nil
+		}
+		return ErrNotExist, nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid integer %q", protocolErr, line[1:])
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid length %q", protocolErr, line[1:])
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid length %q", protocolErr, line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%v: unexpected reply %q", protocolErr, line)
+}
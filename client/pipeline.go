@@ -0,0 +1,41 @@
+package client
+
+import "context"
+
+// Pipeline queues commands and sends them to the server
+// in one batch, so they cost a single round trip. It isn't
+// a transaction: commands of other clients may run between
+// the queued ones. A Pipeline isn't safe for concurrent use.
+type Pipeline struct {
+	c    *Client
+	cmds [][]string
+}
+
+// Pipeline returns an empty pipeline of c.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Queue adds command with args to p.
+func (p *Pipeline) Queue(args ...string) {
+	p.cmds = append(p.cmds, args)
+}
+
+// Len returns the number of queued commands.
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends queued commands and returns their replies in
+// the same order, error replies are kept in the slice. The
+// returned error means replies haven't been received, some
+// of the commands may have been executed though, so they
+// aren't sent again. p is empty after Exec and may be reused.
+func (p *Pipeline) Exec(ctx context.Context) ([]interface{}, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	return p.c.roundTrip(ctx, cmds, false)
+}
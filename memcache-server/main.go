@@ -3,29 +3,81 @@ package main
 import (
 	"redis-like/server"
 
+	"context"
 	"flag"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var host string = "localhost"
 var port = flag.String("port", "8000", "sever port")
-var addr string
+var databases = flag.Int("databases", 16, "number of databases")
+var dir = flag.String("dir", ".", "directory for the snapshot file")
+var dbfilename = flag.String("dbfilename", "dump.rls", "snapshot file name")
+var appendonly = flag.Bool("appendonly", false, "log every write command to the append only file")
+var appendfilename = flag.String("appendfilename", "appendonly.aof", "append only file name")
+var appendfsync = flag.String("appendfsync", "everysec", "fsync policy of the append only file: always, everysec or no")
+var autoAofRewritePercentage = flag.Int64("auto-aof-rewrite-percentage", 100, "rewrite the append only file when it grows by this percentage, 0 disables automatic rewrites")
+var autoAofRewriteMinSize = flag.Int64("auto-aof-rewrite-min-size", 64*1024*1024, "minimal size of the append only file to be rewritten automatically")
+var maxmemory = flag.String("maxmemory", "0", "memory limit for data, e.g. 100mb, 0 means no limit")
+var maxmemoryPolicy = flag.String("maxmemory-policy", "noeviction", "how keys are evicted when maxmemory is reached: "+
+	"noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru or volatile-ttl")
+var replicaof = flag.String("replicaof", "", "follow the master at \"host port\"")
+var replBacklogSize = flag.String("repl-backlog-size", "1mb", "size of the replication backlog for partial resynchronization")
+var clusterEnabled = flag.Bool("cluster-enabled", false, "run the server as a node of a cluster")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long running commands may finish on shutdown")
 
 func main() {
 	flag.Parse()
-	addr = host + ":" + *port
+	maxMemory, err := server.ParseMemory(*maxmemory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backlogSize, err := server.ParseMemory(*replBacklogSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := host + ":" + *port
+	srv, err := server.New(server.Config{
+		Addr:                     addr,
+		Databases:                *databases,
+		Dir:                      *dir,
+		DbFilename:               *dbfilename,
+		AppendOnly:               *appendonly,
+		AppendFilename:           *appendfilename,
+		AppendFsync:              *appendfsync,
+		AutoAofRewritePercentage: *autoAofRewritePercentage,
+		AutoAofRewriteMinSize:    *autoAofRewriteMinSize,
+		MaxMemory:                maxMemory,
+		MaxMemoryPolicy:          *maxmemoryPolicy,
+		ReplicaOf:                *replicaof,
+		ReplBacklogSize:          backlogSize,
+		ClusterEnabled:           *clusterEnabled,
+		ShutdownTimeout:          *shutdownTimeout,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Print(err)
-			continue
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("%v received, shutting down\n", <-sigs)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown error: %v\n", err)
 		}
-		go server.HandleConn(conn, addr)
+	}()
+	if err := srv.Serve(listener); err != server.ErrServerClosed {
+		log.Fatal(err)
 	}
+	log.Print("server is stopped")
 }
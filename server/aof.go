@@ -0,0 +1,530 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fsync policies of the append only file.
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+)
+
+var badFsyncPolicyErr = errors.New("ERROR: fsync policy must be one of always, everysec or no")
+
+// appendOnlyFile logs every command which changes data,
+// so databases may be restored by replaying the log.
+type appendOnlyFile struct {
+	srv    *Server
+	mu     sync.Mutex
+	path   string
+	fsync  string
+	f      *os.File
+	w      *bufio.Writer
+	dbId   string // database of the last logged command
+	dirty  bool   // there are writes which aren't synced yet
+	size   int64
+	closed chan struct{}
+
+	baseSize    int64         // size after the last rewrite
+	rewriting   bool          // background rewrite is in progress
+	rewriteBuf  *bytes.Buffer // commands logged during the rewrite
+	rewriteDbId string        // database of the last buffered command
+}
+
+var aofDisabledErr = errors.New("ERROR: append only file is disabled")
+var aofRewriteInProgressErr = errors.New("ERROR: background append only file rewriting already in progress")
+
+// checkFsyncPolicy returns error if fsync isn't
+// one of always, everysec or no.
+func checkFsyncPolicy(fsync string) error {
+	switch fsync {
+	case fsyncAlways, fsyncEverySec, fsyncNo:
+		return nil
+	}
+	return badFsyncPolicyErr
+}
+
+// loadAppendOnly replays the append only file of s and
+// opens it to log new commands. A truncated last
+// command is dropped from the file.
+func (s *Server) loadAppendOnly() error {
+	path := filepath.Join(s.cfg.Dir, s.cfg.AppendFilename)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := s.replayAppendOnly(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.aof = newAppendOnlyFile(s, f, path, s.cfg.AppendFsync, size)
+	return nil
+}
+
+// newAppendOnlyFile creates appendOnlyFile of s writing to f.
+func newAppendOnlyFile(s *Server, f *os.File, path, fsync string, size int64) *appendOnlyFile {
+	a := &appendOnlyFile{
+		srv:      s,
+		path:     path,
+		fsync:    fsync,
+		f:        f,
+		w:        bufio.NewWriter(f),
+		size:     size,
+		baseSize: size,
+		closed:   make(chan struct{}),
+	}
+	if fsync == fsyncEverySec {
+		go a.syncEverySecond()
+	}
+	return a
+}
+
+// countingReader counts bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// replayAppendOnly executes all commands from r in s.
+// It returns size of the valid part of the log.
+func (s *Server) replayAppendOnly(r io.Reader) (int64, error) {
+	// keys don't expire until all commands are replayed,
+	// they may be changed by later commands of the log
+	atomic.StoreInt32(&s.loading, 1)
+	defer atomic.StoreInt32(&s.loading, 0)
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	dm := s.getDb(defaultDbIndex)
+	var valid int64
+	var n int
+	for {
+		args, err := readRESPCommand(br)
+		if err == io.EOF {
+			log.Printf("append only file: %d commands loaded\n", n)
+			return valid, nil
+		}
+		if err != nil {
+			log.Printf("append only file is truncated after %d commands: %v\n", n, err)
+			return valid, nil
+		}
+		valid = cr.n - int64(br.Buffered())
+		if len(args) == 0 {
+			continue
+		}
+		if err := replayCommand(&dm, args); err != nil {
+			return 0, fmt.Errorf("ERROR: bad command %q in append only file: %v", args, err)
+		}
+		n++
+	}
+}
+
+// replayCommand executes a single logged command. SELECT
+// switches dm to another database of the same server.
+func replayCommand(dm **DataMap, args []string) error {
+	cmd := strings.ToLower(args[0])
+	switch cmd {
+	case "select":
+		if len(args) != 2 {
+			return fewArgsErr
+		}
+		other, err := (*dm).srv.db(args[1])
+		if err != nil {
+			return err
+		}
+		*dm = other
+		return nil
+	case "expireat", "pexpireat":
+		// the deadline may have passed while the server was
+		// down, the key is removed by expiration then
+		if len(args) == 3 {
+			ttl, err := strconv.ParseInt(args[2], 10, 64)
+			if cmd == "expireat" {
+				ttl *= 1000
+			}
+			if err == nil && ttl > 0 {
+				return (*dm).setDeadline(args[1], ttl)
+			}
+		}
+	}
+	_, err := execute(*dm, cmd, args[1:])
+	return err
+}
+
+// feed appends cmds executed in dm to the log.
+func (a *appendOnlyFile) feed(dm *DataMap, cmds [][]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return
+	}
+	for _, args := range cmds {
+		if dm.DbId != a.dbId {
+			a.size += int64(writeCommand(a.w, []string{"select", dm.DbId}))
+			a.dbId = dm.DbId
+		}
+		a.size += int64(writeCommand(a.w, args))
+		if a.rewriting {
+			if dm.DbId != a.rewriteDbId {
+				writeCommand(a.rewriteBuf, []string{"select", dm.DbId})
+				a.rewriteDbId = dm.DbId
+			}
+			writeCommand(a.rewriteBuf, args)
+		}
+	}
+	if err := a.w.Flush(); err != nil {
+		log.Printf("append only file write error: %v\n", err)
+		return
+	}
+	a.dirty = true
+	if a.fsync == fsyncAlways {
+		a.sync()
+	}
+}
+
+// writeCommand encodes args as RESP array to w.
+// It returns number of written bytes.
+func writeCommand(w io.Writer, args []string) int {
+	n, _ := fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		m, _ := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		n += m
+	}
+	return n
+}
+
+// sync flushes the log to disk. It must be
+// called with a.mu held.
+func (a *appendOnlyFile) sync() {
+	if !a.dirty {
+		return
+	}
+	if err := a.f.Sync(); err != nil {
+		log.Printf("append only file fsync error: %v\n", err)
+		return
+	}
+	a.dirty = false
+}
+
+// syncEverySecond flushes the log to disk
+// once per second until a is closed.
+func (a *appendOnlyFile) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.closed:
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			a.sync()
+			a.mu.Unlock()
+		}
+	}
+}
+
+// Close flushes and closes the log.
+func (a *appendOnlyFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return nil
+	}
+	close(a.closed)
+	a.w.Flush()
+	a.sync()
+	err := a.f.Close()
+	a.w = nil
+	return err
+}
+
+// zeroResultCommands are write commands which
+// change nothing if they return 0.
+var zeroResultCommands = map[string]bool{
+	"setnx":    true,
+	"msetnx":   true,
+	"del":      true,
+	"unlink":   true,
+	"renamenx": true,
+	"copy":     true,
+	"move":     true,
+}
+
+// aofCommands converts cmd executed in dm with result res
+// to commands which are safe to replay later. Relative
+// expiration is logged as absolute one and random
+// choices are logged as their results.
+func aofCommands(dm *DataMap, cmd string, args []string, res interface{}) [][]string {
+	switch {
+	case cmd == "spop":
+		var members []string
+		switch x := res.(type) {
+		case string:
+			members = []string{x}
+		case []string:
+			members = x
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		return [][]string{append([]string{"srem", args[0]}, members...)}
+	case cmd == "incrbyfloat":
+		// the result is logged, so it doesn't depend on float rounding
+		value, _ := res.(string)
+		return setCommands(dm, args[0], value)
+	case cmd == "getex":
+		switch {
+		case res == nil || len(args) == 1:
+			return nil
+		case strings.ToLower(args[1]) == "persist":
+			return [][]string{{"persist", args[0]}}
+		}
+		return [][]string{pexpireatCommand(dm, args[0])}
+	case (cmd == "expire" || cmd == "pexpire") && len(args) > 0:
+		return [][]string{pexpireatCommand(dm, args[0])}
+	case cmd == "set" && len(args) > 2:
+		opts, _ := parseSetOptions(args[2:])
+		var set bool
+		switch {
+		case opts.get && opts.nx:
+			set = res == nil
+		case opts.get && !opts.xx:
+			set = true
+		default:
+			set = res != nil
+		}
+		if !set {
+			return nil
+		}
+		return setCommands(dm, args[0], args[1])
+	case (cmd == "setex" || cmd == "psetex") && len(args) > 2:
+		return setCommands(dm, args[0], args[2])
+	case zeroResultCommands[cmd] && isZero(res):
+		// nothing has been changed
+		return nil
+	}
+	return [][]string{append([]string{cmd}, args...)}
+}
+
+// isZero reports whether res is an integer reply 0.
+func isZero(res interface{}) bool {
+	switch x := res.(type) {
+	case int:
+		return x == 0
+	case int64:
+		return x == 0
+	}
+	return false
+}
+
+// setCommands returns commands which set key to value
+// keeping the current ttl of key.
+func setCommands(dm *DataMap, key, value string) [][]string {
+	cmds := [][]string{{"set", key, value}}
+	if dm.deadline(key) > 0 {
+		cmds = append(cmds, pexpireatCommand(dm, key))
+	}
+	return cmds
+}
+
+// pexpireatCommand returns PEXPIREAT command
+// which restores the current ttl of key.
+func pexpireatCommand(dm *DataMap, key string) []string {
+	return []string{"pexpireat", key, strconv.FormatInt(dm.deadline(key), 10)}
+}
+
+// needsRewrite reports whether the log has grown
+// enough to be rewritten automatically.
+func (a *appendOnlyFile) needsRewrite() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	percentage := a.srv.cfg.AutoAofRewritePercentage
+	if a.rewriting || a.w == nil || percentage <= 0 {
+		return false
+	}
+	return a.size >= a.srv.cfg.AutoAofRewriteMinSize &&
+		a.size >= a.baseSize+a.baseSize*percentage/100
+}
+
+// startRewrite rewrites the log in background. The new log
+// is built from a snapshot of all databases, commands logged
+// meanwhile are buffered and appended to the new log
+// before it replaces the old one. It must be called with
+// propagateMu held, so the snapshot and the buffer
+// don't miss or repeat any command.
+func (a *appendOnlyFile) startRewrite() error {
+	a.mu.Lock()
+	if a.w == nil {
+		a.mu.Unlock()
+		return aofDisabledErr
+	}
+	if a.rewriting {
+		a.mu.Unlock()
+		return aofRewriteInProgressErr
+	}
+	a.rewriting = true
+	a.rewriteBuf = new(bytes.Buffer)
+	a.rewriteDbId = ""
+	a.mu.Unlock()
+	dbs := a.srv.takeSnapshot()
+	go func() {
+		if err := a.rewrite(dbs); err != nil {
+			log.Printf("background append only file rewriting error: %v\n", err)
+			a.mu.Lock()
+			a.rewriting = false
+			a.rewriteBuf = nil
+			a.mu.Unlock()
+			return
+		}
+		log.Printf("background append only file rewriting terminated with success\n")
+	}()
+	return nil
+}
+
+// rewrite writes minimal log which restores dbs, appends
+// buffered commands and replaces the log with it.
+func (a *appendOnlyFile) rewrite(dbs []dbSnapshot) error {
+	defer func() {
+		for _, db := range dbs {
+			db.release()
+		}
+	}()
+	tmp := fmt.Sprintf("%s.rewrite-%d", a.path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var dbId string
+	for _, db := range dbs {
+		if len(db.entries) == 0 {
+			continue
+		}
+		writeCommand(w, []string{"select", db.id})
+		dbId = db.id
+		for _, e := range db.entries {
+			if args := restoreCommand(e); args != nil {
+				writeCommand(w, args)
+				if e.ttl > 0 {
+					writeCommand(w, []string{"pexpireat", e.key, strconv.FormatInt(e.ttl, 10)})
+				}
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		f.Close()
+		os.Remove(tmp)
+		return aofDisabledErr
+	}
+	if _, err := a.rewriteBuf.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.w.Flush()
+	a.f.Close()
+	a.f = f
+	a.w = bufio.NewWriter(f)
+	a.dbId = dbId
+	if a.rewriteDbId != "" {
+		a.dbId = a.rewriteDbId
+	}
+	a.size = size
+	a.baseSize = size
+	a.dirty = false
+	a.rewriting = false
+	a.rewriteBuf = nil
+	return nil
+}
+
+// restoreCommand returns a command which creates e.
+// It returns nil for values which can't be restored,
+// e.g. empty lists.
+func restoreCommand(e snapshotEntry) []string {
+	switch x := e.value.(type) {
+	case string:
+		return []string{"set", e.key, x}
+	case int64:
+		return []string{"set", e.key, strconv.FormatInt(x, 10)}
+	case *list:
+		if x.len() == 0 {
+			return nil
+		}
+		return append([]string{"lset", e.key}, x.items()...)
+	case map[string]string:
+		if len(x) == 0 {
+			return nil
+		}
+		args := []string{"hset", e.key}
+		for k, v := range x {
+			args = append(args, k, v)
+		}
+		return args
+	case map[string]struct{}:
+		if len(x) == 0 {
+			return nil
+		}
+		return append([]string{"sadd", e.key}, setMembers(x)...)
+	case *zset:
+		if x.len() == 0 {
+			return nil
+		}
+		args := []string{"zadd", e.key}
+		for n := x.zsl.header.level[0].forward; n != nil; n = n.level[0].forward {
+			args = append(args, formatFloat(n.score), n.member)
+		}
+		return args
+	}
+	return nil
+}
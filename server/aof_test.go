@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendOnlyFeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAppendOnlyFile(nil, f, path, fsyncAlways, 0)
+	var dm DataMap
+	dm.Init()
+	dm.DbId = "aof"
+	dm.Set("key", "value")
+	dm.Expire("key", 100)
+	a.feed(&dm, aofCommands(&dm, "set", []string{"key", "value"}, nil))
+	a.feed(&dm, aofCommands(&dm, "expire", []string{"key", "100"}, nil))
+	a.Close()
+	content, _ := os.ReadFile(path)
+	want := fmt.Sprintf("*2\r\n$6\r\nselect\r\n$3\r\naof\r\n"+
+		"*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"+
+		"*3\r\n$9\r\npexpireat\r\n$3\r\nkey\r\n$13\r\n%d\r\n", dm.deadline("key"))
+	if string(content) != want {
+		t.Fatalf("got %q, want %q", content, want)
+	}
+	if a.size != int64(len(want)) {
+		t.Fatalf("got %d size, want %d", a.size, len(want))
+	}
+}
+
+func TestReplayAppendOnly(t *testing.T) {
+	past := time.Now().UTC().Unix() - 10
+	entries := "*2\r\n$6\r\nselect\r\n$1\r\n3\r\n" +
+		"*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n" +
+		"*3\r\n$3\r\nset\r\n$3\r\nold\r\n$5\r\nvalue\r\n" +
+		fmt.Sprintf("*3\r\n$8\r\nexpireat\r\n$3\r\nold\r\n$10\r\n%d\r\n", past)
+	truncated := "*3\r\n$3\r\nset\r\n$3\r\nkey"
+	s := newTestServer(t, Config{})
+	size, err := s.replayAppendOnly(strings.NewReader(entries + truncated))
+	if err != nil {
+		t.Fatalf("replayAppendOnly error: %v", err)
+	}
+	if size != int64(len(entries)) {
+		t.Fatalf("got %d valid bytes, want %d", size, len(entries))
+	}
+	dm := s.getDb("3")
+	if got, _ := dm.Get("key"); got != "value" {
+		t.Fatalf("got %q, want 'value'", got)
+	}
+	if _, err := dm.Get("old"); err != keyNotExistErr {
+		t.Fatalf("expired key should be removed on replay, got '%v'", err)
+	}
+	if _, err := s.replayAppendOnly(strings.NewReader("*1\r\n$5\r\ngroot\r\n")); err == nil {
+		t.Fatal("unknown command in the log should not be allowed")
+	}
+}
+
+func TestAppendOnlyRestartAfterDeadline(t *testing.T) {
+	// the first deadline passes before restart, but the
+	// key is kept alive by the last command
+	for _, last := range [][]string{{"pexpire", "key", "1000000"}, {"persist", "key"}} {
+		cfg := Config{Dir: t.TempDir(), AppendOnly: true, AppendFsync: fsyncAlways}
+		s := newTestServer(t, cfg)
+		dm := s.getDb(defaultDbIndex)
+		for _, args := range [][]string{{"set", "key", "value"}, {"pexpire", "key", "100"}, last} {
+			if _, err := executeAndPropagate(dm, args[0], args[1:]); err != nil {
+				t.Fatalf("%v error: %v", args, err)
+			}
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown error: %v", err)
+		}
+		time.Sleep(150 * time.Millisecond)
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatalf("New error after %v: %v", last, err)
+		}
+		got, err := s.getDb(defaultDbIndex).Get("key")
+		s.Shutdown(context.Background())
+		if err != nil || got != "value" {
+			t.Fatalf("got %q, %v after %v, want 'value'", got, err, last)
+		}
+	}
+}
+
+func TestAppendOnlyRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{})
+	a := newAppendOnlyFile(s, f, path, fsyncNo, 0)
+	defer a.Close()
+	dm := s.getDb("4")
+	dm.HSet("dict", map[string]string{"counter": "0"})
+	a.feed(dm, [][]string{{"hset", "dict", "counter", "0"}})
+	for i := 1; i <= 100; i++ {
+		dm.HUpdate("dict", "counter", fmt.Sprint(i))
+		a.feed(dm, [][]string{{"hupdate", "dict", "counter", fmt.Sprint(i)}})
+	}
+	before := a.size
+	if err := a.startRewrite(); err != nil {
+		t.Fatalf("startRewrite error: %v", err)
+	}
+	dm.Set("str", "written during rewrite")
+	a.feed(dm, [][]string{{"set", "str", "written during rewrite"}})
+	for i := 0; ; i++ {
+		a.mu.Lock()
+		rewriting := a.rewriting
+		a.mu.Unlock()
+		if !rewriting {
+			break
+		}
+		if i > 100 {
+			t.Fatal("rewrite is not finished in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.size >= before {
+		t.Fatalf("got %d bytes log after rewrite, want less than %d", a.size, before)
+	}
+	dm.Remove("dict")
+	dm.Remove("str")
+	content, _ := os.ReadFile(path)
+	if _, err := s.replayAppendOnly(strings.NewReader(string(content))); err != nil {
+		t.Fatalf("replayAppendOnly error: %v", err)
+	}
+	if got, _ := dm.HGetVal("dict", "counter"); got != "100" {
+		t.Fatalf("got %q counter after replay, want '100'", got)
+	}
+	if got, _ := dm.Get("str"); got != "written during rewrite" {
+		t.Fatalf("got %q after replay, want 'written during rewrite'", got)
+	}
+}
+
+func TestAppendOnlyNeedsRewrite(t *testing.T) {
+	s := &Server{cfg: Config{AutoAofRewritePercentage: 100, AutoAofRewriteMinSize: 10}}
+	a := &appendOnlyFile{srv: s, w: bufio.NewWriter(io.Discard), baseSize: 10, size: 15}
+	if a.needsRewrite() {
+		t.Fatal("log which hasn't grown twice should not be rewritten")
+	}
+	a.size = 20
+	if !a.needsRewrite() {
+		t.Fatal("log which has grown twice should be rewritten")
+	}
+	s.cfg.AutoAofRewritePercentage = 0
+	if a.needsRewrite() {
+		t.Fatal("automatic rewrite should be disabled by zero percentage")
+	}
+}
+
+func TestAofCommands(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.PSetEx("key", 1500, "value")
+	got := aofCommands(&dm, "set", []string{"key", "value", "px", "1500"}, okReply)
+	want := fmt.Sprintf("[[set key value] [pexpireat key %d]]", dm.deadline("key"))
+	if fmt.Sprintf("%v", got) != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	got = aofCommands(&dm, "hset", []string{"dict", "hello", "world"}, nil)
+	if fmt.Sprintf("%v", got) != "[[hset dict hello world]]" {
+		t.Fatalf("got %v, want [[hset dict hello world]]", got)
+	}
+	for _, res := range []interface{}{0, int64(0)} {
+		if got := aofCommands(&dm, "setnx", []string{"key", "value"}, res); len(got) != 0 {
+			t.Fatalf("got %v logged for %T result, SETNX which has set nothing shouldn't be logged", got, res)
+		}
+	}
+	got = aofCommands(&dm, "setnx", []string{"other", "value"}, int64(1))
+	if fmt.Sprintf("%v", got) != "[[setnx other value]]" {
+		t.Fatalf("got %v, want [[setnx other value]]", got)
+	}
+}
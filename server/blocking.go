@@ -0,0 +1,367 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Blocking pops park the connection goroutine of a client
+// until one of its lists gets an item or the timeout passes.
+// Blocked clients are queued by key in the order they have
+// come. A write which adds items to a list with blocked
+// clients marks its key as ready, and ready keys are served
+// after the command, or after the whole transaction on EXEC,
+// so blocked clients never see half applied transactions.
+// Served pops are propagated as LPOP, RPOP and LMOVE commands.
+
+var timeoutNotFloatErr = errors.New("ERROR: timeout is not a float or out of range")
+var negativeTimeoutErr = errors.New("ERROR: timeout is negative")
+var unblockedErr = errors.New("UNBLOCKED force unblock from blocking operation, " +
+	"instance state changed (master -> replica?)")
+
+// blockedPop is a pop a blocked client waits for.
+type blockedPop struct {
+	keys     []string
+	fromTail bool
+	move     bool   // the item is pushed to dst
+	dst      string // destination of BLMOVE
+	toTail   bool
+	served   chan popResult
+}
+
+// popResult is the reply to a served blockedPop.
+type popResult struct {
+	res interface{}
+	err error
+}
+
+// parseBlockingPop parses arguments of BLPOP, BRPOP
+// and BLMOVE commands.
+func parseBlockingPop(cmd string, args []string) (*blockedPop, time.Duration, error) {
+	p := &blockedPop{served: make(chan popResult, 1)}
+	if cmd == "blmove" {
+		if len(args) < 5 {
+			return nil, 0, fewArgsErr
+		}
+		if len(args) > 5 {
+			return nil, 0, manyArgsErr
+		}
+		fromTail, toTail, err := parseMoveDirections(args[2], args[3])
+		if err != nil {
+			return nil, 0, err
+		}
+		p.keys, p.move, p.dst = args[:1], true, args[1]
+		p.fromTail, p.toTail = fromTail, toTail
+	} else {
+		if len(args) < 2 {
+			return nil, 0, fewArgsErr
+		}
+		p.keys, p.fromTail = args[:len(args)-1], cmd == "brpop"
+	}
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return nil, 0, err
+	}
+	return p, timeout, nil
+}
+
+// parseTimeout parses timeout in seconds.
+// Zero timeout means waiting forever.
+func parseTimeout(s string) (time.Duration, error) {
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(sec) || math.Abs(sec)*float64(time.Second) > math.MaxInt64 {
+		return 0, timeoutNotFloatErr
+	}
+	if sec < 0 {
+		return 0, negativeTimeoutErr
+	}
+	timeout := time.Duration(sec * float64(time.Second))
+	if timeout == 0 && sec > 0 {
+		// too short to wait, but not forever
+		timeout = 1
+	}
+	return timeout, nil
+}
+
+// direction returns the name of the end of a list.
+func direction(tail bool) string {
+	if tail {
+		return "right"
+	}
+	return "left"
+}
+
+// command returns the command which
+// propagates the pop of p from key.
+func (p *blockedPop) command(key string) []string {
+	switch {
+	case p.move:
+		return []string{"lmove", key, p.dst, direction(p.fromTail), direction(p.toTail)}
+	case p.fromTail:
+		return []string{"rpop", key}
+	}
+	return []string{"lpop", key}
+}
+
+// popFor pops an item for p from list stored by key. It
+// returns false if the list not exists. It must be called
+// with dm.mu held for writing.
+func (dm *DataMap) popFor(p *blockedPop, key string) (interface{}, bool, error) {
+	if p.move {
+		return dm.move(key, p.dst, p.fromTail, p.toTail)
+	}
+	l, err := dm.lookupList(key)
+	if err != nil || l == nil || l.len() == 0 {
+		return nil, false, err
+	}
+	items, _ := dm.popItems(key, 1, p.fromTail)
+	return []string{key, items[0]}, true, nil
+}
+
+// popFirst pops an item for p from the first of its
+// keys which holds a list. It returns an empty key if
+// there are no lists. It must be called with dm.mu held
+// for writing.
+func (dm *DataMap) popFirst(p *blockedPop) (string, interface{}, error) {
+	for _, key := range p.keys {
+		res, ok, err := dm.popFor(p, key)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			return key, res, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// block queues p on all its keys. It must be
+// called with dm.mu held for writing.
+func (dm *DataMap) block(p *blockedPop) {
+	for _, key := range p.keys {
+		dm.blocked[key] = append(dm.blocked[key], p)
+	}
+}
+
+// removeBlocked removes p from queues of its keys and
+// reports whether it has been queued. It must be called
+// with dm.mu held for writing.
+func (dm *DataMap) removeBlocked(p *blockedPop) bool {
+	found := false
+	for _, key := range p.keys {
+		queue, ok := dm.blocked[key]
+		if !ok {
+			continue
+		}
+		kept := queue[:0]
+		for _, q := range queue {
+			if q == p {
+				found = true
+			} else {
+				kept = append(kept, q)
+			}
+		}
+		if len(kept) == 0 {
+			delete(dm.blocked, key)
+		} else {
+			dm.blocked[key] = kept
+		}
+	}
+	return found
+}
+
+// unblock removes p from queues of dm and reports whether it
+// has been queued, so it is not going to be served anymore.
+func (dm *DataMap) unblock(p *blockedPop) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.removeBlocked(p)
+}
+
+// signalReady marks key as ready if there are clients blocked
+// on it. It must be called with dm.mu held for writing.
+func (dm *DataMap) signalReady(key string) {
+	if len(dm.blocked[key]) == 0 {
+		return
+	}
+	for _, k := range dm.ready {
+		if k == key {
+			return
+		}
+	}
+	dm.ready = append(dm.ready, key)
+}
+
+// serveReady serves clients blocked on ready keys in the
+// order they have been blocked. It must be called with
+// propagateMu of the server and dm.execMu held.
+func (dm *DataMap) serveReady() {
+	var cmds [][]string
+	dm.mu.Lock()
+	for len(dm.ready) > 0 {
+		key := dm.ready[0]
+		dm.ready = dm.ready[1:]
+		for len(dm.blocked[key]) > 0 {
+			if l, err := dm.lookupList(key); err != nil || l == nil {
+				// clients wait for a list again
+				break
+			}
+			p := dm.blocked[key][0]
+			dm.removeBlocked(p)
+			res, _, err := dm.popFor(p, key)
+			p.served <- popResult{res, err}
+			if err == nil {
+				cmds = append(cmds, p.command(key))
+			}
+		}
+	}
+	dm.mu.Unlock()
+	for _, cmd := range cmds {
+		propagate(dm, cmd[0], cmd[1:], nil)
+	}
+}
+
+// serveBlocked is serveReady which takes propagateMu.
+// It must be called with dm.execMu held.
+func (dm *DataMap) serveBlocked() {
+	dm.mu.RLock()
+	ready := len(dm.ready) > 0
+	dm.mu.RUnlock()
+	if !ready {
+		return
+	}
+	dm.srv.propagateMu.Lock()
+	defer dm.srv.propagateMu.Unlock()
+	dm.serveReady()
+}
+
+// popOrBlock pops an item for p. If all lists of p are empty,
+// p is queued when block is set. It reports whether an item
+// has been popped. It must be called with dm.execMu held.
+func (dm *DataMap) popOrBlock(p *blockedPop, block bool) (interface{}, bool, error) {
+	dm.srv.propagateMu.Lock()
+	defer dm.srv.propagateMu.Unlock()
+	if dm.srv.repl.isReplica() {
+		return nil, false, readOnlyErr
+	}
+	if block {
+		// clients blocked earlier go first
+		dm.serveReady()
+	}
+	dm.mu.Lock()
+	key, res, err := dm.popFirst(p)
+	if err == nil && key == "" && block {
+		dm.block(p)
+	}
+	dm.mu.Unlock()
+	if err != nil || key == "" {
+		return nil, false, err
+	}
+	cmd := p.command(key)
+	propagate(dm, cmd[0], cmd[1:], nil)
+	return res, true, nil
+}
+
+// unblockAll unblocks all blocked clients of s with err.
+func (s *Server) unblockAll(err error) {
+	s.propagateMu.Lock()
+	defer s.propagateMu.Unlock()
+	for _, dm := range s.databases() {
+		dm.mu.Lock()
+		var blocked []*blockedPop
+		for _, queue := range dm.blocked {
+			blocked = append(blocked, queue...)
+		}
+		for _, p := range blocked {
+			if dm.removeBlocked(p) {
+				p.served <- popResult{nil, err}
+			}
+		}
+		dm.ready = nil
+		dm.mu.Unlock()
+	}
+}
+
+// blockingPop handles BLPOP key [key ...] timeout, BRPOP key
+// [key ...] timeout and BLMOVE source destination LEFT|RIGHT
+// LEFT|RIGHT timeout commands. They don't block in transactions.
+func (cl *client) blockingPop(cmd string, args []string) (interface{}, error) {
+	p, timeout, err := parseBlockingPop(cmd, args)
+	if err != nil {
+		return nil, err
+	}
+	if c := cl.srv.cluster; c != nil {
+		if err := c.redirect(cl.db, commandKeys(cmd, args), cl.asking); err != nil {
+			return nil, err
+		}
+	}
+	dm := cl.db
+	if cl.execDbs[dm] {
+		res, _, err := dm.popOrBlock(p, false)
+		return res, err
+	}
+	dm.execMu.RLock()
+	res, ok, err := dm.popOrBlock(p, true)
+	dm.execMu.RUnlock()
+	if err != nil || ok {
+		return res, err
+	}
+	return cl.waitPop(dm, p, timeout)
+}
+
+// waitPop waits until p is served, the timeout passes, the
+// peer of cl disconnects or the server is shut down. Zero
+// timeout means waiting forever.
+func (cl *client) waitPop(dm *DataMap, p *blockedPop, timeout time.Duration) (interface{}, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var shutdown <-chan struct{}
+	if dm.srv != nil {
+		shutdown = dm.srv.done
+	}
+	disconnected, stop := cl.watchDisconnect()
+	defer stop()
+	select {
+	case r := <-p.served:
+		return r.res, r.err
+	case <-expired:
+	case <-disconnected:
+	case <-shutdown:
+	}
+	if dm.unblock(p) {
+		return nil, nil
+	}
+	// p has been served meanwhile
+	r := <-p.served
+	return r.res, r.err
+}
+
+// watchDisconnect returns a channel which is closed if the peer
+// of cl closes the connection while cl waits. stop must be
+// called before reading the next command.
+func (cl *client) watchDisconnect() (<-chan struct{}, func()) {
+	if cl.r.Buffered() > 0 {
+		// the next command has already come
+		return nil, func() {}
+	}
+	disconnected := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := cl.r.Peek(1); err != nil {
+			close(disconnected)
+		}
+	}()
+	return disconnected, func() {
+		// interrupt waiting for the peer
+		cl.conn.SetReadDeadline(time.Now())
+		<-done
+		cl.conn.SetReadDeadline(time.Time{})
+	}
+}
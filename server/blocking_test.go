@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockedClient connects a client of s which sends cmd and
+// waits until it is blocked on key of the default database.
+func blockedClient(t *testing.T, s *Server, key string, cmd ...string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	return blockedClientInput(t, s, key, respCommand(cmd...))
+}
+
+// blockedClientInput is like blockedClient, but it sends raw
+// input which may have more commands after the blocking one.
+func blockedClientInput(t *testing.T, s *Server, key, input string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	dm := s.getDb(defaultDbIndex)
+	dm.mu.RLock()
+	n := len(dm.blocked[key])
+	dm.mu.RUnlock()
+	srv, cli := net.Pipe()
+	go s.ServeConn(srv)
+	fmt.Fprint(cli, input)
+	for i := 0; ; i++ {
+		dm.mu.RLock()
+		blocked := len(dm.blocked[key]) > n
+		dm.mu.RUnlock()
+		if blocked {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("client is not blocked on %s", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cli, bufio.NewReader(cli)
+}
+
+func TestParseTimeout(t *testing.T) {
+	cases := []struct {
+		s    string
+		want time.Duration
+		err  error
+	}{
+		{"0", 0, nil},
+		{"1.5", 1500 * time.Millisecond, nil},
+		{"1e-12", 1, nil},
+		{"-1", 0, negativeTimeoutErr},
+		{"soon", 0, timeoutNotFloatErr},
+		{"inf", 0, timeoutNotFloatErr},
+		{"1e100", 0, timeoutNotFloatErr},
+	}
+	for _, c := range cases {
+		if got, err := parseTimeout(c.s); got != c.want || err != c.err {
+			t.Fatalf("parseTimeout(%s) = %v, %v, want %v, %v", c.s, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestBlockingPopFIFO(t *testing.T) {
+	s := newTestServer(t, Config{})
+	first, r1 := blockedClient(t, s, "bq-fifo", "blpop", "bq-fifo-other", "bq-fifo", "0")
+	defer first.Close()
+	second, r2 := blockedClient(t, s, "bq-fifo", "brpop", "bq-fifo", "0")
+	defer second.Close()
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("rpush", "bq-fifo", "a", "b", "c"))
+	expectLines(t, r, ":3")
+	expectLines(t, r1, "*2", "$7", "bq-fifo", "$1", "a")
+	expectLines(t, r2, "*2", "$7", "bq-fifo", "$1", "c")
+	fmt.Fprint(cli, respCommand("lrange", "bq-fifo", "0", "-1"))
+	expectLines(t, r, "*1", "$1", "b")
+
+	// the list is not empty, so the pop doesn't block
+	fmt.Fprint(cli, respCommand("blmove", "bq-fifo", "bq-fifo-dst", "left", "right", "0"))
+	expectLines(t, r, "$1", "b")
+	fmt.Fprint(cli, respCommand("blpop", "bq-fifo", "0.05"))
+	expectLines(t, r, "$-1")
+	fmt.Fprint(cli, respCommand("blpop", "bq-fifo", "-1"))
+	expectLines(t, r, "-ERR timeout is negative")
+}
+
+func TestBlockingMove(t *testing.T) {
+	s := newTestServer(t, Config{})
+	dm := s.getDb(defaultDbIndex)
+	dm.Remove("bq-move-src")
+	mover, r1 := blockedClient(t, s, "bq-move-src", "blmove", "bq-move-src", "bq-move-dst", "right", "left", "0")
+	defer mover.Close()
+	popper, r2 := blockedClient(t, s, "bq-move-dst", "blpop", "bq-move-dst", "0")
+	defer popper.Close()
+
+	if _, err := executeAndPropagate(dm, "rpush", []string{"bq-move-src", "a", "b"}); err != nil {
+		t.Fatalf("rpush error: %v", err)
+	}
+	expectLines(t, r1, "$1", "b")
+	// the moved item wakes the next client
+	expectLines(t, r2, "*2", "$11", "bq-move-dst", "$1", "b")
+	if items, _ := dm.LRange("bq-move-src", 0, -1); fmt.Sprint(items) != "[a]" {
+		t.Fatalf("got %v, want [a]", items)
+	}
+	p := &blockedPop{move: true, dst: "dst", fromTail: true}
+	if got := p.command("src"); fmt.Sprint(got) != "[lmove src dst right left]" {
+		t.Fatalf("got %v propagated, want LMOVE", got)
+	}
+}
+
+func TestBlockingPopMulti(t *testing.T) {
+	s := newTestServer(t, Config{})
+	blocked, r1 := blockedClient(t, s, "bq-multi", "blpop", "bq-multi", "0")
+	defer blocked.Close()
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("multi"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("rpush", "bq-multi", "a"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("lpop", "bq-multi"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("blpop", "bq-multi", "0"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("rpush", "bq-multi", "b"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("exec"))
+	// BLPOP doesn't block in transactions
+	expectLines(t, r, "*4", ":1", "$1", "a", "$-1", ":1")
+	expectLines(t, r1, "*2", "$8", "bq-multi", "$1", "b")
+}
+
+func TestUnblock(t *testing.T) {
+	s := newTestServer(t, Config{})
+	dm := s.getDb(defaultDbIndex)
+	gone, _ := blockedClient(t, s, "bq-gone", "blpop", "bq-gone", "0")
+	gone.Close()
+	for i := 0; ; i++ {
+		dm.mu.RLock()
+		n := len(dm.blocked["bq-gone"])
+		dm.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("disconnected client is still blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	blocked, r := blockedClient(t, s, "bq-replica", "brpop", "bq-replica", "0")
+	defer blocked.Close()
+	s.unblockAll(unblockedErr)
+	expectLines(t, r, "-"+unblockedErr.Error())
+}
+
+func TestShutdownPipelinedBlockingPop(t *testing.T) {
+	s := newTestServer(t, Config{})
+	// the next command is buffered while the client is blocked
+	input := respCommand("blpop", "bq-pipelined", "0") + respCommand("ping")
+	blocked, r := blockedClientInput(t, s, "bq-pipelined", input)
+	defer blocked.Close()
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- s.Shutdown(ctx)
+	}()
+	expectLines(t, r, "$-1")
+	if err := <-stopped; err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+}
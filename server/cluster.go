@@ -0,0 +1,656 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster mode splits keys between nodes like Redis Cluster.
+// Every key belongs to one of 16384 hash slots, which is CRC16
+// of the key or of its {hashtag}. Each node serves a set of
+// slots and replies with MOVED to commands for keys of other
+// nodes. Nodes exchange their slots and known nodes by
+// CLUSTER GOSSIP messages sent to the regular client port, so
+// a node learns about the whole cluster after CLUSTER MEET
+// with any of its nodes. Conflicting claims of a slot are
+// resolved by config epochs: the claim with greater one wins.
+//
+// A slot is moved between nodes live:
+//  1. CLUSTER SETSLOT slot IMPORTING source-id on the target,
+//  2. CLUSTER SETSLOT slot MIGRATING target-id on the source,
+//  3. MIGRATE of all keys of the slot from the source,
+//  4. CLUSTER SETSLOT slot NODE target-id on the target
+//     and then on the source.
+//
+// Meanwhile the source replies with ASK to commands for keys
+// it doesn't have anymore, and the target serves such commands
+// only if they are preceded by ASKING.
+const clusterSlots = 16384
+const clusterGossipInterval = 100 * time.Millisecond
+const clusterLinkTimeout = time.Second
+
+var clusterDisabledErr = errors.New("ERROR: This instance has cluster support disabled")
+var crossSlotErr = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+var clusterDownErr = errors.New("CLUSTERDOWN Hash slot not served")
+var invalidSlotErr = errors.New("ERROR: Invalid or out of range slot")
+var selectInClusterErr = errors.New("ERROR: SELECT is not allowed in cluster mode")
+
+// clusterNode is a node of the cluster.
+type clusterNode struct {
+	id        string
+	host      string
+	port      string
+	epoch     uint64 // config epoch of slots claimed by the node
+	connected bool   // the last gossip exchange has succeeded
+}
+
+func (n *clusterNode) addr() string { return net.JoinHostPort(n.host, n.port) }
+
+// clusterState is the cluster configuration seen by this node.
+type clusterState struct {
+	mu           sync.RWMutex
+	myself       *clusterNode
+	nodes        map[string]*clusterNode // known nodes by id
+	slots        [clusterSlots]*clusterNode
+	migrating    [clusterSlots]*clusterNode // targets of slots moved from myself
+	importing    [clusterSlots]*clusterNode // sources of slots moved to myself
+	meets        map[string]struct{}        // addresses of nodes to meet
+	currentEpoch uint64
+}
+
+// newClusterState creates the state of a new node. host and
+// port are the address other nodes and clients connect to.
+func newClusterState(host, port string) *clusterState {
+	myself := &clusterNode{id: newRandomId(), host: host, port: port, connected: true}
+	return &clusterState{
+		myself: myself,
+		nodes:  map[string]*clusterNode{myself.id: myself},
+		meets:  make(map[string]struct{}),
+	}
+}
+
+// crc16 is CRC16-CCITT (XMODEM) used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keySlot returns hash slot of key. If key contains
+// non empty {hashtag}, only the hashtag is hashed, so
+// related keys may be kept in the same slot.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) & (clusterSlots - 1)
+}
+
+// parseSlot parses slot number.
+func parseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, invalidSlotErr
+	}
+	return slot, nil
+}
+
+// redirect checks whether this node serves keys of a command
+// executed in dm. It returns MOVED or ASK error if keys
+// belong to another node. asking is set by ASKING command.
+func (c *clusterState) redirect(dm *DataMap, keys []string, asking bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := keySlot(keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(key) != slot {
+			return crossSlotErr
+		}
+	}
+	c.mu.RLock()
+	owner, migrating, importing := c.slots[slot], c.migrating[slot], c.importing[slot]
+	var addr string
+	switch {
+	case owner != nil && owner != c.myself:
+		addr = owner.addr()
+	case migrating != nil:
+		addr = migrating.addr()
+	}
+	c.mu.RUnlock()
+	switch {
+	case owner == c.myself:
+		if migrating == nil {
+			return nil
+		}
+		// missing keys may have been migrated already
+		for _, key := range keys {
+			if dm.keyVersion(key) == 0 {
+				return fmt.Errorf("ASK %d %s", slot, addr)
+			}
+		}
+		return nil
+	case importing != nil && asking:
+		return nil
+	case owner == nil:
+		return clusterDownErr
+	}
+	return fmt.Errorf("MOVED %d %s", slot, addr)
+}
+
+// slotRanges returns ranges of slots served by n.
+// It must be called with c.mu held.
+func (c *clusterState) slotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if c.slots[slot] != n {
+			continue
+		}
+		if l := len(ranges); l > 0 && ranges[l-1][1] == slot-1 {
+			ranges[l-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// formatRanges formats ranges like "0-100,200".
+func formatRanges(ranges [][2]int, sep string) string {
+	items := make([]string, len(ranges))
+	for i, r := range ranges {
+		if r[0] == r[1] {
+			items[i] = strconv.Itoa(r[0])
+		} else {
+			items[i] = fmt.Sprintf("%d-%d", r[0], r[1])
+		}
+	}
+	return strings.Join(items, sep)
+}
+
+// parseRanges parses slots formatted by formatRanges.
+func parseRanges(s string) ([]int, error) {
+	var slots []int
+	for _, item := range strings.Split(s, ",") {
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		start, err := parseSlot(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = parseSlot(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+// sortedNodes returns known nodes sorted by id.
+// It must be called with c.mu held.
+func (c *clusterState) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// gossip returns the state of this node sent to other nodes:
+// id, host, port, config epoch and slots of the node followed
+// by "id,host,port" of every other known node.
+func (c *clusterState) gossip() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	me := c.myself
+	msg := []string{me.id, me.host, me.port, strconv.FormatUint(me.epoch, 10), formatRanges(c.slotRanges(me), ",")}
+	for _, n := range c.sortedNodes() {
+		if n != me {
+			msg = append(msg, strings.Join([]string{n.id, n.host, n.port}, ","))
+		}
+	}
+	return msg
+}
+
+// handleGossip applies a gossip message of another node.
+func (c *clusterState) handleGossip(msg []string) error {
+	if len(msg) < 5 {
+		return fewArgsErr
+	}
+	epoch, err := strconv.ParseUint(msg[3], 10, 64)
+	if err != nil {
+		return syntaxErr
+	}
+	slots, err := parseRanges(msg[4])
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg[0] == c.myself.id {
+		return nil
+	}
+	n := c.nodes[msg[0]]
+	if n == nil {
+		n = &clusterNode{id: msg[0]}
+		c.nodes[n.id] = n
+		log.Printf("cluster: node %s at %s:%s is added\n", n.id, msg[1], msg[2])
+	}
+	n.host, n.port, n.epoch = msg[1], msg[2], epoch
+	if epoch > c.currentEpoch {
+		c.currentEpoch = epoch
+	}
+	for _, slot := range slots {
+		if owner := c.slots[slot]; owner == nil || owner != n && owner.epoch < epoch {
+			c.slots[slot] = n
+			c.migrating[slot] = nil
+		}
+	}
+	for _, info := range msg[5:] {
+		fields := strings.Split(info, ",")
+		if len(fields) != 3 || c.nodes[fields[0]] != nil || fields[0] == c.myself.id {
+			continue
+		}
+		c.nodes[fields[0]] = &clusterNode{id: fields[0], host: fields[1], port: fields[2]}
+		log.Printf("cluster: node %s at %s:%s is added\n", fields[0], fields[1], fields[2])
+	}
+	return nil
+}
+
+// clusterLink is a connection used to gossip with a node.
+type clusterLink struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// clusterPeer is a node to gossip with. node is
+// nil for nodes which haven't been met yet.
+type clusterPeer struct {
+	addr string
+	node *clusterNode
+}
+
+// peers returns other known nodes and nodes to meet.
+func (c *clusterState) peers() []clusterPeer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var peers []clusterPeer
+	for _, n := range c.nodes {
+		if n != c.myself {
+			peers = append(peers, clusterPeer{n.addr(), n})
+		}
+	}
+	for addr := range c.meets {
+		peers = append(peers, clusterPeer{addr: addr})
+	}
+	return peers
+}
+
+// gossipLoop exchanges gossip with all peers
+// periodically until done is closed.
+func (c *clusterState) gossipLoop(done <-chan struct{}) {
+	links := make(map[string]*clusterLink)
+	ticker := time.NewTicker(clusterGossipInterval)
+	defer ticker.Stop()
+	defer func() {
+		for _, l := range links {
+			l.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for _, p := range c.peers() {
+			err := c.exchange(links, p.addr)
+			c.mu.Lock()
+			if p.node != nil {
+				p.node.connected = err == nil
+			} else if err == nil {
+				delete(c.meets, p.addr)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// exchange sends gossip to the node at addr and
+// applies gossip received in reply.
+func (c *clusterState) exchange(links map[string]*clusterLink, addr string) error {
+	l := links[addr]
+	if l == nil {
+		conn, err := net.DialTimeout("tcp", addr, clusterLinkTimeout)
+		if err != nil {
+			return err
+		}
+		l = &clusterLink{conn: conn, r: bufio.NewReader(conn)}
+		links[addr] = l
+	}
+	err := func() error {
+		l.conn.SetDeadline(time.Now().Add(clusterLinkTimeout))
+		var buf bytes.Buffer
+		writeCommand(&buf, append([]string{"cluster", "gossip"}, c.gossip()...))
+		if _, err := l.conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		reply, err := readReply(l.r)
+		if err != nil {
+			return err
+		}
+		if e, ok := reply.(error); ok {
+			return e
+		}
+		items, _ := reply.([]interface{})
+		msg := make([]string, len(items))
+		for i, item := range items {
+			msg[i], _ = item.(string)
+		}
+		return c.handleGossip(msg)
+	}()
+	if err != nil {
+		l.conn.Close()
+		delete(links, addr)
+	}
+	return err
+}
+
+// countKeysInSlot returns number of keys of dm in slot.
+func countKeysInSlot(dm *DataMap, slot int) int {
+	n := 0
+	for _, key := range dm.Keys() {
+		if keySlot(key) == slot {
+			n++
+		}
+	}
+	return n
+}
+
+// clusterCommand handles CLUSTER subcommand [arg ...] command.
+func (s *Server) clusterCommand(args []string) (interface{}, error) {
+	c := s.cluster
+	if c == nil {
+		return nil, clusterDisabledErr
+	}
+	if len(args) == 0 {
+		return nil, fewArgsErr
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch sub {
+	case "myid":
+		return c.myself.id, nil
+	case "info":
+		return c.info(), nil
+	case "slots":
+		return c.slotsReply(), nil
+	case "nodes":
+		return c.nodesReply(), nil
+	case "meet":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("ERROR: wrong number of arguments for 'cluster meet' command")
+		}
+		if _, err := strconv.ParseUint(args[1], 10, 16); err != nil {
+			return nil, fmt.Errorf("ERROR: Invalid node address specified: %s:%s", args[0], args[1])
+		}
+		c.mu.Lock()
+		c.meets[net.JoinHostPort(args[0], args[1])] = struct{}{}
+		c.mu.Unlock()
+		return okReply, nil
+	case "addslots", "delslots":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		return c.assignSlots(args, sub == "addslots")
+	case "setslot":
+		return c.setSlot(s.getDb(defaultDbIndex), args)
+	case "keyslot":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("ERROR: wrong number of arguments for 'cluster keyslot' command")
+		}
+		return int64(keySlot(args[0])), nil
+	case "countkeysinslot":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("ERROR: wrong number of arguments for 'cluster countkeysinslot' command")
+		}
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return int64(countKeysInSlot(s.getDb(defaultDbIndex), slot)), nil
+	case "getkeysinslot":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("ERROR: wrong number of arguments for 'cluster getkeysinslot' command")
+		}
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return nil, errors.New("ERROR: Invalid number of keys")
+		}
+		keys := []string{}
+		for _, key := range s.getDb(defaultDbIndex).Keys() {
+			if len(keys) == count {
+				break
+			}
+			if keySlot(key) == slot {
+				keys = append(keys, key)
+			}
+		}
+		return keys, nil
+	case "gossip":
+		if err := c.handleGossip(args); err != nil {
+			return nil, err
+		}
+		return c.gossip(), nil
+	default:
+		return nil, fmt.Errorf("ERROR: unknown subcommand '%s'", sub)
+	}
+}
+
+// assignSlots handles CLUSTER ADDSLOTS and CLUSTER DELSLOTS.
+func (c *clusterState) assignSlots(args []string, add bool) (interface{}, error) {
+	slots := make([]int, len(args))
+	for i, arg := range args {
+		slot, err := parseSlot(arg)
+		if err != nil {
+			return nil, err
+		}
+		slots[i] = slot
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, slot := range slots {
+		if add && c.slots[slot] != nil {
+			return nil, fmt.Errorf("ERROR: Slot %d is already busy", slot)
+		}
+		if !add && c.slots[slot] == nil {
+			return nil, fmt.Errorf("ERROR: Slot %d is already unassigned", slot)
+		}
+	}
+	for _, slot := range slots {
+		c.slots[slot] = nil
+		if add {
+			c.slots[slot] = c.myself
+		}
+		c.migrating[slot], c.importing[slot] = nil, nil
+	}
+	return okReply, nil
+}
+
+// setSlot handles CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE
+// node-id and CLUSTER SETSLOT slot STABLE commands. dm is the
+// database which keys are served by the cluster.
+func (c *clusterState) setSlot(dm *DataMap, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fewArgsErr
+	}
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return nil, err
+	}
+	action := strings.ToLower(args[1])
+	if action == "stable" {
+		c.mu.Lock()
+		c.migrating[slot], c.importing[slot] = nil, nil
+		c.mu.Unlock()
+		return okReply, nil
+	}
+	if len(args) != 3 {
+		return nil, syntaxErr
+	}
+	if action == "node" && c.isMigrating(slot) && countKeysInSlot(dm, slot) > 0 {
+		return nil, fmt.Errorf("ERROR: Can't assign hashslot %d to a different node while I still hold keys for this hash slot", slot)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.nodes[args[2]]
+	if n == nil {
+		return nil, fmt.Errorf("ERROR: I don't know about node %s", args[2])
+	}
+	switch action {
+	case "migrating":
+		if c.slots[slot] != c.myself {
+			return nil, fmt.Errorf("ERROR: I'm not the owner of hash slot %d", slot)
+		}
+		if n == c.myself {
+			return nil, errors.New("ERROR: I can't migrate a slot to myself")
+		}
+		c.migrating[slot] = n
+	case "importing":
+		if c.slots[slot] == c.myself {
+			return nil, fmt.Errorf("ERROR: I'm already the owner of hash slot %d", slot)
+		}
+		if n == c.myself {
+			return nil, errors.New("ERROR: I can't import a slot from myself")
+		}
+		c.importing[slot] = n
+	case "node":
+		if n == c.myself && c.importing[slot] != nil {
+			// the new claim must win over the old owner
+			c.currentEpoch++
+			c.myself.epoch = c.currentEpoch
+		}
+		if n == c.myself || c.slots[slot] == c.myself {
+			c.migrating[slot] = nil
+		}
+		c.importing[slot] = nil
+		c.slots[slot] = n
+	default:
+		return nil, syntaxErr
+	}
+	return okReply, nil
+}
+
+// isMigrating reports whether slot is being migrated from this node.
+func (c *clusterState) isMigrating(slot int) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.migrating[slot] != nil
+}
+
+// info handles CLUSTER INFO command.
+func (c *clusterState) info() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	assigned := 0
+	owners := make(map[*clusterNode]bool)
+	for _, n := range c.slots {
+		if n != nil {
+			assigned++
+			owners[n] = true
+		}
+	}
+	state := "ok"
+	if assigned < clusterSlots {
+		state = "fail"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(c.nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", len(owners))
+	fmt.Fprintf(&b, "cluster_current_epoch:%d\r\n", c.currentEpoch)
+	fmt.Fprintf(&b, "cluster_my_epoch:%d\r\n", c.myself.epoch)
+	return b.String()
+}
+
+// slotsReply handles CLUSTER SLOTS command.
+func (c *clusterState) slotsReply() []interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res := []interface{}{}
+	for _, n := range c.sortedNodes() {
+		port, _ := strconv.ParseInt(n.port, 10, 64)
+		for _, r := range c.slotRanges(n) {
+			res = append(res, []interface{}{int64(r[0]), int64(r[1]), []interface{}{n.host, port, n.id}})
+		}
+	}
+	return res
+}
+
+// nodesReply handles CLUSTER NODES command.
+func (c *clusterState) nodesReply() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var b strings.Builder
+	for _, n := range c.sortedNodes() {
+		flags, link := "master", "disconnected"
+		if n == c.myself {
+			flags = "myself,master"
+		}
+		if n.connected {
+			link = "connected"
+		}
+		fmt.Fprintf(&b, "%s %s@%s %s - 0 0 %d %s", n.id, n.addr(), n.port, flags, n.epoch, link)
+		if ranges := c.slotRanges(n); len(ranges) > 0 {
+			fmt.Fprintf(&b, " %s", formatRanges(ranges, " "))
+		}
+		if n == c.myself {
+			for slot := 0; slot < clusterSlots; slot++ {
+				if m := c.migrating[slot]; m != nil {
+					fmt.Fprintf(&b, " [%d->-%s]", slot, m.id)
+				}
+				if i := c.importing[slot]; i != nil {
+					fmt.Fprintf(&b, " [%d-<-%s]", slot, i.id)
+				}
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func clusterInfo(s *Server) [][2]interface{} {
+	return [][2]interface{}{{"cluster_enabled", boolToInt(s.cluster != nil)}}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31c3 {
+		t.Fatalf("got %#x CRC16, want 0x31c3", got)
+	}
+	cases := map[string]int{"foo": 12182, "bar": 5061, "{foo}.bar": 12182, "foo{}{bar}": keySlotOf("foo{}{bar}"), "foo{{bar}}": keySlotOf("{bar")}
+	for key, want := range cases {
+		if got := keySlot(key); got != want {
+			t.Fatalf("keySlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Fatal("keys with the same hashtag should be in the same slot")
+	}
+}
+
+// keySlotOf hashes s entirely.
+func keySlotOf(s string) int { return int(crc16(s)) & (clusterSlots - 1) }
+
+// addNode adds a node with id listening on port to c.
+func addNode(c *clusterState, id, port string) *clusterNode {
+	n := &clusterNode{id: id, host: "127.0.0.1", port: port}
+	c.nodes[id] = n
+	return n
+}
+
+func TestClusterRedirect(t *testing.T) {
+	c := newClusterState("127.0.0.1", "7000")
+	other := addNode(c, "other", "7001")
+	var dm DataMap
+	dm.Init()
+	dm.Set("foo", "value")
+	foo, bar := keySlot("foo"), keySlot("bar")
+
+	if err := c.redirect(&dm, []string{"foo"}, false); err != clusterDownErr {
+		t.Fatalf("got '%v', want '%v'", err, clusterDownErr)
+	}
+	c.slots[foo], c.slots[bar] = c.myself, other
+	if err := c.redirect(&dm, []string{"foo"}, false); err != nil {
+		t.Fatalf("got '%v', the slot is served by the node", err)
+	}
+	if err := c.redirect(&dm, []string{"foo", "bar"}, false); err != crossSlotErr {
+		t.Fatalf("got '%v', want '%v'", err, crossSlotErr)
+	}
+	want := fmt.Sprintf("MOVED %d 127.0.0.1:7001", bar)
+	if err := c.redirect(&dm, []string{"bar"}, false); err == nil || err.Error() != want {
+		t.Fatalf("got '%v', want '%s'", err, want)
+	}
+
+	c.migrating[foo] = other
+	if err := c.redirect(&dm, []string{"foo"}, false); err != nil {
+		t.Fatalf("got '%v', existing keys of migrating slot should be served", err)
+	}
+	want = fmt.Sprintf("ASK %d 127.0.0.1:7001", foo)
+	if err := c.redirect(&dm, []string{"{foo}.missing"}, false); err == nil || err.Error() != want {
+		t.Fatalf("got '%v', want '%s'", err, want)
+	}
+
+	c.importing[bar] = other
+	if err := c.redirect(&dm, []string{"bar"}, true); err != nil {
+		t.Fatalf("got '%v', importing slot should be served after ASKING", err)
+	}
+	if err := c.redirect(&dm, []string{"bar"}, false); err == nil || !strings.HasPrefix(err.Error(), "MOVED") {
+		t.Fatalf("got '%v', want MOVED without ASKING", err)
+	}
+}
+
+func TestClusterGossip(t *testing.T) {
+	a := newClusterState("127.0.0.1", "7000")
+	b := newClusterState("127.0.0.1", "7001")
+	c := newClusterState("127.0.0.1", "7002")
+	a.assignSlots([]string{"0", "1", "2"}, true)
+	b.assignSlots([]string{"3"}, true)
+	if err := b.handleGossip(a.gossip()); err != nil {
+		t.Fatalf("handleGossip error: %v", err)
+	}
+	// c meets b and learns about a from it
+	b.handleGossip(c.gossip())
+	c.handleGossip(b.gossip())
+	if len(c.nodes) != 3 {
+		t.Fatalf("got %d known nodes, want 3", len(c.nodes))
+	}
+	c.handleGossip(a.gossip())
+	want := []string{a.myself.id, a.myself.id, a.myself.id, b.myself.id}
+	for slot, id := range want {
+		if n := c.slots[slot]; n == nil || n.id != id {
+			t.Fatalf("slot %d is served by %v, want %s", slot, n, id)
+		}
+	}
+	if got := formatRanges(c.slotRanges(c.nodes[a.myself.id]), ","); got != "0-2" {
+		t.Fatalf("got %q slots of node a, want '0-2'", got)
+	}
+}
+
+func TestClusterSetSlot(t *testing.T) {
+	a := newClusterState("127.0.0.1", "7000")
+	b := newClusterState("127.0.0.1", "7001")
+	a.assignSlots([]string{"100"}, true)
+	b.handleGossip(a.gossip())
+	a.handleGossip(b.gossip())
+	if _, err := b.setSlot(newDb("0"), []string{"100", "importing", a.myself.id}); err != nil {
+		t.Fatalf("SETSLOT IMPORTING error: %v", err)
+	}
+	if _, err := a.setSlot(newDb("0"), []string{"100", "migrating", b.myself.id}); err != nil {
+		t.Fatalf("SETSLOT MIGRATING error: %v", err)
+	}
+	if _, err := b.setSlot(newDb("0"), []string{"100", "node", b.myself.id}); err != nil {
+		t.Fatalf("SETSLOT NODE error: %v", err)
+	}
+	if b.myself.epoch <= a.myself.epoch {
+		t.Fatalf("got %d epoch of the new owner, want greater than %d", b.myself.epoch, a.myself.epoch)
+	}
+	// the claim of b wins even if a hasn't been told
+	a.handleGossip(b.gossip())
+	if a.slots[100] != a.nodes[b.myself.id] || a.migrating[100] != nil {
+		t.Fatal("slot should be moved to the node with greater epoch")
+	}
+	if _, err := a.setSlot(newDb("0"), []string{"100", "migrating", b.myself.id}); err == nil {
+		t.Fatal("only owner should migrate slot")
+	}
+}
+
+func TestClusterCommands(t *testing.T) {
+	s := newTestServer(t, Config{Addr: "127.0.0.1:7000", ClusterEnabled: true})
+	cluster := s.cluster
+	cluster.mu.Lock()
+	other := addNode(cluster, "other", "7001")
+	cluster.slots[keySlot("bar")] = other
+	cluster.mu.Unlock()
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("get", "foo"))
+	expectLines(t, r, "-CLUSTERDOWN Hash slot not served")
+	fmt.Fprint(cli, respCommand("cluster", "addslots", fmt.Sprint(keySlot("foo"))))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("set", "foo", "value"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("get", "bar"))
+	expectLines(t, r, fmt.Sprintf("-MOVED %d 127.0.0.1:7001", keySlot("bar")))
+	fmt.Fprint(cli, respCommand("select", "1"))
+	expectLines(t, r, "-ERR SELECT is not allowed in cluster mode")
+	fmt.Fprint(cli, respCommand("cluster", "keyslot", "foo"))
+	expectLines(t, r, ":12182")
+	fmt.Fprint(cli, respCommand("cluster", "countkeysinslot", "12182"))
+	expectLines(t, r, ":1")
+
+	cluster.mu.Lock()
+	cluster.importing[keySlot("bar")] = other
+	cluster.mu.Unlock()
+	fmt.Fprint(cli, respCommand("asking"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("set", "bar", "value"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("get", "bar"))
+	expectLines(t, r, fmt.Sprintf("-MOVED %d 127.0.0.1:7001", keySlot("bar")))
+
+	fmt.Fprint(cli, respCommand("cluster", "slots"))
+	expectLines(t, r, "*2", "*3")
+}
+
+func TestMigrate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	source, target := newTestServer(t, Config{}), newTestServer(t, Config{})
+	src, dst := source.getDb("1"), target.getDb("2")
+	go target.Serve(ln)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	src.LSet("list", []string{"a", "b"})
+	src.PSetEx("str", 100000, "value")
+	dst.Set("str", "old")
+	cl := &client{srv: source, db: src}
+	res, err := cl.migrate([]string{host, port, "", "2", "1000", "KEYS", "list", "str", "missing"})
+	if err != nil || res != okReply {
+		t.Fatalf("got %v, %v, want OK", res, err)
+	}
+	if list, _ := dst.LGet("list"); fmt.Sprint(list) != "[a b]" {
+		t.Fatalf("got %v list on the target, want [a b]", list)
+	}
+	if val, _ := dst.Get("str"); val != "value" || dst.deadline("str") == 0 {
+		t.Fatalf("got %q with %d ttl on the target, want 'value' with ttl", val, dst.deadline("str"))
+	}
+	if keys := src.Keys(); len(keys) != 0 {
+		t.Fatalf("got %v keys on the source, want none", keys)
+	}
+	if res, _ := cl.migrate([]string{host, port, "missing", "2", "1000"}); res != statusReply("NOKEY") {
+		t.Fatalf("got %v, want NOKEY", res)
+	}
+}
+
+func TestMigrateChangedKey(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	source := newTestServer(t, Config{})
+	src := source.getDb(defaultDbIndex)
+	src.Set("key", "old")
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		// select, remove and set of the key
+		for i := 0; i < 3; i++ {
+			if _, err := readRESPCommand(r); err != nil {
+				return
+			}
+		}
+		// the key is changed before the target replies
+		executeAndPropagate(src, "set", []string{"key", "new"})
+		fmt.Fprint(conn, strings.Repeat("+OK\r\n", 3))
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	cl := &client{srv: source, db: src}
+	if res, err := cl.migrate([]string{host, port, "key", "0", "1000"}); err != nil || res != okReply {
+		t.Fatalf("got %v, %v, want OK", res, err)
+	}
+	if got, err := src.Get("key"); err != nil || got != "new" {
+		t.Fatalf("got %q, %v, want the key changed during migration kept", got, err)
+	}
+}
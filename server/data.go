@@ -2,26 +2,51 @@ package server
 
 import (
 	"errors"
+	"strconv"
 )
 
 var typeMismatchErr = errors.New("ERROR: types mismatch")
 var noItemErr = errors.New("ERROR: no such item")
 
 type data struct {
-	ttl   int64       // time to live
+	ttl   int64       // unix time in milliseconds when data expires
 	value interface{} // field for particular data
+	size  int64       // estimated memory used by key and value
+	atime int64       // unix time in milliseconds of the last access
+	freq  uint32      // logarithmic access frequency counter
+	// version is changed on every modification, see WATCH
+	version uint64
+	// cloned is the snapshot generation since which
+	// value is a private copy, see DataMap.unshare
+	cloned uint64
+	// fields keeps fields of a hash in the scan order. It
+	// is built by HSCAN and dropped when the hash is replaced.
+	fields *scanIndex
 }
 
 func (d *data) TTL() int64     { return d.ttl }
 func (d *data) SetTTL(t int64) { d.ttl = t }
 
+// stringValue returns value which keeps string s.
+// Integers are kept as int64 to save memory.
+func stringValue(s string) interface{} {
+	if len(s) > 20 || len(s) == 0 {
+		return s
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return s
+	}
+	return n
+}
+
 // SSet sets string s to d instance of data.
 // It returns error if d contains a value
 // with another type.
 func (d *data) SSet(s string) error {
 	switch d.value.(type) {
-	case nil, string:
-		d.value = s
+	case nil, string, int64:
+		d.value = stringValue(s)
 		return nil
 	default:
 		return typeMismatchErr
@@ -36,42 +61,61 @@ func (d *data) SGet() (string, error) {
 		return "", noItemErr
 	case string:
 		return x, nil
+	case int64:
+		return strconv.FormatInt(x, 10), nil
 	default:
 		return "", typeMismatchErr
 	}
 }
 
-// LGet gets slice from d. It returns
+// LGet gets a copy of list items from d. It returns
 // error if d contains a value with another type.
 func (d *data) LGet() ([]string, error) {
-	switch x := d.value.(type) {
-	case nil:
-		return nil, noItemErr
-	case []string:
-		return x, nil
-	default:
-		return nil, typeMismatchErr
+	l, err := d.ListGet()
+	if err != nil {
+		return nil, err
 	}
+	return l.items(), nil
 }
 
-// LSet sets slice list to d. It returns
+// LSet sets list of items to d. It returns
 // if d contains another type.
-func (d *data) LSet(list []string) error {
+func (d *data) LSet(items []string) error {
+	return d.ListSet(newList(items))
+}
+
+// ListSet sets list l to d. It returns
+// error if d contains another type.
+func (d *data) ListSet(l *list) error {
 	switch d.value.(type) {
-	case nil, []string:
-		d.value = list
+	case nil, *list:
+		d.value = l
 		return nil
 	default:
 		return typeMismatchErr
 	}
 }
 
+// ListGet gets list from d. It returns
+// error if d contains another type.
+func (d *data) ListGet() (*list, error) {
+	switch x := d.value.(type) {
+	case nil:
+		return nil, noItemErr
+	case *list:
+		return x, nil
+	default:
+		return nil, typeMismatchErr
+	}
+}
+
 // HSet sets map to d. It returns error
 // if d contains another type.
 func (d *data) HSet(dict map[string]string) error {
 	switch d.value.(type) {
 	case nil, map[string]string:
 		d.value = dict
+		d.fields = nil
 		return nil
 	default:
 		return typeMismatchErr
@@ -90,3 +134,53 @@ func (d *data) HGet() (map[string]string, error) {
 		return nil, typeMismatchErr
 	}
 }
+
+// SetSet sets set of members to d. It returns
+// error if d contains another type.
+func (d *data) SetSet(set map[string]struct{}) error {
+	switch d.value.(type) {
+	case nil, map[string]struct{}:
+		d.value = set
+		return nil
+	default:
+		return typeMismatchErr
+	}
+}
+
+// SetGet gets set of members from d. It returns
+// error if d contains another type.
+func (d *data) SetGet() (map[string]struct{}, error) {
+	switch x := d.value.(type) {
+	case nil:
+		return nil, noItemErr
+	case map[string]struct{}:
+		return x, nil
+	default:
+		return nil, typeMismatchErr
+	}
+}
+
+// ZSetSet sets sorted set z to d. It returns
+// error if d contains another type.
+func (d *data) ZSetSet(z *zset) error {
+	switch d.value.(type) {
+	case nil, *zset:
+		d.value = z
+		return nil
+	default:
+		return typeMismatchErr
+	}
+}
+
+// ZSetGet gets sorted set from d. It returns
+// error if d contains another type.
+func (d *data) ZSetGet() (*zset, error) {
+	switch x := d.value.(type) {
+	case nil:
+		return nil, noItemErr
+	case *zset:
+		return x, nil
+	default:
+		return nil, typeMismatchErr
+	}
+}
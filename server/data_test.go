@@ -37,15 +37,15 @@ func TestLSet(t *testing.T) {
 	if err != nil {
 		t.Fatalf("d.LSet(%v) error: %v", s, err)
 	}
-	got, _ := d.value.([]string)
-	if len(got) != len(s) {
+	got, _ := d.value.(*list)
+	if got.len() != len(s) {
 		t.Fatalf("got %v, want: %v", got, s)
 	}
 }
 
 func TestLGet(t *testing.T) {
 	want := []string{"hello", "world"}
-	d := data{value: want}
+	d := data{value: newList(want)}
 	got, err := d.LGet()
 	if err != nil {
 		t.Fatalf("d.LGet() error: %v", err)
@@ -97,3 +97,19 @@ func TestHGet(t *testing.T) {
 	}
 
 }
+
+func TestSetGet(t *testing.T) {
+	want := map[string]struct{}{"hello": {}, "world": {}}
+	d := data{value: want}
+	got, err := d.SetGet()
+	if err != nil {
+		t.Fatalf("d.SetGet() error: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("d.SetGet() = %v, want: %v", got, want)
+	}
+	d.value = "hello"
+	if _, err := d.SetGet(); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+}
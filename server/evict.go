@@ -0,0 +1,275 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// eviction policies used when the memory limit is reached.
+const (
+	policyNoEviction    = "noeviction"
+	policyAllKeysLRU    = "allkeys-lru"
+	policyAllKeysLFU    = "allkeys-lfu"
+	policyAllKeysRandom = "allkeys-random"
+	policyVolatileLRU   = "volatile-lru"
+	policyVolatileTTL   = "volatile-ttl"
+)
+
+// Memory used by keys is estimated as length of keys and
+// values plus fixed overhead per key and per list item
+// or hash field.
+const keyOverhead = 64
+const itemOverhead = 16
+
+// evictionSamples is number of keys sampled in each
+// database to find the best key to evict.
+const evictionSamples = 5
+
+// LFU counter is logarithmic, like in Redis: the more a key
+// is accessed the less likely its counter is incremented.
+// The counter is decremented for every lfuDecayTime
+// milliseconds the key isn't accessed.
+const lfuInitVal = 5
+const lfuMaxVal = 255
+const lfuLogFactor = 10
+const lfuDecayTime = 60 * 1000
+
+var oomErr = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+var badPolicyErr = errors.New("ERROR: unknown maxmemory policy")
+
+// shrinkCommands are write commands which
+// are allowed when memory limit is reached.
+var shrinkCommands = map[string]bool{
+	"remove":    true,
+	"persist":   true,
+	"expire":    true,
+	"pexpire":   true,
+	"expireat":  true,
+	"pexpireat": true,
+	"srem":      true,
+	"spop":      true,
+	"zrem":      true,
+	"zpopmin":   true,
+	"zpopmax":   true,
+	"lpop":      true,
+	"rpop":      true,
+	"ltrim":     true,
+	"lrem":      true,
+	"hdel":      true,
+	"getdel":    true,
+	"del":       true,
+	"unlink":    true,
+	"flushdb":   true,
+	"flushall":  true,
+	"swapdb":    true,
+}
+
+// checkPolicy returns error if policy of keys
+// eviction is unknown.
+func checkPolicy(policy string) error {
+	switch policy {
+	case policyNoEviction, policyAllKeysLRU, policyAllKeysLFU,
+		policyAllKeysRandom, policyVolatileLRU, policyVolatileTTL:
+		return nil
+	}
+	return badPolicyErr
+}
+
+// ParseMemory parses memory size like "1024",
+// "100kb", "64mb" or "2gb" to bytes.
+func ParseMemory(s string) (int64, error) {
+	s = strings.ToLower(s)
+	mul := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mul    int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, mul = strings.TrimSuffix(s, unit.suffix), unit.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("ERROR: invalid memory size %q", s)
+	}
+	return n * mul, nil
+}
+
+// valueSize estimates memory used by value of d.
+func (d *data) valueSize() int64 {
+	switch x := d.value.(type) {
+	case string:
+		return int64(len(x))
+	case int64:
+		return 8
+	case *list:
+		size := int64(x.len()) * itemOverhead
+		for i := 0; i < x.len(); i++ {
+			size += int64(len(x.at(i)))
+		}
+		return size
+	case map[string]string:
+		size := int64(len(x)) * itemOverhead * 2
+		for k, v := range x {
+			size += int64(len(k) + len(v))
+		}
+		return size
+	case map[string]struct{}:
+		size := int64(len(x)) * itemOverhead
+		for m := range x {
+			size += int64(len(m))
+		}
+		return size
+	case *zset:
+		var size int64
+		for m := range x.dict {
+			size += zitemSize(m)
+		}
+		return size
+	}
+	return 0
+}
+
+// grow adds delta to memory used by d stored in dm.
+func (dm *DataMap) grow(d *data, delta int64) {
+	d.size += delta
+	atomic.AddInt64(&dm.used, delta)
+}
+
+// usedMemory returns memory used by all databases of s.
+func (s *Server) usedMemory() int64 {
+	var used int64
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	for _, dm := range s.dbs {
+		used += atomic.LoadInt64(&dm.used)
+	}
+	return used
+}
+
+// touch updates access time and frequency of d.
+// It may be called with dm.mu held for reading.
+func (d *data) touch(now int64) {
+	freq := d.decayedFreq(now)
+	if freq < lfuMaxVal {
+		base := float64(freq) - lfuInitVal
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			freq++
+		}
+	}
+	atomic.StoreUint32(&d.freq, freq)
+	atomic.StoreInt64(&d.atime, now)
+}
+
+// decayedFreq returns LFU counter of d decremented
+// by time passed since the last access.
+func (d *data) decayedFreq(now int64) uint32 {
+	freq := int64(atomic.LoadUint32(&d.freq))
+	if periods := (now - atomic.LoadInt64(&d.atime)) / lfuDecayTime; periods > 0 {
+		freq -= periods
+	}
+	if freq < 0 {
+		freq = 0
+	}
+	return uint32(freq)
+}
+
+// create adds new empty data by key. It must
+// be called with dm.mu held for writing.
+func (dm *DataMap) create(key string) *data {
+	d := &data{atime: nowMs(), freq: lfuInitVal}
+	dm.hash[key] = d
+	dm.keys.add(key)
+	dm.grow(d, int64(len(key))+keyOverhead)
+	return d
+}
+
+// resize recalculates memory used by d stored by key.
+// It must be called with dm.mu held for writing.
+func (dm *DataMap) resize(key string, d *data) {
+	dm.grow(d, int64(len(key))+keyOverhead+d.valueSize()-d.size)
+}
+
+// evictionCandidate samples keys of dm and returns
+// the best one to evict by policy. Lower score
+// means the key should be evicted earlier.
+func (dm *DataMap) evictionCandidate(policy string, now int64) (key string, score float64, ok bool) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	keys := make([]string, 0, evictionSamples)
+	switch policy {
+	case policyVolatileLRU, policyVolatileTTL:
+		for k := range dm.volatile {
+			if keys = append(keys, k); len(keys) == evictionSamples {
+				break
+			}
+		}
+	default:
+		for k := range dm.hash {
+			if keys = append(keys, k); len(keys) == evictionSamples {
+				break
+			}
+		}
+	}
+	score = math.Inf(1)
+	for _, k := range keys {
+		d := dm.hash[k]
+		var s float64
+		switch policy {
+		case policyAllKeysLRU, policyVolatileLRU:
+			s = float64(atomic.LoadInt64(&d.atime))
+		case policyAllKeysLFU:
+			s = float64(d.decayedFreq(now))
+		case policyVolatileTTL:
+			s = float64(d.ttl)
+		default:
+			s = rand.Float64()
+		}
+		if !ok || s < score {
+			key, score, ok = k, s, true
+		}
+	}
+	return key, score, ok
+}
+
+// freeMemoryIfNeeded evicts keys until used memory fits
+// the limit of s. Evicted keys are propagated as removed.
+// It returns oomErr if memory can't be freed. It must be
+// called with s.propagateMu held.
+func (s *Server) freeMemoryIfNeeded() error {
+	limit, policy := s.cfg.MaxMemory, s.cfg.MaxMemoryPolicy
+	if limit <= 0 {
+		return nil
+	}
+	now := nowMs()
+	for s.usedMemory() > limit {
+		if policy == policyNoEviction {
+			return oomErr
+		}
+		var best *DataMap
+		var bestKey string
+		var bestScore float64
+		for _, dm := range s.databases() {
+			key, score, ok := dm.evictionCandidate(policy, now)
+			if ok && (best == nil || score < bestScore) {
+				best, bestKey, bestScore = dm, key, score
+			}
+		}
+		if best == nil {
+			return oomErr
+		}
+		best.Remove(bestKey)
+		propagate(best, "remove", []string{bestKey}, nil)
+		atomic.AddInt64(&s.evictedKeys, 1)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	cases := map[string]int64{"0": 0, "1024": 1024, "100kb": 100 << 10, "64MB": 64 << 20, "2gb": 2 << 30}
+	for have, want := range cases {
+		got, err := ParseMemory(have)
+		if err != nil {
+			t.Fatalf("ParseMemory(%q) error: %v", have, err)
+		}
+		if got != want {
+			t.Fatalf("ParseMemory(%q) = %d, want %d", have, got, want)
+		}
+	}
+	if _, err := ParseMemory("lots"); err == nil {
+		t.Fatal("invalid memory size should not be allowed")
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.Set("key", "value")
+	want := int64(len("key")+len("value")) + keyOverhead
+	if got := dm.hash["key"].size; got != want {
+		t.Fatalf("got %d size, want %d", got, want)
+	}
+	dm.HSet("dict", map[string]string{"a": "b"})
+	dm.HUpdate("dict", "c", "dd")
+	want = int64(len("dict")+len("abcdd")) + keyOverhead + 4*itemOverhead
+	if got := dm.hash["dict"].size; got != want {
+		t.Fatalf("got %d size, want %d", got, want)
+	}
+	dm.Remove("key")
+	dm.Remove("dict")
+	if got := atomic.LoadInt64(&dm.used); got != 0 {
+		t.Fatalf("got %d used memory after removing all keys, want 0", got)
+	}
+}
+
+func TestEvictionCandidate(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	now := nowMs()
+	dm.hash["old"] = &data{value: "a", atime: now - 1000, freq: 100, ttl: now + 10}
+	dm.hash["new"] = &data{value: "b", atime: now, freq: 1, ttl: now + 100}
+	dm.volatile["old"] = struct{}{}
+	dm.volatile["new"] = struct{}{}
+	cases := map[string]string{
+		policyAllKeysLRU:  "old",
+		policyAllKeysLFU:  "new",
+		policyVolatileTTL: "old",
+	}
+	for policy, want := range cases {
+		key, _, ok := dm.evictionCandidate(policy, now)
+		if !ok || key != want {
+			t.Fatalf("got %q candidate for %s policy, want %q", key, policy, want)
+		}
+	}
+	delete(dm.volatile, "old")
+	delete(dm.volatile, "new")
+	if _, _, ok := dm.evictionCandidate(policyVolatileLRU, now); ok {
+		t.Fatal("keys without ttl should not be evicted by volatile policy")
+	}
+}
+
+func TestLFUCounter(t *testing.T) {
+	now := nowMs()
+	d := &data{atime: now, freq: lfuInitVal}
+	for i := 0; i < 100; i++ {
+		d.touch(now)
+	}
+	if d.freq <= lfuInitVal {
+		t.Fatalf("got %d frequency, want greater than %d after access", d.freq, lfuInitVal)
+	}
+	if got := d.decayedFreq(now + 2*lfuDecayTime); got != d.freq-2 {
+		t.Fatalf("got %d decayed frequency, want %d", got, d.freq-2)
+	}
+}
+
+func TestFreeMemoryIfNeeded(t *testing.T) {
+	s := newTestServer(t, Config{MaxMemory: 1})
+	dm := s.getDb("1")
+	dm.Set("key", "value")
+	s.propagateMu.Lock()
+	err := s.freeMemoryIfNeeded()
+	s.propagateMu.Unlock()
+	if err != oomErr {
+		t.Fatalf("got '%v', want '%v'", err, oomErr)
+	}
+	if _, err := executeAndPropagate(dm, "set", []string{"other", "value"}); err != oomErr {
+		t.Fatalf("got '%v', want '%v' for write command", err, oomErr)
+	}
+	if _, err := executeAndPropagate(dm, "remove", []string{"other"}); err != nil {
+		t.Fatalf("got '%v', removing keys should be allowed", err)
+	}
+	s.cfg.MaxMemory, s.cfg.MaxMemoryPolicy = s.usedMemory()-1, policyAllKeysRandom
+	s.propagateMu.Lock()
+	err = s.freeMemoryIfNeeded()
+	s.propagateMu.Unlock()
+	if err != nil {
+		t.Fatalf("got '%v', expected 'nil' error", err)
+	}
+	if s.usedMemory() > s.cfg.MaxMemory {
+		t.Fatal("used memory should fit the limit after eviction")
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+// Keys with ttl are removed in three ways:
+//   - the expire loop of each database sleeps until the
+//     nearest deadline from a min-heap and removes due keys;
+//   - expired keys are invisible to all commands and are
+//     removed right away by commands which change data;
+//   - like Redis, the expire loop samples random keys with
+//     ttl and removes expired ones, so stale heap entries
+//     never keep expired keys alive.
+const activeExpireInterval = 100 * time.Millisecond
+const activeExpireSamples = 20
+
+// expireEntry is a key scheduled to expire at deadline.
+type expireEntry struct {
+	deadline int64
+	key      string
+}
+
+// expireHeap is a min-heap of expireEntry by deadline. It may
+// contain stale entries for keys which ttl has been changed.
+type expireHeap []expireEntry
+
+func (h expireHeap) Len() int            { return len(h) }
+func (h expireHeap) Less(i, j int) bool  { return h[i].deadline < h[j].deadline }
+func (h expireHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expireHeap) Push(x interface{}) { *h = append(*h, x.(expireEntry)) }
+func (h *expireHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// nowMs returns current unix time in milliseconds.
+func nowMs() int64 { return time.Now().UnixMilli() }
+
+// deadlineTime converts ttl in milliseconds to time.
+func deadlineTime(ttl int64) time.Time { return time.UnixMilli(ttl) }
+
+// expired reports whether ttl of d has passed at now.
+func (d *data) expired(now int64) bool { return d.ttl > 0 && d.ttl <= now }
+
+// now returns current unix time in milliseconds to check ttl
+// of keys. It is zero while the server replays its append
+// only file, so keys don't expire until it is loaded.
+func (dm *DataMap) now() int64 {
+	if dm.srv != nil && atomic.LoadInt32(&dm.srv.loading) != 0 {
+		return 0
+	}
+	return nowMs()
+}
+
+// lookup gets data by key. Expired keys are reported as
+// not existing. It must be called with dm.mu held
+// at least for reading.
+func (dm *DataMap) lookup(key string) (*data, bool) {
+	now := dm.now()
+	d, ok := dm.hash[key]
+	if !ok {
+		return nil, false
+	}
+	if d.expired(now) {
+		dm.wakeExpire()
+		return nil, false
+	}
+	d.touch(now)
+	return d, true
+}
+
+// lookupWrite gets data by key and removes it if it has
+// expired. It must be called with dm.mu held for writing.
+func (dm *DataMap) lookupWrite(key string) (*data, bool) {
+	now := dm.now()
+	d, ok := dm.hash[key]
+	if !ok {
+		return nil, false
+	}
+	if d.expired(now) {
+		dm.delete(key)
+		return nil, false
+	}
+	d.touch(now)
+	return d, true
+}
+
+// delete removes key from dm. It must be
+// called with dm.mu held for writing.
+func (dm *DataMap) delete(key string) {
+	if d, ok := dm.hash[key]; ok {
+		dm.grow(d, -d.size)
+		dm.keys.remove(key)
+	}
+	delete(dm.hash, key)
+	delete(dm.volatile, key)
+}
+
+// setTTL sets ttl of d stored by key and schedules its
+// expiration. Zero ttl makes the key persistent. It must
+// be called with dm.mu held for writing.
+func (dm *DataMap) setTTL(key string, d *data, ttl int64) {
+	d.SetTTL(ttl)
+	dm.modified(d)
+	if ttl == 0 {
+		delete(dm.volatile, key)
+		return
+	}
+	if dm.volatile == nil {
+		dm.volatile = make(map[string]struct{})
+	}
+	dm.volatile[key] = struct{}{}
+	wake := len(dm.expires) == 0 || ttl < dm.expires[0].deadline
+	heap.Push(&dm.expires, expireEntry{deadline: ttl, key: key})
+	if wake {
+		dm.wakeExpire()
+	}
+}
+
+// wakeExpire wakes up the expire loop of dm.
+func (dm *DataMap) wakeExpire() {
+	select {
+	case dm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// expireDue removes keys which deadline has passed at now.
+// It returns when the loop should wake up next time or
+// zero time if there is nothing to wait for.
+func (dm *DataMap) expireDue(now int64) time.Time {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for len(dm.expires) > 0 && dm.expires[0].deadline <= now {
+		e := heap.Pop(&dm.expires).(expireEntry)
+		if d, ok := dm.hash[e.key]; ok && d.ttl == e.deadline {
+			dm.delete(e.key)
+		}
+	}
+	dm.activeExpire(now)
+	// drop stale entries if they outnumber keys with ttl
+	if len(dm.expires) > 2*len(dm.volatile)+64 {
+		dm.expires = dm.expires[:0]
+		for key := range dm.volatile {
+			dm.expires = append(dm.expires, expireEntry{deadline: dm.hash[key].ttl, key: key})
+		}
+		heap.Init(&dm.expires)
+	}
+	if len(dm.volatile) == 0 {
+		return time.Time{}
+	}
+	next := time.Now().Add(activeExpireInterval)
+	if len(dm.expires) > 0 {
+		if t := deadlineTime(dm.expires[0].deadline); t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// activeExpire samples random keys with ttl and removes
+// expired ones. Sampling is repeated while more than a
+// quarter of samples has expired. It must be called with
+// dm.mu held for writing.
+func (dm *DataMap) activeExpire(now int64) {
+	for {
+		sampled, expired := 0, 0
+		for key := range dm.volatile {
+			if sampled == activeExpireSamples {
+				break
+			}
+			sampled++
+			if dm.hash[key].expired(now) {
+				dm.delete(key)
+				expired++
+			}
+		}
+		if expired*4 <= sampled || sampled < activeExpireSamples {
+			return
+		}
+	}
+}
+
+// expireLoop removes expired keys from dm until done is
+// closed. It sleeps until the nearest deadline or until
+// it is woken up.
+func (dm *DataMap) expireLoop(done <-chan struct{}) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		var timeout <-chan time.Time
+		if next := dm.expireDue(dm.now()); !next.IsZero() {
+			timer.Reset(time.Until(next))
+			timeout = timer.C
+		}
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-dm.wake:
+			if !timer.Stop() && timeout != nil {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timeout:
+		}
+	}
+}
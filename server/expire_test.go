@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpireLookup(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.hash["old"] = &data{value: "bye", ttl: nowMs() - 1}
+	dm.hash["new"] = &data{value: "hello", ttl: nowMs() + 100000}
+	if _, err := dm.Get("old"); err != keyNotExistErr {
+		t.Fatalf("got '%v', want '%v' for expired key", err, keyNotExistErr)
+	}
+	if got, err := dm.Get("new"); err != nil || got != "hello" {
+		t.Fatalf("got %q, '%v', want 'hello'", got, err)
+	}
+	if keys := dm.Keys(); len(keys) != 1 || keys[0] != "new" {
+		t.Fatalf("Keys() = %v, want [new]", keys)
+	}
+	if err := dm.Set("old", "again"); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if ttl, _ := dm.TTL("old"); ttl != -1 {
+		t.Fatalf("got %d ttl, new key should not inherit ttl of expired one", ttl)
+	}
+}
+
+func TestExpireDue(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	now := nowMs()
+	for i, ttl := range []int64{now - 2, now - 1, now + 100000} {
+		key := fmt.Sprintf("key%d", i)
+		dm.hash[key] = &data{value: "value"}
+		dm.setTTL(key, dm.hash[key], ttl)
+	}
+	// stale entry: ttl of key2 was changed
+	dm.setTTL("key2", dm.hash["key2"], now+200000)
+	next := dm.expireDue(now)
+	if len(dm.hash) != 1 {
+		t.Fatalf("got %d keys, want 1", len(dm.hash))
+	}
+	if next.IsZero() || next.After(time.Now().Add(activeExpireInterval)) {
+		t.Fatalf("got %v next wake up, want not later than active expire interval", next)
+	}
+	dm.Persist("key2")
+	if next := dm.expireDue(now); !next.IsZero() {
+		t.Fatalf("got %v next wake up, want zero time without keys with ttl", next)
+	}
+}
+
+func TestActiveExpire(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	now := nowMs()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		dm.hash[key] = &data{value: "value", ttl: now - 1}
+		dm.volatile[key] = struct{}{}
+	}
+	dm.activeExpire(now)
+	if len(dm.hash) != 0 {
+		t.Fatalf("got %d keys, expired keys should be sampled and removed", len(dm.hash))
+	}
+}
+
+func TestExpireLoop(t *testing.T) {
+	s := newTestServer(t, Config{})
+	dm := s.getDb("1")
+	dm.Set("key", "value")
+	deadline := nowMs() + 50
+	if err := dm.PExpireat("key", deadline); err != nil {
+		t.Fatalf("PExpireat error: %v", err)
+	}
+	for time.Now().Before(deadlineTime(deadline)) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	dm.mu.RLock()
+	_, ok := dm.hash["key"]
+	dm.mu.RUnlock()
+	if ok {
+		t.Fatal("key should be removed right after its deadline")
+	}
+}
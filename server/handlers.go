@@ -2,109 +2,484 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var globalHash = make(map[string]*DataMap)
-var defalutDbIndex string = "0"
-var launchChecker = make(chan string)
+// serverVersion is reported to clients by HELLO command.
+const serverVersion = "0.1.0"
 
-func init() {
-	var dm DataMap
-	dm.Init()
-	dm.DbId = defalutDbIndex
-	globalHash[defalutDbIndex] = &dm
-}
+var noProtoErr = errors.New("NOPROTO unsupported protocol version")
+
+// protoDetectTimeout is how long a new connection may stay
+// silent before it is treated as a telnet like session.
+const protoDetectTimeout = 100 * time.Millisecond
+
+// client holds the state of a single connection.
+type client struct {
+	srv    *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	wmu    sync.Mutex // guards w, replies and pushed messages share it
+	w      *bufio.Writer
+	addr   string
+	prompt string
+	proto  int
+	id     int64
+	name   string
+	db     *DataMap
+	quit   bool
+
+	pushes    chan pushReply // messages pushed to the client
+	pushOnce  sync.Once
+	closeOnce sync.Once
+	channels  map[string]struct{}
+	patterns  map[string]struct{}
 
-var launchTTLMonitorOnce sync.Once
+	multi   bool              // commands are queued until EXEC
+	queued  [][]string        // commands queued after MULTI
+	watched []watchedKey      // keys watched by WATCH
+	execDbs map[*DataMap]bool // databases locked by running EXEC
 
-func launchTTLMonitor() {
-	go ttlMonitor()
-	launchChecker <- defalutDbIndex
+	replica *replica // not nil if the client is a replica
+	asking  bool     // the next command may use an importing slot
 }
 
-// HandleConn handles each c connection.
-// it also sends db id through launchChecker channel
-// for each new database. addr is required for prompt.
-func HandleConn(c net.Conn, addr string) {
-	launchTTLMonitorOnce.Do(launchTTLMonitor)
-	prompt := fmt.Sprintf("%s[%s] ", addr, defalutDbIndex)
-	dm := globalHash[defalutDbIndex]
-	input := bufio.NewScanner(c)
-	defer c.Close()
-	fmt.Fprintf(c, "%s", prompt)
-	for input.Scan() {
-		cmd, data, err := CommandHandler(input.Text())
+// ServeConn handles connection c until it is closed. The
+// protocol is detected from the first byte sent by the peer:
+// RESP clients start with '*', everything else is served
+// as a telnet like session.
+func (s *Server) ServeConn(c net.Conn) {
+	cl := &client{
+		srv:    s,
+		conn:   c,
+		r:      bufio.NewReader(c),
+		w:      bufio.NewWriter(c),
+		addr:   s.cfg.Addr,
+		id:     atomic.AddInt64(&s.nextClientId, 1),
+		prompt: fmt.Sprintf("%s[%s] ", s.cfg.Addr, defaultDbIndex),
+		db:     s.getDb(defaultDbIndex),
+	}
+	if !s.addClient(cl) {
+		c.Close()
+		return
+	}
+	defer s.removeClient(cl)
+	defer cl.close()
+	cl.detectProtocol()
+	if cl.proto == telnetProto {
+		cl.w.WriteString(cl.prompt)
+		cl.w.Flush()
+	}
+	// the server may be shut down while cl is served
+	for !cl.quit && !s.closed() {
+		args, err := cl.readCommand()
 		if err != nil {
-			fmt.Fprintf(c, "%s", prompt)
-			continue
+			if err != io.EOF && cl.proto != telnetProto && !s.closed() {
+				cl.reply("", nil, err)
+				cl.flush()
+			}
+			return
 		}
-		cmd = strings.ToLower(cmd)
-		if cmd == "select" {
-			if len(data) != 1 {
-				fmt.Fprintf(c, "wrong number of arguments for 'select' command\n%s", prompt)
-				continue
-			} else {
-				id := data[0]
-				_, ok := globalHash[id]
-				if !ok {
-					globalHash[id] = &DataMap{}
-					dm = globalHash[id]
-					dm.Init()
-					dm.DbId = id
-					launchChecker <- id
-				} else {
-					dm = globalHash[id]
-				}
-				prompt = fmt.Sprintf("%s[%s] ", addr, id)
-				fmt.Fprintf(c, "%s", prompt)
-				continue
+		if len(args) == 0 {
+			if cl.proto == telnetProto {
+				cl.wmu.Lock()
+				cl.w.WriteString(cl.prompt)
+				cl.wmu.Unlock()
 			}
+		} else {
+			cl.dispatch(strings.ToLower(args[0]), args[1:])
 		}
-		result, err := DataHandler(dm, cmd, data)
-		if err != nil {
-			fmt.Fprintf(c, "%s\n%s", err.Error(), prompt)
-			continue
+		// flush replies only when pipelined commands are handled
+		// or no more commands will be read.
+		if cl.r.Buffered() == 0 || cl.quit || s.closed() {
+			if err := cl.flush(); err != nil {
+				return
+			}
 		}
-		fmt.Fprintf(c, "%s\n%s", result, prompt)
 	}
 }
 
-// ttlChecker check ttl for each key
-// in endless loop. It resets unhandled ttl to 0.
-func ttlChecker(dm *DataMap) {
-	for {
-		for _, key := range dm.Keys() {
-			ttl, _ := dm.TTL(key)
-			if ttl == "-1" {
-				continue
-			}
-			dTTL, err := strconv.Atoi(ttl)
-			if err != nil {
-				log.Printf("db %s: Got unhandled ttl %q for %q key\n", dm.DbId, ttl, key)
-				log.Printf("db %s: TTL for %q key has been reseted\n", dm.DbId, key)
-				dm.Persist(key)
-				continue
-			}
-			if int64(dTTL) < time.Now().UTC().Unix() {
-				log.Printf("db %s: %q key has been removed. TTL expired\n", dm.DbId, key)
-				dm.Remove(key)
+// flush writes buffered replies to the connection.
+func (cl *client) flush() error {
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+	return cl.w.Flush()
+}
+
+// close releases resources of cl and closes its connection.
+func (cl *client) close() {
+	cl.unsubscribeAll()
+	cl.dropReplica()
+	cl.closeOnce.Do(func() {
+		cl.conn.Close()
+	})
+}
+
+// detectProtocol waits for the first byte from the peer
+// and chooses the protocol of the connection.
+func (cl *client) detectProtocol() {
+	cl.conn.SetReadDeadline(time.Now().Add(protoDetectTimeout))
+	b, err := cl.r.Peek(1)
+	cl.conn.SetReadDeadline(time.Time{})
+	if err == nil && b[0] == '*' {
+		cl.proto = resp2Proto
+	}
+}
+
+// readCommand reads the next command with its arguments.
+// An empty slice is returned for an empty telnet line.
+func (cl *client) readCommand() ([]string, error) {
+	if cl.proto != telnetProto {
+		return readRESPCommand(cl.r)
+	}
+	line, err := readLine(cl.r)
+	if err != nil {
+		return nil, err
+	}
+	cmd, data, err := CommandHandler(line)
+	if err != nil {
+		return nil, nil
+	}
+	return append([]string{cmd}, data...), nil
+}
+
+// dispatch runs cmd and writes the reply.
+func (cl *client) dispatch(cmd string, args []string) {
+	if cl.subscribed() && cl.proto != resp3Proto && !subscribeModeCommands[cmd] {
+		cl.reply(cmd, nil, fmt.Errorf("ERROR: Can't execute '%s': only (P)SUBSCRIBE / "+
+			"(P)UNSUBSCRIBE / PING / QUIT are allowed in this context", cmd))
+		return
+	}
+	if cmd == "psync" || cmd == "replconf" {
+		cl.replicationCommand(cmd, args)
+		return
+	}
+	// messages are pushed to cl as soon as it is subscribed, so
+	// writes are held until the confirmation is written
+	subscribing := cmd == "subscribe" || cmd == "psubscribe"
+	if subscribing {
+		cl.wmu.Lock()
+	}
+	var res interface{}
+	var err error
+	if cl.multi || transactionCommands[cmd] {
+		res, err = cl.transaction(cmd, args)
+	} else {
+		res, err = cl.call(cmd, args)
+	}
+	if cmd != "asking" {
+		// ASKING affects only the next command
+		cl.asking = false
+	}
+	if subscribing {
+		cl.writeReply(cmd, res, err)
+		cl.wmu.Unlock()
+		return
+	}
+	cl.reply(cmd, res, err)
+}
+
+// call runs cmd and returns its result.
+func (cl *client) call(cmd string, args []string) (res interface{}, err error) {
+	switch cmd {
+	case "ping":
+		res, err = cl.ping(args)
+	case "quit":
+		cl.quit = true
+		res = okReply
+	case "shutdown":
+		if res, err = cl.srv.shutdownCommand(args); err == nil {
+			cl.quit = true
+		}
+	case "subscribe":
+		res, err = cl.subscribe(args)
+	case "psubscribe":
+		res, err = cl.psubscribe(args)
+	case "unsubscribe":
+		res = cl.unsubscribe(args)
+	case "punsubscribe":
+		res = cl.punsubscribe(args)
+	case "publish":
+		res, err = cl.srv.publishCommand(args)
+	case "pubsub":
+		res, err = cl.srv.pubsubCommand(args)
+	case "select":
+		res, err = cl.selectDb(args)
+	case "hello":
+		res, err = cl.hello(args)
+	case "save":
+		res, err = cl.srv.saveCommand(args)
+	case "bgsave":
+		res, err = cl.srv.bgsaveCommand(args)
+	case "bgrewriteaof":
+		res, err = cl.srv.bgrewriteaofCommand(args)
+	case "info":
+		res, err = cl.srv.infoCommand(args)
+	case "replicaof", "slaveof":
+		res, err = cl.srv.replicaofCommand(args)
+	case "lastsave":
+		if len(args) != 0 {
+			err = manyArgsErr
+		} else {
+			res = atomic.LoadInt64(&cl.srv.lastSave)
+		}
+	case "cluster":
+		res, err = cl.srv.clusterCommand(args)
+	case "asking":
+		if cl.srv.cluster == nil {
+			err = clusterDisabledErr
+		} else {
+			cl.asking = true
+			res = okReply
+		}
+	case "migrate":
+		res, err = cl.migrate(args)
+	case "blpop", "brpop", "blmove":
+		res, err = cl.blockingPop(cmd, args)
+	default:
+		res, err = cl.execute(cmd, args)
+	}
+	return res, err
+}
+
+// execute runs a data command in the database of cl.
+func (cl *client) execute(cmd string, args []string) (interface{}, error) {
+	if c := cl.srv.cluster; c != nil {
+		if err := c.redirect(cl.db, commandKeys(cmd, args), cl.asking); err != nil {
+			return nil, err
+		}
+	}
+	if cl.execDbs[cl.db] {
+		// the database is already locked by EXEC
+		return executeLocked(cl.db, cmd, args)
+	}
+	return executeAndPropagate(cl.db, cmd, args)
+}
+
+// executeAndPropagate executes cmd in dm and
+// propagates it if it has changed data. Clients
+// blocked on lists cmd has pushed to are served.
+func executeAndPropagate(dm *DataMap, cmd string, args []string) (interface{}, error) {
+	dbs := commandDbs(dm, cmd, args)
+	for _, db := range dbs {
+		db.execMu.RLock()
+	}
+	defer func() {
+		for _, db := range dbs {
+			db.execMu.RUnlock()
+		}
+	}()
+	res, err := executeLocked(dm, cmd, args)
+	if writeCommands[cmd] {
+		for _, db := range dbs {
+			db.serveBlocked()
+		}
+	}
+	return res, err
+}
+
+// executeLocked is like executeAndPropagate, but it
+// must be called with dm.execMu held.
+func executeLocked(dm *DataMap, cmd string, args []string) (interface{}, error) {
+	if !writeCommands[cmd] {
+		return execute(dm, cmd, args)
+	}
+	s := dm.srv
+	if s.repl.isReplica() {
+		return nil, readOnlyErr
+	}
+	s.propagateMu.Lock()
+	defer s.propagateMu.Unlock()
+	if err := s.freeMemoryIfNeeded(); err != nil && !shrinkCommands[cmd] {
+		return nil, err
+	}
+	res, err := execute(dm, cmd, args)
+	if err == nil {
+		propagate(dm, cmd, args, res)
+	}
+	return res, err
+}
+
+// propagate sends cmd executed in dm with result res to the
+// append only file and replicas of the server of dm. It
+// must be called with propagateMu of the server held.
+func propagate(dm *DataMap, cmd string, args []string, res interface{}) {
+	cmds := aofCommands(dm, cmd, args, res)
+	if len(cmds) == 0 {
+		return
+	}
+	s := dm.srv
+	s.repl.feed(dm, cmds)
+	if a := s.aof; a != nil {
+		a.feed(dm, cmds)
+		if a.needsRewrite() {
+			if err := a.startRewrite(); err != nil {
+				log.Printf("append only file rewriting error: %v\n", err)
 			}
 		}
 	}
 }
 
-// ttlMonitor get db id from launchChecker channel
-// and launch ttlChecker got it.
-func ttlMonitor() {
-	for {
-		key := <-launchChecker
-		go ttlChecker(globalHash[key])
+// bgrewriteaofCommand handles BGREWRITEAOF command.
+func (s *Server) bgrewriteaofCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, manyArgsErr
+	}
+	if s.aof == nil {
+		return nil, aofDisabledErr
+	}
+	s.propagateMu.Lock()
+	defer s.propagateMu.Unlock()
+	if err := s.aof.startRewrite(); err != nil {
+		return nil, err
+	}
+	return statusReply("Background append only file rewriting started"), nil
+}
+
+// reply writes result of cmd in the protocol of cl.
+func (cl *client) reply(cmd string, res interface{}, err error) {
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+	cl.writeReply(cmd, res, err)
+}
+
+// writeReply is like reply, but it must be
+// called with cl.wmu held.
+func (cl *client) writeReply(cmd string, res interface{}, err error) {
+	if cl.proto != telnetProto {
+		if err != nil {
+			writeRESP(cl.w, err, cl.proto)
+		} else {
+			writeRESP(cl.w, res, cl.proto)
+		}
+		return
+	}
+	switch {
+	case err != nil:
+		fmt.Fprintf(cl.w, "%s\n%s", err.Error(), cl.prompt)
+	case cmd == "select" && res == okReply:
+		fmt.Fprintf(cl.w, "%s", cl.prompt)
+	default:
+		fmt.Fprintf(cl.w, "%s\n%s", formatReply(res), cl.prompt)
+	}
+}
+
+// ping handles PING [message] command.
+// Subscribed clients get the reply in push format.
+func (cl *client) ping(args []string) (interface{}, error) {
+	if len(args) > 1 {
+		return nil, manyArgsErr
+	}
+	if cl.subscribed() && cl.proto != resp3Proto {
+		msg := ""
+		if len(args) == 1 {
+			msg = args[0]
+		}
+		return []interface{}{"pong", msg}, nil
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return statusReply("PONG"), nil
+}
+
+// saveCommand handles SAVE command.
+func (s *Server) saveCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, manyArgsErr
+	}
+	if err := s.Save(); err != nil {
+		return nil, err
+	}
+	return okReply, nil
+}
+
+// bgsaveCommand handles BGSAVE command.
+func (s *Server) bgsaveCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, manyArgsErr
+	}
+	if err := s.BGSave(); err != nil {
+		return nil, err
+	}
+	return statusReply("Background saving started"), nil
+}
+
+// hello switches cl to the requested protocol version
+// and returns information about the server.
+// HELLO [protover [SETNAME clientname]]
+func (cl *client) hello(args []string) (interface{}, error) {
+	proto := cl.proto
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, noProtoErr
+		}
+		if ver != resp2Proto && ver != resp3Proto {
+			return nil, noProtoErr
+		}
+		proto = ver
+		args = args[1:]
+	}
+	var name string
+	for len(args) > 0 {
+		if strings.ToLower(args[0]) != "setname" || len(args) < 2 {
+			return nil, fmt.Errorf("ERROR: syntax error in HELLO option %q", args[0])
+		}
+		name = args[1]
+		args = args[2:]
+	}
+	if name != "" {
+		cl.name = name
+	}
+	if proto == telnetProto {
+		proto = resp2Proto
+	}
+	// pushed messages are written in the protocol of cl
+	cl.wmu.Lock()
+	cl.proto = proto
+	cl.wmu.Unlock()
+	return mapReply{
+		"server", "redis-like",
+		"version", serverVersion,
+		"proto", int64(proto),
+		"id", cl.id,
+		"mode", cl.srv.mode(),
+		"role", cl.srv.repl.role(),
+		"modules", []string{},
+	}, nil
+}
+
+// mode returns mode of s reported to clients.
+func (s *Server) mode() string {
+	if s.cluster != nil {
+		return "cluster"
+	}
+	return "standalone"
+}
+
+// selectDb switches cl to the database with id from args.
+func (cl *client) selectDb(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("wrong number of arguments for 'select' command")
+	}
+	if cl.srv.cluster != nil && args[0] != defaultDbIndex {
+		return nil, selectInClusterErr
+	}
+	dm, err := cl.srv.db(args[0])
+	if err != nil {
+		return nil, err
 	}
+	cl.db = dm
+	cl.prompt = fmt.Sprintf("%s[%s] ", cl.addr, dm.DbId)
+	return okReply, nil
 }
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+var hashNotIntegerErr = errors.New("ERROR: hash value is not an integer")
+var hashNotFloatErr = errors.New("ERROR: hash value is not a float")
+var nanOrInfErr = errors.New("ERROR: increment would produce NaN or Infinity")
+
+// fieldSize is memory used by field with value in a hash.
+func fieldSize(field, value string) int64 {
+	return int64(len(field)+len(value)) + itemOverhead*2
+}
+
+// lookupHash gets hash stored by key or nil if key
+// not exists. It must be called with dm.mu held at
+// least for reading.
+func (dm *DataMap) lookupHash(key string) (map[string]string, error) {
+	d, ok := dm.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	return d.HGet()
+}
+
+// writeHash gets hash stored by key to change it. A missing
+// hash is created if create is set, otherwise nil is
+// returned. It must be called with dm.mu held for writing.
+func (dm *DataMap) writeHash(key string, create bool) (*data, map[string]string, error) {
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		if !create {
+			return nil, nil, nil
+		}
+		d = dm.create(key)
+		d.HSet(make(map[string]string))
+		return d, d.value.(map[string]string), nil
+	}
+	if _, err := d.HGet(); err != nil {
+		return nil, nil, err
+	}
+	dm.unshare(d)
+	return d, d.value.(map[string]string), nil
+}
+
+// setField sets field of hash d to value. It must
+// be called with dm.mu held for writing.
+func (dm *DataMap) setField(d *data, dict map[string]string, field, value string) {
+	if old, ok := dict[field]; ok {
+		dm.grow(d, int64(len(value)-len(old)))
+	} else {
+		dm.grow(d, fieldSize(field, value))
+		if d.fields != nil {
+			d.fields.add(field)
+		}
+	}
+	dict[field] = value
+	dm.modified(d)
+}
+
+// HDel removes fields from hash in dm by key and returns
+// the number of removed fields. An empty hash is removed.
+// Returns error if key contains another type.
+func (dm *DataMap) HDel(key string, fields ...string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, dict, err := dm.writeHash(key, false)
+	if err != nil || dict == nil {
+		return 0, err
+	}
+	removed := 0
+	for _, field := range fields {
+		if value, ok := dict[field]; ok {
+			delete(dict, field)
+			if d.fields != nil {
+				d.fields.remove(field)
+			}
+			dm.grow(d, -fieldSize(field, value))
+			removed++
+		}
+	}
+	if len(dict) == 0 {
+		dm.delete(key)
+	} else if removed > 0 {
+		dm.modified(d)
+	}
+	return removed, nil
+}
+
+// HLen gets the number of fields of hash in dm by key.
+// Returns error if key contains another type.
+func (dm *DataMap) HLen(key string) (int, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	dict, err := dm.lookupHash(key)
+	return len(dict), err
+}
+
+// HExists reports whether field is in hash in dm by
+// key. Returns error if key contains another type.
+func (dm *DataMap) HExists(key, field string) (bool, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	dict, err := dm.lookupHash(key)
+	if err != nil {
+		return false, err
+	}
+	_, ok := dict[field]
+	return ok, nil
+}
+
+// HKeys gets sorted fields of hash in dm by key.
+// Returns error if key contains another type.
+func (dm *DataMap) HKeys(key string) ([]string, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	dict, err := dm.lookupHash(key)
+	if err != nil {
+		return nil, err
+	}
+	return hashFields(dict), nil
+}
+
+// HVals gets values of hash in dm by key in the order of
+// their fields. Returns error if key contains another type.
+func (dm *DataMap) HVals(key string) ([]string, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	dict, err := dm.lookupHash(key)
+	if err != nil {
+		return nil, err
+	}
+	fields := hashFields(dict)
+	for i, field := range fields {
+		fields[i] = dict[field]
+	}
+	return fields, nil
+}
+
+// hashFields returns sorted fields of dict.
+func hashFields(dict map[string]string) []string {
+	fields := make([]string, 0, len(dict))
+	for field := range dict {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// HMGet gets values of fields of hash in dm by key. Values
+// of missing fields are nil. Returns error if key contains
+// another type.
+func (dm *DataMap) HMGet(key string, fields ...string) ([]interface{}, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	dict, err := dm.lookupHash(key)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if value, ok := dict[field]; ok {
+			res[i] = value
+		}
+	}
+	return res, nil
+}
+
+// HSetNX sets field of hash in dm by key to value if the field
+// not exists and reports whether it has been set. The hash is
+// created if key not exists. Returns error if key contains
+// another type.
+func (dm *DataMap) HSetNX(key, field, value string) (bool, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if dict, err := dm.lookupHash(key); err != nil {
+		return false, err
+	} else if _, ok := dict[field]; ok {
+		return false, nil
+	}
+	d, dict, _ := dm.writeHash(key, true)
+	dm.setField(d, dict, field, value)
+	return true, nil
+}
+
+// HIncrBy increments integer value of field of hash in dm
+// by key by incr and returns the new value. A missing field
+// is 0 and the hash is created if key not exists. Returns
+// error if key contains another type, the value is not an
+// integer or the result overflows.
+func (dm *DataMap) HIncrBy(key, field string, incr int64) (int64, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dict, err := dm.lookupHash(key)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if value, ok := dict[field]; ok {
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, hashNotIntegerErr
+		}
+	}
+	if incr > 0 && n > math.MaxInt64-incr || incr < 0 && n < math.MinInt64-incr {
+		return 0, overflowErr
+	}
+	n += incr
+	d, dict, _ := dm.writeHash(key, true)
+	dm.setField(d, dict, field, strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+// HIncrByFloat increments float value of field of hash in dm
+// by key by incr and returns the new value. A missing field
+// is 0 and the hash is created if key not exists. Returns
+// error if key contains another type, the value is not a
+// float or the result is not a finite number.
+func (dm *DataMap) HIncrByFloat(key, field string, incr float64) (float64, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dict, err := dm.lookupHash(key)
+	if err != nil {
+		return 0, err
+	}
+	var f float64
+	if value, ok := dict[field]; ok {
+		if f, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, hashNotFloatErr
+		}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, nanOrInfErr
+	}
+	d, dict, _ := dm.writeHash(key, true)
+	dm.setField(d, dict, field, formatFloat(f))
+	return f, nil
+}
+
+// HScan gets fields with values of hash in dm by key which
+// follow the cursor of opts and match its pattern, and the
+// next cursor. Fields are indexed in the scan order by the
+// first call, later calls visit only fields they return.
+// Returns error if key contains another type.
+func (dm *DataMap) HScan(key string, opts scanOptions) (uint64, []string, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, ok := dm.lookup(key)
+	if !ok {
+		return 0, nil, nil
+	}
+	dict, err := d.HGet()
+	if err != nil {
+		return 0, nil, err
+	}
+	if d.fields == nil {
+		d.fields = newScanIndex()
+		for field := range dict {
+			d.fields.add(field)
+		}
+	}
+	var res []string
+	next := d.fields.scan(opts, func(field string) {
+		if opts.matches(field) {
+			res = append(res, field, dict[field])
+		}
+	})
+	return next, res, nil
+}
+
+// hashCommand runs hash command cmd with key and args in dm.
+func hashCommand(dm *DataMap, cmd, key string, args []string) (interface{}, error) {
+	switch cmd {
+	case "hdel", "hmget":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if cmd == "hdel" {
+			return dm.HDel(key, args...)
+		}
+		return dm.HMGet(key, args...)
+	case "hlen", "hkeys", "hvals":
+		if len(args) > 0 {
+			return nil, manyArgsErr
+		}
+		switch cmd {
+		case "hlen":
+			return dm.HLen(key)
+		case "hkeys":
+			return dm.HKeys(key)
+		}
+		return dm.HVals(key)
+	case "hexists":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		ok, err := dm.HExists(key, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return 1, nil
+		}
+		return 0, nil
+	case "hsetnx", "hincrby", "hincrbyfloat":
+		if len(args) < 2 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		field := args[0]
+		switch cmd {
+		case "hsetnx":
+			ok, err := dm.HSetNX(key, field, args[1])
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return 1, nil
+			}
+			return 0, nil
+		case "hincrby":
+			incr, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return nil, notIntegerErr
+			}
+			return dm.HIncrBy(key, field, incr)
+		}
+		incr, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+			return nil, notFloatErr
+		}
+		f, err := dm.HIncrByFloat(key, field, incr)
+		if err != nil {
+			return nil, err
+		}
+		return formatFloat(f), nil
+	case "hscan":
+		opts, err := parseScanArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		next, items, err := dm.HScan(key, opts)
+		if err != nil {
+			return nil, err
+		}
+		return scanReply(next, items), nil
+	default:
+		return nil, unknownCmdErr
+	}
+}
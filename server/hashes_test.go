@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestMapHDel(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.HSet("hash", map[string]string{"a": "1", "b": "2"})
+	if n, err := dm.HDel("hash", "a", "c"); err != nil || n != 1 {
+		t.Fatalf("HDel = %d, %v, want 1 removed", n, err)
+	}
+	if n, _ := dm.HLen("hash"); n != 1 {
+		t.Fatalf("got %d fields, want 1", n)
+	}
+	dm.HDel("hash", "b")
+	if _, err := dm.HGet("hash"); err != keyNotExistErr {
+		t.Fatalf("got '%v', empty hash should be removed", err)
+	}
+	dm.Set("str", "value")
+	if _, err := dm.HDel("str", "a"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+	if _, err := dm.HLen("str"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+}
+
+func TestMapHFields(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.HSet("hash", map[string]string{"b": "2", "a": "1", "c": "3"})
+	if keys, _ := dm.HKeys("hash"); fmt.Sprint(keys) != "[a b c]" {
+		t.Fatalf("got %v, want [a b c]", keys)
+	}
+	if vals, _ := dm.HVals("hash"); fmt.Sprint(vals) != "[1 2 3]" {
+		t.Fatalf("got %v, want [1 2 3]", vals)
+	}
+	if res, _ := dm.HMGet("hash", "c", "x", "a"); fmt.Sprint(res) != "[3 <nil> 1]" {
+		t.Fatalf("got %v, want [3 <nil> 1]", res)
+	}
+	if ok, _ := dm.HExists("hash", "b"); !ok {
+		t.Fatal("field 'b' should exist")
+	}
+	if ok, _ := dm.HExists("missing", "b"); ok {
+		t.Fatal("field of missing hash shouldn't exist")
+	}
+	if ok, _ := dm.HSetNX("hash", "a", "new"); ok {
+		t.Fatal("existing field shouldn't be set")
+	}
+	if ok, _ := dm.HSetNX("new-hash", "a", "new"); !ok {
+		t.Fatal("missing field should be set")
+	}
+	if val, _ := dm.HGetVal("new-hash", "a"); val != "new" {
+		t.Fatalf("got %q, want 'new'", val)
+	}
+}
+
+func TestMapHIncr(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if n, err := dm.HIncrBy("hash", "n", 5); err != nil || n != 5 {
+		t.Fatalf("HIncrBy = %d, %v, want 5", n, err)
+	}
+	if n, _ := dm.HIncrBy("hash", "n", -7); n != -2 {
+		t.Fatalf("got %d, want -2", n)
+	}
+	dm.HUpdate("hash", "big", "9223372036854775807")
+	if _, err := dm.HIncrBy("hash", "big", 1); err != overflowErr {
+		t.Fatalf("got '%v', expected '%v' error", err, overflowErr)
+	}
+	dm.HUpdate("hash", "text", "hello")
+	if _, err := dm.HIncrBy("hash", "text", 1); err != hashNotIntegerErr {
+		t.Fatalf("got '%v', expected '%v' error", err, hashNotIntegerErr)
+	}
+	if _, err := dm.HIncrByFloat("hash", "text", 1); err != hashNotFloatErr {
+		t.Fatalf("got '%v', expected '%v' error", err, hashNotFloatErr)
+	}
+	if f, err := dm.HIncrByFloat("hash", "n", 0.5); err != nil || f != -1.5 {
+		t.Fatalf("HIncrByFloat = %v, %v, want -1.5", f, err)
+	}
+	if val, _ := dm.HGetVal("hash", "n"); val != "-1.5" {
+		t.Fatalf("got %q, want -1.5", val)
+	}
+	if _, err := dm.HIncrBy("hash", "n", 1); err != hashNotIntegerErr {
+		t.Fatalf("got '%v', expected '%v' error", err, hashNotIntegerErr)
+	}
+}
+
+func TestMapHScan(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dict := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		dict[fmt.Sprintf("field:%d", i)] = fmt.Sprint(i)
+	}
+	copied := make(map[string]string, len(dict))
+	for k, v := range dict {
+		copied[k] = v
+	}
+	dm.HSet("hash", copied)
+	var fields []string
+	opts := scanOptions{count: 7}
+	for {
+		next, items, err := dm.HScan("hash", opts)
+		if err != nil {
+			t.Fatalf("HScan error: %v", err)
+		}
+		for i := 0; i < len(items); i += 2 {
+			if dict[items[i]] != items[i+1] {
+				t.Fatalf("got %s=%s, want %s", items[i], items[i+1], dict[items[i]])
+			}
+			fields = append(fields, items[i])
+		}
+		if next == 0 {
+			break
+		}
+		opts.cursor = next
+		// fields removed during the scan don't break it
+		dm.HDel("hash", items[0])
+	}
+	sort.Strings(fields)
+	if len(fields) != len(dict) || fields[0] != "field:0" {
+		t.Fatalf("got %d fields, want %d", len(fields), len(dict))
+	}
+	_, items, _ := dm.HScan("hash", scanOptions{count: 100, match: "field:1?"})
+	if len(items) == 0 || len(items)%2 != 0 {
+		t.Fatalf("got %v, want matching fields", items)
+	}
+	// the index of fields follows changes of the hash
+	dm.HSet("hash", map[string]string{"a": "1", "b": "2"})
+	dm.HScan("hash", opts)
+	dm.HDel("hash", "a")
+	dm.HUpdate("hash", "c", "3")
+	_, items, _ = dm.HScan("hash", scanOptions{count: 100})
+	got := make(map[string]string)
+	for i := 0; i+1 < len(items); i += 2 {
+		got[items[i]] = items[i+1]
+	}
+	if len(items) != 4 || fmt.Sprint(got) != "map[b:2 c:3]" {
+		t.Fatalf("got %v, want fields b and c", items)
+	}
+}
+
+func TestHashDataHandlers(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if _, err := DataHandler(&dm, "hdel", []string{"hash"}); err != fewArgsErr {
+		t.Fatalf("got '%v', want: '%v'", err, fewArgsErr)
+	}
+	if res, _ := DataHandler(&dm, "hsetnx", []string{"hash", "a", "1"}); res != "1" {
+		t.Fatalf("got %s, want 1", res)
+	}
+	if res, _ := DataHandler(&dm, "hincrby", []string{"hash", "a", "2"}); res != "3" {
+		t.Fatalf("got %s, want 3", res)
+	}
+	if _, err := DataHandler(&dm, "hincrby", []string{"hash", "a", "x"}); err != notIntegerErr {
+		t.Fatalf("got '%v', want: '%v'", err, notIntegerErr)
+	}
+	if res, _ := DataHandler(&dm, "hincrbyfloat", []string{"hash", "b", "0.1"}); res != "0.1" {
+		t.Fatalf("got %s, want 0.1", res)
+	}
+	if res, _ := DataHandler(&dm, "hexists", []string{"hash", "c"}); res != "0" {
+		t.Fatalf("got %s, want 0", res)
+	}
+	if res, _ := DataHandler(&dm, "hmget", []string{"hash", "a", "c"}); res != "[3 (nil)]" {
+		t.Fatalf("got %s, want [3 (nil)]", res)
+	}
+	if res, _ := DataHandler(&dm, "hscan", []string{"hash", "0"}); res != "[0 [a 3 b 0.1]]" {
+		t.Fatalf("got %s, want [0 [a 3 b 0.1]]", res)
+	}
+	if _, err := DataHandler(&dm, "hscan", []string{"hash", "-1"}); err != invalidCursorErr {
+		t.Fatalf("got '%v', want: '%v'", err, invalidCursorErr)
+	}
+	if _, err := DataHandler(&dm, "hscan", []string{"hash", "0", "count", "0"}); err != syntaxErr {
+		t.Fatalf("got '%v', want: '%v'", err, syntaxErr)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// infoSection returns a section of INFO command output.
+type infoSection struct {
+	name   string
+	fields func(s *Server) [][2]interface{}
+}
+
+var infoSections = []infoSection{
+	{"server", serverInfo},
+	{"memory", memoryInfo},
+	{"persistence", persistenceInfo},
+	{"stats", statsInfo},
+	{"replication", replicationInfo},
+	{"cluster", clusterInfo},
+	{"keyspace", keyspaceInfo},
+}
+
+func serverInfo(s *Server) [][2]interface{} {
+	return [][2]interface{}{
+		{"redis_like_version", serverVersion},
+		{"process_id", os.Getpid()},
+		{"uptime_in_seconds", int64(time.Since(s.startTime).Seconds())},
+	}
+}
+
+func memoryInfo(s *Server) [][2]interface{} {
+	return [][2]interface{}{
+		{"used_memory", s.usedMemory()},
+		{"maxmemory", s.cfg.MaxMemory},
+		{"maxmemory_policy", s.cfg.MaxMemoryPolicy},
+	}
+}
+
+func persistenceInfo(s *Server) [][2]interface{} {
+	fields := [][2]interface{}{
+		{"rdb_bgsave_in_progress", atomic.LoadInt32(&s.bgsaveInProgress)},
+		{"rdb_last_save_time", atomic.LoadInt64(&s.lastSave)},
+		{"aof_enabled", 0},
+	}
+	if aof := s.aof; aof != nil {
+		aof.mu.Lock()
+		fields[2][1] = 1
+		fields = append(fields,
+			[2]interface{}{"aof_rewrite_in_progress", boolToInt(aof.rewriting)},
+			[2]interface{}{"aof_current_size", aof.size},
+			[2]interface{}{"aof_base_size", aof.baseSize},
+		)
+		aof.mu.Unlock()
+	}
+	return fields
+}
+
+func statsInfo(s *Server) [][2]interface{} {
+	return [][2]interface{}{
+		{"connected_clients", s.connectedClients()},
+		{"total_connections_received", atomic.LoadInt64(&s.nextClientId)},
+		{"evicted_keys", atomic.LoadInt64(&s.evictedKeys)},
+	}
+}
+
+func keyspaceInfo(s *Server) [][2]interface{} {
+	var fields [][2]interface{}
+	for _, dm := range s.databases() {
+		dm.mu.RLock()
+		keys, expires := len(dm.hash), len(dm.volatile)
+		dm.mu.RUnlock()
+		if keys > 0 {
+			fields = append(fields, [2]interface{}{"db" + dm.DbId, fmt.Sprintf("keys=%d,expires=%d", keys, expires)})
+		}
+	}
+	return fields
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// infoCommand handles INFO [section ...] command.
+func (s *Server) infoCommand(args []string) (interface{}, error) {
+	want := make(map[string]bool)
+	for _, arg := range args {
+		want[strings.ToLower(arg)] = true
+	}
+	all := len(want) == 0 || want["all"] || want["everything"] || want["default"]
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !want[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(section.name[:1]), section.name[1:])
+		for _, field := range section.fields(s) {
+			fmt.Fprintf(&b, "%v:%v\r\n", field[0], field[1])
+		}
+	}
+	return b.String(), nil
+}
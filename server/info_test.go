@@ -0,0 +1,27 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInfoCommand(t *testing.T) {
+	s := newTestServer(t, Config{})
+	res, err := s.infoCommand([]string{"memory"})
+	if err != nil {
+		t.Fatalf("infoCommand error: %v", err)
+	}
+	info := res.(string)
+	if !strings.HasPrefix(info, "# Memory\r\n") || !strings.Contains(info, "used_memory:") {
+		t.Fatalf("got %q, want memory section", info)
+	}
+	if strings.Contains(info, "# Server") {
+		t.Fatalf("got %q, want only memory section", info)
+	}
+	res, _ = s.infoCommand(nil)
+	for _, section := range infoSections {
+		if !strings.Contains(res.(string), "# "+strings.Title(section.name)) {
+			t.Fatalf("got %q, want %s section", res, section.name)
+		}
+	}
+}
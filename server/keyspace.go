@@ -0,0 +1,593 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var sameObjectErr = errors.New("ERROR: source and destination objects are the same")
+var otherDbInClusterErr = errors.New("ERROR: other databases are not allowed in cluster mode")
+var noServerErr = errors.New("ERROR: the database doesn't belong to a server")
+
+// Del removes keys from dm and returns the
+// number of removed keys.
+func (dm *DataMap) Del(keys ...string) int {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	removed := 0
+	for _, key := range keys {
+		if _, ok := dm.lookupWrite(key); ok {
+			dm.delete(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// lazyFreeThreshold is the number of items above
+// which UNLINK frees a value in the background.
+const lazyFreeThreshold = 64
+
+// Unlink is like Del, but values with many items are
+// freed in the background after dm is unlocked, so
+// large values don't block other clients.
+func (dm *DataMap) Unlink(keys ...string) int {
+	removed, large := dm.unlink(keys)
+	if len(large) > 0 {
+		go freeValues(large)
+	}
+	return removed
+}
+
+// unlink removes keys from dm and returns the number of
+// removed keys and their values with many items which
+// nothing else refers to.
+func (dm *DataMap) unlink(keys []string) (removed int, large []interface{}) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for _, key := range keys {
+		d, ok := dm.lookupWrite(key)
+		if !ok {
+			continue
+		}
+		// a value shared with a snapshot is still in use
+		shared := dm.snapshots != 0 && d.cloned != dm.snapGen
+		if !shared && valueLen(d.value) > lazyFreeThreshold {
+			large = append(large, d.value)
+		}
+		dm.delete(key)
+		removed++
+	}
+	return removed, large
+}
+
+// valueLen returns the number of items in a container.
+func valueLen(value interface{}) int {
+	switch x := value.(type) {
+	case *list:
+		return x.len()
+	case map[string]string:
+		return len(x)
+	case map[string]struct{}:
+		return len(x)
+	case *zset:
+		return x.len()
+	}
+	return 0
+}
+
+// freeValues drops items of removed values, so their
+// memory can be reclaimed part by part.
+func freeValues(values []interface{}) {
+	for _, value := range values {
+		switch x := value.(type) {
+		case *list:
+			clear(x.buf)
+		case map[string]string:
+			clear(x)
+		case map[string]struct{}:
+			clear(x)
+		case *zset:
+			clear(x.dict)
+			x.zsl = nil
+		}
+	}
+}
+
+// Exists returns the number of keys which exist in
+// dm. A key mentioned several times is counted
+// several times.
+func (dm *DataMap) Exists(keys ...string) int {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	n := 0
+	for _, key := range keys {
+		if _, ok := dm.lookup(key); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Touch updates access time of keys in dm and
+// returns the number of existing keys.
+func (dm *DataMap) Touch(keys ...string) int {
+	return dm.Exists(keys...)
+}
+
+// Type returns the type of value stored in dm
+// by key or "none" if key not exists.
+func (dm *DataMap) Type(key string) string {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	d, ok := dm.lookup(key)
+	if !ok {
+		return "none"
+	}
+	return valueType(d.value)
+}
+
+// valueType returns the name of the type of value.
+func valueType(value interface{}) string {
+	switch value.(type) {
+	case string, int64:
+		return "string"
+	case *list:
+		return "list"
+	case map[string]string:
+		return "hash"
+	case map[string]struct{}:
+		return "set"
+	case *zset:
+		return "zset"
+	}
+	return "none"
+}
+
+// Rename renames key src in dm to dst. A value stored
+// by dst is overwritten. Returns error if src not exists.
+func (dm *DataMap) Rename(src, dst string) error {
+	_, err := dm.rename(src, dst, false)
+	return err
+}
+
+// RenameNX renames key src in dm to dst if dst not exists
+// and reports whether the key has been renamed. Returns
+// error if src not exists.
+func (dm *DataMap) RenameNX(src, dst string) (bool, error) {
+	return dm.rename(src, dst, true)
+}
+
+// rename renames src to dst, if nx is set only when
+// dst not exists, and reports whether it has been done.
+func (dm *DataMap) rename(src, dst string, nx bool) (bool, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, ok := dm.lookupWrite(src)
+	if !ok {
+		return false, keyNotExistErr
+	}
+	if src == dst {
+		return !nx, nil
+	}
+	if _, ok := dm.lookupWrite(dst); ok {
+		if nx {
+			return false, nil
+		}
+		dm.delete(dst)
+	}
+	delete(dm.hash, src)
+	delete(dm.volatile, src)
+	dm.keys.remove(src)
+	dm.hash[dst] = d
+	dm.keys.add(dst)
+	dm.grow(d, int64(len(dst)-len(src)))
+	if ttl := d.TTL(); ttl > 0 {
+		dm.setTTL(dst, d, ttl)
+	}
+	dm.modified(d)
+	if _, ok := d.value.(*list); ok {
+		dm.signalReady(dst)
+	}
+	return true, nil
+}
+
+// Copy copies value stored in dm by key src with its ttl
+// to key dst of database to and reports whether it has
+// been copied. A value stored by dst is overwritten only
+// if replace is set. Returns error if src not exists.
+func (dm *DataMap) Copy(src string, to *DataMap, dst string, replace bool) (bool, error) {
+	if dm == to && src == dst {
+		return false, sameObjectErr
+	}
+	unlock := lockPair(dm, to)
+	defer unlock()
+	d, ok := dm.lookupWrite(src)
+	if !ok {
+		return false, keyNotExistErr
+	}
+	if _, ok := to.lookupWrite(dst); ok {
+		if !replace {
+			return false, nil
+		}
+		to.delete(dst)
+	}
+	to.put(dst, cloneValue(d.value), d.TTL())
+	return true, nil
+}
+
+// Move moves key from dm to database to with its ttl if it
+// not exists there and reports whether it has been moved.
+// Returns error if key not exists.
+func (dm *DataMap) Move(key string, to *DataMap) (bool, error) {
+	if dm == to {
+		return false, sameObjectErr
+	}
+	unlock := lockPair(dm, to)
+	defer unlock()
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		return false, keyNotExistErr
+	}
+	if _, ok := to.lookupWrite(key); ok {
+		return false, nil
+	}
+	// snapshots of dm must keep the value unchanged
+	dm.unshare(d)
+	value := d.value
+	dm.delete(key)
+	to.put(key, value, d.TTL())
+	return true, nil
+}
+
+// put stores value with ttl in dm by key which
+// not exists. It must be called with dm.mu held
+// for writing.
+func (dm *DataMap) put(key string, value interface{}, ttl int64) {
+	d := dm.create(key)
+	d.value = value
+	dm.resize(key, d)
+	dm.modified(d)
+	if ttl > 0 {
+		dm.setTTL(key, d, ttl)
+	}
+	if _, ok := value.(*list); ok {
+		dm.signalReady(key)
+	}
+}
+
+// DbSize returns the number of keys in dm.
+func (dm *DataMap) DbSize() int {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return len(dm.hash)
+}
+
+// Flush removes all keys from dm. With async the keys
+// are dropped at once and their memory is reclaimed by
+// the garbage collector in the background.
+func (dm *DataMap) Flush(async bool) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if !async {
+		dm.clear()
+		return
+	}
+	dm.hash = make(map[string]*data)
+	dm.keys = newScanIndex()
+	dm.volatile = make(map[string]struct{})
+	dm.expires = nil
+	atomic.StoreInt64(&dm.used, 0)
+}
+
+// Swap atomically exchanges all keys of dm and other.
+// Clients using either database see the keys of the
+// other one at once, blocked clients are served by lists
+// which have come.
+func (dm *DataMap) Swap(other *DataMap) {
+	if dm == other {
+		return
+	}
+	unlock := lockPair(dm, other)
+	defer unlock()
+	// active snapshots are counted by database,
+	// so swapped values must not be shared
+	dm.unshareAll()
+	other.unshareAll()
+	dm.hash, other.hash = other.hash, dm.hash
+	dm.keys, other.keys = other.keys, dm.keys
+	dm.volatile, other.volatile = other.volatile, dm.volatile
+	dm.expires, other.expires = other.expires, dm.expires
+	used := atomic.LoadInt64(&dm.used)
+	atomic.StoreInt64(&dm.used, atomic.LoadInt64(&other.used))
+	atomic.StoreInt64(&other.used, used)
+	for _, db := range []*DataMap{dm, other} {
+		for key := range db.blocked {
+			if d, ok := db.lookupWrite(key); ok {
+				if _, ok := d.value.(*list); ok {
+					db.signalReady(key)
+				}
+			}
+		}
+		db.wakeExpire()
+	}
+}
+
+// unshareAll makes private copies of all values of dm
+// which may be referenced by an active snapshot. It
+// must be called with dm.mu held for writing.
+func (dm *DataMap) unshareAll() {
+	if dm.snapshots == 0 {
+		return
+	}
+	for _, d := range dm.hash {
+		d.value = cloneValue(d.value)
+	}
+}
+
+// lockPair locks dm and other for writing in the order
+// of their ids, so concurrent calls can't deadlock,
+// and returns the function which unlocks them.
+func lockPair(dm, other *DataMap) (unlock func()) {
+	if dm == other {
+		dm.mu.Lock()
+		return dm.mu.Unlock
+	}
+	first, second := dm, other
+	if second.DbId < first.DbId {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	second.mu.Lock()
+	return func() {
+		second.mu.Unlock()
+		first.mu.Unlock()
+	}
+}
+
+// targetDbs returns the other databases of s used by cmd
+// with args: the destination of MOVE or COPY with DB option,
+// both databases of SWAPDB and all databases for FLUSHALL.
+// It returns nil for other commands or invalid ids.
+func (s *Server) targetDbs(cmd string, args []string) []*DataMap {
+	if s.cluster != nil {
+		return nil
+	}
+	var ids []string
+	switch cmd {
+	case "move":
+		if len(args) == 2 {
+			ids = args[1:]
+		}
+	case "copy":
+		for i := 2; i+1 < len(args); i++ {
+			if strings.ToLower(args[i]) == "db" {
+				ids = args[i+1 : i+2]
+			}
+		}
+	case "swapdb":
+		if len(args) == 2 {
+			ids = args
+		}
+	case "flushall":
+		return s.databases()
+	}
+	var dbs []*DataMap
+	for _, id := range ids {
+		if dm, err := s.db(id); err == nil {
+			dbs = append(dbs, dm)
+		}
+	}
+	return dbs
+}
+
+// otherDb returns database with id of the server of dm.
+func (dm *DataMap) otherDb(id string) (*DataMap, error) {
+	switch {
+	case dm.srv == nil:
+		return nil, noServerErr
+	case dm.srv.cluster != nil:
+		return nil, otherDbInClusterErr
+	}
+	return dm.srv.db(id)
+}
+
+// commandDbs returns databases used by cmd with args
+// executed in dm sorted by id, so they are always
+// locked in the same order.
+func commandDbs(dm *DataMap, cmd string, args []string) []*DataMap {
+	dbs := []*DataMap{dm}
+	used := map[*DataMap]bool{dm: true}
+	for _, other := range dm.srv.targetDbs(cmd, args) {
+		if !used[other] {
+			used[other] = true
+			dbs = append(dbs, other)
+		}
+	}
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].DbId < dbs[j].DbId })
+	return dbs
+}
+
+// Scan gets keys of dm which follow the cursor of opts and
+// match its pattern and typ, and the next cursor. An empty
+// typ matches values of any type.
+func (dm *DataMap) Scan(opts scanOptions, typ string) (uint64, []string) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	now := nowMs()
+	var keys []string
+	next := dm.keys.scan(opts, func(key string) {
+		d := dm.hash[key]
+		if !d.expired(now) && opts.matches(key) && (typ == "" || valueType(d.value) == typ) {
+			keys = append(keys, key)
+		}
+	})
+	return next, keys
+}
+
+// parseKeyScanArgs parses cursor [MATCH pattern] [COUNT count]
+// [TYPE type] arguments of SCAN command.
+func parseKeyScanArgs(args []string) (scanOptions, string, error) {
+	var typ string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if i%2 == 1 && i+1 < len(args) && strings.ToLower(args[i]) == "type" {
+			typ = strings.ToLower(args[i+1])
+			i++
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+	opts, err := parseScanArgs(rest)
+	return opts, typ, err
+}
+
+// keyspaceCommand runs generic command cmd with
+// key and args in dm.
+func keyspaceCommand(dm *DataMap, cmd, key string, args []string) (interface{}, error) {
+	switch cmd {
+	case "del", "unlink", "exists", "touch":
+		keys := append([]string{key}, args...)
+		switch cmd {
+		case "del":
+			return dm.Del(keys...), nil
+		case "unlink":
+			return dm.Unlink(keys...), nil
+		case "exists":
+			return dm.Exists(keys...), nil
+		}
+		return dm.Touch(keys...), nil
+	case "type":
+		if len(args) > 0 {
+			return nil, manyArgsErr
+		}
+		return statusReply(dm.Type(key)), nil
+	case "rename", "renamenx":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		if cmd == "rename" {
+			if err := dm.Rename(key, args[0]); err != nil {
+				return nil, err
+			}
+			return okReply, nil
+		}
+		return boolReply(dm.RenameNX(key, args[0]))
+	case "move":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		to, err := dm.otherDb(args[0])
+		if err != nil {
+			return nil, err
+		}
+		ok, err := dm.Move(key, to)
+		if err == keyNotExistErr {
+			return 0, nil
+		}
+		return boolReply(ok, err)
+	case "copy":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		to, replace := dm, false
+		for i := 1; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "replace":
+				replace = true
+			case "db":
+				if i+1 == len(args) {
+					return nil, syntaxErr
+				}
+				other, err := dm.otherDb(args[i+1])
+				if err != nil {
+					return nil, err
+				}
+				to = other
+				i++
+			default:
+				return nil, syntaxErr
+			}
+		}
+		ok, err := dm.Copy(key, to, args[0], replace)
+		if err == keyNotExistErr {
+			return 0, nil
+		}
+		return boolReply(ok, err)
+	default:
+		return nil, unknownCmdErr
+	}
+}
+
+// databaseCommand runs cmd with args which
+// works with whole databases of dm's server.
+func databaseCommand(dm *DataMap, cmd string, args []string) (interface{}, error) {
+	switch cmd {
+	case "dbsize":
+		if len(args) > 0 {
+			return nil, manyArgsErr
+		}
+		return dm.DbSize(), nil
+	case "flushdb", "flushall":
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		async := false
+		if len(args) == 1 {
+			switch strings.ToLower(args[0]) {
+			case "async":
+				async = true
+			case "sync":
+			default:
+				return nil, syntaxErr
+			}
+		}
+		if cmd == "flushdb" || dm.srv == nil {
+			dm.Flush(async)
+			return okReply, nil
+		}
+		for _, db := range dm.srv.databases() {
+			db.Flush(async)
+		}
+		return okReply, nil
+	case "swapdb":
+		if len(args) < 2 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		a, err := dm.otherDb(args[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := dm.otherDb(args[1])
+		if err != nil {
+			return nil, err
+		}
+		a.Swap(b)
+		return okReply, nil
+	default:
+		return nil, unknownCmdErr
+	}
+}
+
+// boolReply converts result of a command which
+// reports whether it has been done to 1 or 0.
+func boolReply(ok bool, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return 1, nil
+	}
+	return 0, nil
+}
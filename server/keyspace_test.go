@@ -0,0 +1,338 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newDb returns a database with id which
+// doesn't belong to a server.
+func newDb(id string) *DataMap {
+	dm := &DataMap{DbId: id}
+	dm.Init()
+	return dm
+}
+
+func TestMapDelExists(t *testing.T) {
+	dm := newDb("0")
+	dm.Set("a", "1")
+	dm.Set("b", "2")
+	dm.PSetEx("expired", 1, "3")
+	dm.hash["expired"].ttl = nowMs() - 1
+	if n := dm.Exists("a", "a", "b", "c", "expired"); n != 3 {
+		t.Fatalf("got %d, want 3", n)
+	}
+	if n := dm.Del("a", "c", "expired"); n != 1 {
+		t.Fatalf("got %d removed, want 1", n)
+	}
+	if n := dm.Unlink("b", "b"); n != 1 {
+		t.Fatalf("got %d removed, want 1", n)
+	}
+	if len(dm.hash) != 0 {
+		t.Fatalf("got %d keys, want none", len(dm.hash))
+	}
+}
+
+func TestMapUnlinkLarge(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	members := make([]string, lazyFreeThreshold+2)
+	for i := range members {
+		members[i] = fmt.Sprint(i)
+	}
+	dm.SAdd("shared", members...)
+	dm.SAdd("private", members...)
+	dm.SAdd("small", "a")
+	entries, release := dm.snapshotKeys([]string{"shared"})
+	defer release()
+	// the set is cloned by a change after the snapshot
+	dm.SRem("private", "0")
+	removed, large := dm.unlink([]string{"shared", "private", "small", "missing"})
+	if removed != 3 {
+		t.Fatalf("got %d removed, want 3", removed)
+	}
+	if len(large) != 1 || valueLen(large[0]) != len(members)-1 {
+		t.Fatalf("got %d values to free, want only the private set", len(large))
+	}
+	freeValues(large)
+	if n := valueLen(entries[0].value); n != len(members) {
+		t.Fatalf("got %d members in snapshot, value shared with it shouldn't be freed", n)
+	}
+	dm.SAdd("other", members...)
+	if n := dm.Unlink("other"); n != 1 || dm.Exists("other") != 0 {
+		t.Fatalf("got %d removed, want 1", n)
+	}
+}
+
+func TestMapType(t *testing.T) {
+	dm := newDb("0")
+	dm.Set("str", "value")
+	dm.Set("int", "42")
+	dm.LSet("list", []string{"a"})
+	dm.HSet("hash", map[string]string{"a": "1"})
+	dm.SAdd("set", "a")
+	dm.ZAdd("zset", ZAddFlags{}, ZItem{"a", 1})
+	for key, want := range map[string]string{
+		"str": "string", "int": "string", "list": "list",
+		"hash": "hash", "set": "set", "zset": "zset", "missing": "none",
+	} {
+		if got := dm.Type(key); got != want {
+			t.Fatalf("Type(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMapRename(t *testing.T) {
+	dm := newDb("0")
+	if err := dm.Rename("missing", "dst"); err != keyNotExistErr {
+		t.Fatalf("got '%v', expected '%v' error", err, keyNotExistErr)
+	}
+	dm.PSetEx("src", 100000, "value")
+	dm.Set("dst", "old")
+	if ok, _ := dm.RenameNX("src", "dst"); ok {
+		t.Fatal("existing key shouldn't be overwritten by RENAMENX")
+	}
+	ttl := dm.deadline("src")
+	if err := dm.Rename("src", "dst"); err != nil {
+		t.Fatalf("Rename error: %v", err)
+	}
+	if s, _ := dm.Get("dst"); s != "value" || dm.deadline("dst") != ttl {
+		t.Fatalf("got %q with ttl %d, want 'value' with ttl %d", s, dm.deadline("dst"), ttl)
+	}
+	if dm.Exists("src") != 0 {
+		t.Fatal("renamed key should be removed")
+	}
+	if dm.hash["dst"].size != int64(len("dst"))+keyOverhead+dm.hash["dst"].valueSize() {
+		t.Fatalf("got size %d after rename", dm.hash["dst"].size)
+	}
+}
+
+func TestMapCopyMove(t *testing.T) {
+	src, dst := newDb("0"), newDb("1")
+	src.LSet("list", []string{"a", "b"})
+	src.Expire("list", 100)
+	if _, err := src.Copy("list", src, "list", false); err != sameObjectErr {
+		t.Fatalf("got '%v', expected '%v' error", err, sameObjectErr)
+	}
+	if ok, err := src.Copy("list", dst, "copy", false); !ok || err != nil {
+		t.Fatalf("Copy = %v, %v, want copied", ok, err)
+	}
+	src.LPush("list", "c")
+	if items, _ := dst.LGet("copy"); fmt.Sprint(items) != "[a b]" {
+		t.Fatalf("got %v, copy should be independent", items)
+	}
+	if dst.deadline("copy") != src.deadline("list") {
+		t.Fatal("ttl should be copied")
+	}
+	if ok, _ := src.Copy("list", dst, "copy", false); ok {
+		t.Fatal("existing key shouldn't be overwritten without REPLACE")
+	}
+	if ok, _ := src.Copy("list", dst, "copy", true); !ok {
+		t.Fatal("existing key should be overwritten with REPLACE")
+	}
+
+	entries, release := src.snapshot()
+	defer release()
+	if ok, err := src.Move("list", dst); !ok || err != nil {
+		t.Fatalf("Move = %v, %v, want moved", ok, err)
+	}
+	dst.LPush("list", "d")
+	if items := entries[0].value.(*list).items(); fmt.Sprint(items) != "[c a b]" {
+		t.Fatalf("got %v, snapshot shouldn't be changed by moved key", items)
+	}
+	if src.Exists("list") != 0 {
+		t.Fatal("moved key should be removed")
+	}
+	src.Set("list", "value")
+	if ok, _ := src.Move("list", dst); ok {
+		t.Fatal("key existing in destination shouldn't be moved")
+	}
+}
+
+func TestKeyspaceDataHandlers(t *testing.T) {
+	dm := newDb("0")
+	if res, _ := DataHandler(dm, "set", []string{"key", "1"}); res != "OK" {
+		t.Fatalf("got %s, want OK", res)
+	}
+	if res, _ := DataHandler(dm, "type", []string{"key"}); res != "string" {
+		t.Fatalf("got %s, want string", res)
+	}
+	if res, _ := DataHandler(dm, "renamenx", []string{"key", "key"}); res != "0" {
+		t.Fatalf("got %s, want 0", res)
+	}
+	if _, err := DataHandler(dm, "rename", []string{"missing", "key"}); err != keyNotExistErr {
+		t.Fatalf("got '%v', want: '%v'", err, keyNotExistErr)
+	}
+	if res, _ := DataHandler(dm, "copy", []string{"missing", "key"}); res != "0" {
+		t.Fatalf("got %s, want 0", res)
+	}
+	if _, err := DataHandler(dm, "copy", []string{"key", "other", "db"}); err != syntaxErr {
+		t.Fatalf("got '%v', want: '%v'", err, syntaxErr)
+	}
+	if res, _ := DataHandler(dm, "copy", []string{"key", "other"}); res != "1" {
+		t.Fatalf("got %s, want 1", res)
+	}
+	if res, _ := DataHandler(dm, "del", []string{"key", "other", "missing"}); res != "2" {
+		t.Fatalf("got %s, want 2", res)
+	}
+	if res, _ := DataHandler(dm, "exists", []string{"key"}); res != "0" {
+		t.Fatalf("got %s, want 0", res)
+	}
+	if got := aofCommands(dm, "del", []string{"key"}, 0); len(got) != 0 {
+		t.Fatalf("got %v logged, DEL which has removed nothing shouldn't be logged", got)
+	}
+}
+
+func TestMoveWakesBlocked(t *testing.T) {
+	s := newTestServer(t, Config{})
+	src, dst := s.getDb("1"), s.getDb(defaultDbIndex)
+	dst.Remove("move-blocked")
+	src.LSet("move-blocked", []string{"item"})
+	cl, r := blockedClient(t, s, "move-blocked", "blpop", "move-blocked", "0")
+	defer cl.Close()
+
+	res, err := executeAndPropagate(src, "move", []string{"move-blocked", defaultDbIndex})
+	if res != 1 || err != nil {
+		t.Fatalf("MOVE = %v, %v, want 1", res, err)
+	}
+	expectLines(t, r, "*2", "$12", "move-blocked", "$4", "item")
+}
+
+func TestMapFlushSwap(t *testing.T) {
+	a, b := newDb("0"), newDb("1")
+	a.Set("a", "1")
+	a.LSet("list", []string{"x"})
+	b.PSetEx("b", 100000, "2")
+	version := a.keyVersion("list")
+	entries, release := a.snapshot()
+	defer release()
+	a.Swap(b)
+	if a.DbSize() != 1 || b.DbSize() != 2 {
+		t.Fatalf("got %d and %d keys, want 1 and 2", a.DbSize(), b.DbSize())
+	}
+	if a.deadline("b") == 0 || len(a.volatile) != 1 {
+		t.Fatal("ttl should be swapped with the key")
+	}
+	if _, keys := a.Scan(scanOptions{count: 10}, ""); fmt.Sprint(keys) != "[b]" {
+		t.Fatalf("got %v, want [b] scanned after swap", keys)
+	}
+	if b.keyVersion("list") != version {
+		t.Fatal("swapped key should keep its version")
+	}
+	b.LPush("list", "y")
+	for _, e := range entries {
+		if l, ok := e.value.(*list); ok && fmt.Sprint(l.items()) != "[x]" {
+			t.Fatalf("got %v, snapshot shouldn't be changed by swapped key", l.items())
+		}
+	}
+	b.Flush(false)
+	a.Flush(true)
+	if a.DbSize() != 0 || b.DbSize() != 0 || a.used != 0 || b.used != 0 {
+		t.Fatal("flushed databases should be empty")
+	}
+	if _, keys := a.Scan(scanOptions{count: 10}, ""); len(keys) != 0 {
+		t.Fatalf("got %v scanned after flush, want none", keys)
+	}
+}
+
+func TestDatabaseCommands(t *testing.T) {
+	s := newTestServer(t, Config{Databases: 4})
+	db0, db1 := s.getDb(defaultDbIndex), s.getDb("1")
+	db0.Remove("swap-list")
+	db1.LSet("swap-list", []string{"item"})
+	db1.Set("key", "value")
+	cl, r := blockedClient(t, s, "swap-list", "blpop", "swap-list", "0")
+	defer cl.Close()
+	// the client blocked in database 0 is served by the list
+	// which has come from database 1
+	if res, err := executeAndPropagate(db0, "swapdb", []string{"0", "1"}); res != okReply || err != nil {
+		t.Fatalf("SWAPDB = %v, %v, want OK", res, err)
+	}
+	expectLines(t, r, "*2", "$9", "swap-list", "$4", "item")
+	if res, _ := DataHandler(db0, "dbsize", nil); res != "1" {
+		t.Fatalf("got %s keys, want 1", res)
+	}
+	for _, c := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"swapdb", "0"}, fewArgsErr},
+		{[]string{"swapdb", "0", "4"}, dbIndexRangeErr},
+		{[]string{"flushdb", "now"}, syntaxErr},
+		{[]string{"flushall", "async", "now"}, manyArgsErr},
+		{[]string{"dbsize", "x"}, manyArgsErr},
+	} {
+		if _, err := executeAndPropagate(db0, c.args[0], c.args[1:]); err != c.err {
+			t.Fatalf("%v error is '%v', want '%v'", c.args, err, c.err)
+		}
+	}
+	if res, _ := DataHandler(db1, "flushdb", []string{"sync"}); res != "OK" || db1.DbSize() != 0 {
+		t.Fatalf("got %s, want database 1 to be flushed", res)
+	}
+	s.getDb("2").Set("key", "value")
+	if res, _ := executeAndPropagate(db0, "flushall", []string{"async"}); res != okReply {
+		t.Fatalf("got %v, want OK", res)
+	}
+	if s.usedMemory() != 0 {
+		t.Fatalf("got %d used memory, want all databases flushed", s.usedMemory())
+	}
+}
+
+func TestMapScan(t *testing.T) {
+	dm := newDb("0")
+	for i := 0; i < 100; i++ {
+		dm.Set(fmt.Sprintf("key:%d", i), "value")
+	}
+	seen := make(map[string]bool)
+	opts := scanOptions{count: 10}
+	for i := 0; ; i++ {
+		next, keys := dm.Scan(opts, "")
+		for _, key := range keys {
+			seen[key] = true
+		}
+		if next == 0 {
+			break
+		}
+		opts.cursor = next
+		// keys added during the scan don't break it
+		dm.Set(fmt.Sprintf("new:%d", i), "value")
+	}
+	for i := 0; i < 100; i++ {
+		if key := fmt.Sprintf("key:%d", i); !seen[key] {
+			t.Fatalf("key %s is missed", key)
+		}
+	}
+	dm.LSet("key:list", []string{"a"})
+	_, keys := dm.Scan(scanOptions{count: 1000, match: "key:*"}, "list")
+	if fmt.Sprint(keys) != "[key:list]" {
+		t.Fatalf("got %v, want [key:list]", keys)
+	}
+	dm.Rename("key:list", "renamed:list")
+	if _, keys := dm.Scan(scanOptions{count: 1000}, "list"); fmt.Sprint(keys) != "[renamed:list]" {
+		t.Fatalf("got %v, want [renamed:list]", keys)
+	}
+	if keys := dm.KeysMatch("key:1?"); len(keys) != 10 {
+		t.Fatalf("got %v, want 10 keys", keys)
+	}
+}
+
+func TestScanDataHandlers(t *testing.T) {
+	dm := newDb("0")
+	dm.Set("a", "1")
+	dm.LSet("b", []string{"1"})
+	if res, _ := DataHandler(dm, "scan", []string{"0", "type", "list", "count", "10"}); res != "[0 [b]]" {
+		t.Fatalf("got %s, want [0 [b]]", res)
+	}
+	if _, err := DataHandler(dm, "scan", []string{"0", "type"}); err != syntaxErr {
+		t.Fatalf("got '%v', want: '%v'", err, syntaxErr)
+	}
+	if _, err := DataHandler(dm, "scan", []string{"x"}); err != invalidCursorErr {
+		t.Fatalf("got '%v', want: '%v'", err, invalidCursorErr)
+	}
+	if res, _ := DataHandler(dm, "keys", []string{"[a]"}); res != "[a]" {
+		t.Fatalf("got %s, want [a]", res)
+	}
+	if _, err := DataHandler(dm, "keys", []string{"a", "b"}); err != manyArgsErr {
+		t.Fatalf("got '%v', want: '%v'", err, manyArgsErr)
+	}
+}
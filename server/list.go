@@ -0,0 +1,561 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var noPivotErr = errors.New("ERROR: syntax error, BEFORE or AFTER expected")
+var noDirectionErr = errors.New("ERROR: syntax error, LEFT or RIGHT expected")
+
+// minListCapacity is the smallest ring buffer of a list.
+const minListCapacity = 8
+
+// list is a double-ended queue of strings kept in a ring
+// buffer which capacity is a power of two. Pushes and pops
+// at both ends are amortized O(1), an item is got by index
+// in O(1) as well.
+type list struct {
+	buf  []string
+	head int // position of the first item in buf
+	n    int // number of items
+}
+
+// newList returns a list with a copy of items.
+func newList(items []string) *list {
+	l := &list{}
+	l.resize(len(items))
+	l.n = copy(l.buf, items)
+	return l
+}
+
+func (l *list) len() int { return l.n }
+
+// pos returns position in buf of item with index i.
+func (l *list) pos(i int) int { return (l.head + i) & (len(l.buf) - 1) }
+
+func (l *list) at(i int) string { return l.buf[l.pos(i)] }
+
+func (l *list) set(i int, s string) { l.buf[l.pos(i)] = s }
+
+// resize moves items of l to a new buffer
+// which fits at least n items.
+func (l *list) resize(n int) {
+	size := minListCapacity
+	for size < n {
+		size <<= 1
+	}
+	buf := make([]string, size)
+	for i := 0; i < l.n; i++ {
+		buf[i] = l.at(i)
+	}
+	l.buf, l.head = buf, 0
+}
+
+// shrink releases memory of a mostly empty buffer.
+func (l *list) shrink() {
+	if len(l.buf) > minListCapacity && l.n <= len(l.buf)/4 {
+		l.resize(l.n * 2)
+	}
+}
+
+func (l *list) pushBack(s string) {
+	if l.n == len(l.buf) {
+		l.resize(l.n + 1)
+	}
+	l.buf[l.pos(l.n)] = s
+	l.n++
+}
+
+func (l *list) pushFront(s string) {
+	if l.n == len(l.buf) {
+		l.resize(l.n + 1)
+	}
+	l.head = (l.head - 1) & (len(l.buf) - 1)
+	l.buf[l.head] = s
+	l.n++
+}
+
+func (l *list) popFront() string {
+	s := l.buf[l.head]
+	l.buf[l.head] = ""
+	l.head = (l.head + 1) & (len(l.buf) - 1)
+	l.n--
+	l.shrink()
+	return s
+}
+
+func (l *list) popBack() string {
+	i := l.pos(l.n - 1)
+	s := l.buf[i]
+	l.buf[i] = ""
+	l.n--
+	l.shrink()
+	return s
+}
+
+// slice returns a copy of items from start to stop inclusive.
+func (l *list) slice(start, stop int) []string {
+	res := make([]string, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		res = append(res, l.at(i))
+	}
+	return res
+}
+
+// items returns a copy of all items of l.
+func (l *list) items() []string { return l.slice(0, l.n-1) }
+
+func (l *list) clone() *list { return newList(l.items()) }
+
+func (l *list) String() string { return fmt.Sprint(l.items()) }
+
+// listRange converts start and stop indexes which may count
+// from the end of a list of n items to a valid range. It
+// returns false if the range is empty.
+func listRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, start <= stop
+}
+
+// lookupList gets list stored by key or nil if key not
+// exists. It must be called with dm.mu held at least
+// for reading.
+func (dm *DataMap) lookupList(key string) (*list, error) {
+	d, ok := dm.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	return d.ListGet()
+}
+
+// writeList gets list stored by key to change it. A missing
+// list is created if create is set, otherwise nil is
+// returned. It must be called with dm.mu held for writing.
+func (dm *DataMap) writeList(key string, create bool) (*data, *list, error) {
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		if !create {
+			return nil, nil, nil
+		}
+		d = dm.create(key)
+		d.ListSet(newList(nil))
+		return d, d.value.(*list), nil
+	}
+	if _, err := d.ListGet(); err != nil {
+		return nil, nil, err
+	}
+	dm.unshare(d)
+	return d, d.value.(*list), nil
+}
+
+// listChanged finishes a change of list l stored in d by
+// key. An empty list is removed. It must be called with
+// dm.mu held for writing.
+func (dm *DataMap) listChanged(key string, d *data, l *list, changed bool) {
+	if l.len() == 0 {
+		dm.delete(key)
+	} else if changed {
+		dm.modified(d)
+	}
+}
+
+// LPush inserts items at the head of list in dm by key
+// one after another and returns the new length of the
+// list. The list is created if key not exists.
+// Returns error if key contains another type.
+func (dm *DataMap) LPush(key string, items ...string) (int, error) {
+	return dm.push(key, items, false)
+}
+
+// RPush appends items to the tail of list in dm by key
+// and returns the new length of the list. The list is
+// created if key not exists. Returns error if key
+// contains another type.
+func (dm *DataMap) RPush(key string, items ...string) (int, error) {
+	return dm.push(key, items, true)
+}
+
+func (dm *DataMap) push(key string, items []string, tail bool) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.pushItems(key, items, tail)
+}
+
+// pushItems adds items to the head or the tail of list
+// stored by key and returns the new length of the list.
+// It must be called with dm.mu held for writing.
+func (dm *DataMap) pushItems(key string, items []string, tail bool) (int, error) {
+	d, l, err := dm.writeList(key, true)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if tail {
+			l.pushBack(item)
+		} else {
+			l.pushFront(item)
+		}
+		dm.grow(d, int64(len(item))+itemOverhead)
+	}
+	dm.listChanged(key, d, l, len(items) > 0)
+	if len(items) > 0 {
+		dm.signalReady(key)
+	}
+	return l.len(), nil
+}
+
+// LPop removes up to count items from the head of list in
+// dm by key and returns them. Returns error if key not
+// exists or contains another type.
+func (dm *DataMap) LPop(key string, count int) ([]string, error) {
+	return dm.pop(key, count, false)
+}
+
+// RPop removes up to count items from the tail of list in
+// dm by key and returns them. Returns error if key not
+// exists or contains another type.
+func (dm *DataMap) RPop(key string, count int) ([]string, error) {
+	return dm.pop(key, count, true)
+}
+
+func (dm *DataMap) pop(key string, count int, tail bool) ([]string, error) {
+	if count < 0 {
+		return nil, negativeCountErr
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.popItems(key, count, tail)
+}
+
+// popItems removes up to count items from the head or the
+// tail of list stored by key and returns them. It must be
+// called with dm.mu held for writing.
+func (dm *DataMap) popItems(key string, count int, tail bool) ([]string, error) {
+	d, l, err := dm.writeList(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, keyNotExistErr
+	}
+	res := make([]string, 0, min(count, l.len()))
+	for len(res) < count && l.len() > 0 {
+		var item string
+		if tail {
+			item = l.popBack()
+		} else {
+			item = l.popFront()
+		}
+		dm.grow(d, -int64(len(item))-itemOverhead)
+		res = append(res, item)
+	}
+	dm.listChanged(key, d, l, len(res) > 0)
+	return res, nil
+}
+
+// LMove pops an item from the head or the tail of list in
+// dm by src and pushes it to the head or the tail of list
+// by dst. It returns false if src not exists. Returns error
+// if src or dst contains another type.
+func (dm *DataMap) LMove(src, dst string, fromTail, toTail bool) (string, bool, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.move(src, dst, fromTail, toTail)
+}
+
+// move is LMove which must be called with dm.mu held for writing.
+func (dm *DataMap) move(src, dst string, fromTail, toTail bool) (string, bool, error) {
+	l, err := dm.lookupList(src)
+	if err != nil || l == nil || l.len() == 0 {
+		return "", false, err
+	}
+	if _, err := dm.lookupList(dst); err != nil {
+		return "", false, err
+	}
+	items, _ := dm.popItems(src, 1, fromTail)
+	dm.pushItems(dst, items, toTail)
+	return items[0], true, nil
+}
+
+// LRange gets items of list in dm by key from start to
+// stop inclusive. Negative indexes count from the end
+// of the list. Returns error if key contains another type.
+func (dm *DataMap) LRange(key string, start, stop int) ([]string, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	l, err := dm.lookupList(key)
+	if err != nil || l == nil {
+		return []string{}, err
+	}
+	start, stop, ok := listRange(start, stop, l.len())
+	if !ok {
+		return []string{}, nil
+	}
+	return l.slice(start, stop), nil
+}
+
+// LLen gets length of list in dm by key.
+// Returns error if key contains another type.
+func (dm *DataMap) LLen(key string) (int, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	l, err := dm.lookupList(key)
+	if err != nil || l == nil {
+		return 0, err
+	}
+	return l.len(), nil
+}
+
+// LTrim keeps only items of list in dm by key from start
+// to stop inclusive. Negative indexes count from the end
+// of the list. Returns error if key contains another type.
+func (dm *DataMap) LTrim(key string, start, stop int) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, l, err := dm.writeList(key, false)
+	if err != nil || l == nil {
+		return err
+	}
+	start, stop, ok := listRange(start, stop, l.len())
+	if !ok {
+		start, stop = l.len(), l.len()-1
+	}
+	removed := 0
+	for i := 0; i < start; i++ {
+		item := l.popFront()
+		dm.grow(d, -int64(len(item))-itemOverhead)
+		removed++
+	}
+	for l.len() > stop-start+1 {
+		item := l.popBack()
+		dm.grow(d, -int64(len(item))-itemOverhead)
+		removed++
+	}
+	dm.listChanged(key, d, l, removed > 0)
+	return nil
+}
+
+// LInsert inserts item before or after the first pivot
+// item of list in dm by key. It returns the new length
+// of the list, -1 if pivot is not found or 0 if key not
+// exists. Returns error if key contains another type.
+func (dm *DataMap) LInsert(key string, before bool, pivot, item string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, l, err := dm.writeList(key, false)
+	if err != nil || l == nil {
+		return 0, err
+	}
+	items := l.items()
+	for i, s := range items {
+		if s != pivot {
+			continue
+		}
+		if !before {
+			i++
+		}
+		items = append(items[:i], append([]string{item}, items[i:]...)...)
+		*l = *newList(items)
+		dm.grow(d, int64(len(item))+itemOverhead)
+		dm.modified(d)
+		return l.len(), nil
+	}
+	return -1, nil
+}
+
+// LRem removes count items equal to item from list in dm
+// by key and returns the number of removed items. Items
+// are removed from the head if count is positive, from the
+// tail if count is negative, or all of them if count is 0.
+// Returns error if key contains another type.
+func (dm *DataMap) LRem(key string, count int, item string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, l, err := dm.writeList(key, false)
+	if err != nil || l == nil {
+		return 0, err
+	}
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	items := l.items()
+	keep := make([]bool, len(items))
+	removed := 0
+	for i := range items {
+		j := i
+		if count < 0 {
+			j = len(items) - 1 - i
+		}
+		if items[j] == item && (limit == 0 || removed < limit) {
+			removed++
+			continue
+		}
+		keep[j] = true
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	rest := make([]string, 0, len(items)-removed)
+	for i, s := range items {
+		if keep[i] {
+			rest = append(rest, s)
+		}
+	}
+	*l = *newList(rest)
+	dm.grow(d, -int64(removed)*(int64(len(item))+itemOverhead))
+	dm.listChanged(key, d, l, true)
+	return removed, nil
+}
+
+// listCommand runs list command cmd with key and args in dm.
+func listCommand(dm *DataMap, cmd, key string, args []string) (interface{}, error) {
+	switch cmd {
+	case "lpush", "rpush":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if cmd == "lpush" {
+			return dm.LPush(key, args...)
+		}
+		return dm.RPush(key, args...)
+	case "lpop", "rpop":
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		count := 1
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, wrongArgErr
+			}
+			count = n
+		}
+		var items []string
+		var err error
+		if cmd == "lpop" {
+			items, err = dm.LPop(key, count)
+		} else {
+			items, err = dm.RPop(key, count)
+		}
+		if err == keyNotExistErr {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 1 {
+			return items, nil
+		}
+		return items[0], nil
+	case "lrange", "ltrim":
+		if len(args) < 2 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		start, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, wrongArgErr
+		}
+		stop, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, wrongArgErr
+		}
+		if cmd == "lrange" {
+			return dm.LRange(key, start, stop)
+		}
+		if err := dm.LTrim(key, start, stop); err != nil {
+			return nil, err
+		}
+		return okReply, nil
+	case "lmove":
+		if len(args) < 3 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 3 {
+			return nil, manyArgsErr
+		}
+		fromTail, toTail, err := parseMoveDirections(args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		item, ok, err := dm.LMove(key, args[0], fromTail, toTail)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return item, nil
+	case "llen":
+		if len(args) > 0 {
+			return nil, manyArgsErr
+		}
+		return dm.LLen(key)
+	case "linsert":
+		if len(args) < 3 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 3 {
+			return nil, manyArgsErr
+		}
+		var before bool
+		switch strings.ToLower(args[0]) {
+		case "before":
+			before = true
+		case "after":
+		default:
+			return nil, noPivotErr
+		}
+		return dm.LInsert(key, before, args[1], args[2])
+	case "lrem":
+		if len(args) < 2 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		count, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, wrongArgErr
+		}
+		return dm.LRem(key, count, args[1])
+	default:
+		return nil, unknownCmdErr
+	}
+}
+
+// parseMoveDirections parses LEFT|RIGHT LEFT|RIGHT
+// arguments of LMOVE and BLMOVE commands.
+func parseMoveDirections(from, to string) (bool, bool, error) {
+	fromTail, err := parseDirection(from)
+	if err != nil {
+		return false, false, err
+	}
+	toTail, err := parseDirection(to)
+	return fromTail, toTail, err
+}
+
+// parseDirection returns true for RIGHT and false for LEFT.
+func parseDirection(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "left":
+		return false, nil
+	case "right":
+		return true, nil
+	}
+	return false, noDirectionErr
+}
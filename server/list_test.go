@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestListDeque(t *testing.T) {
+	l := newList(nil)
+	var want []string
+	for i := 0; i < 20; i++ {
+		s := fmt.Sprint(i)
+		if i%2 == 0 {
+			l.pushBack(s)
+			want = append(want, s)
+		} else {
+			l.pushFront(s)
+			want = append([]string{s}, want...)
+		}
+	}
+	if fmt.Sprint(l.items()) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", l.items(), want)
+	}
+	if len(l.buf) != 32 {
+		t.Fatalf("got capacity %d, want 32", len(l.buf))
+	}
+	for i := 0; i < 16; i++ {
+		if i%2 == 0 {
+			if s := l.popFront(); s != want[0] {
+				t.Fatalf("popFront = %s, want %s", s, want[0])
+			}
+			want = want[1:]
+		} else {
+			if s := l.popBack(); s != want[len(want)-1] {
+				t.Fatalf("popBack = %s, want %s", s, want[len(want)-1])
+			}
+			want = want[:len(want)-1]
+		}
+	}
+	if fmt.Sprint(l) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", l, want)
+	}
+	if len(l.buf) != minListCapacity {
+		t.Fatalf("got capacity %d, list should shrink to %d", len(l.buf), minListCapacity)
+	}
+}
+
+func TestMapPushPop(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if n, err := dm.RPush("list", "b", "c"); err != nil || n != 2 {
+		t.Fatalf("RPush = %d, %v, want length 2", n, err)
+	}
+	if n, _ := dm.LPush("list", "a", "z"); n != 4 {
+		t.Fatalf("got length %d, want 4", n)
+	}
+	if items, _ := dm.LRange("list", 0, -1); fmt.Sprint(items) != "[z a b c]" {
+		t.Fatalf("got %v, want [z a b c]", items)
+	}
+	if items, err := dm.LPop("list", 1); err != nil || fmt.Sprint(items) != "[z]" {
+		t.Fatalf("LPop = %v, %v, want [z]", items, err)
+	}
+	if items, _ := dm.RPop("list", 5); fmt.Sprint(items) != "[c b a]" {
+		t.Fatalf("got %v, want [c b a]", items)
+	}
+	if _, err := dm.LPop("list", 1); err != keyNotExistErr {
+		t.Fatalf("got '%v', empty list should be removed", err)
+	}
+	if _, err := dm.RPop("list", -1); err != negativeCountErr {
+		t.Fatalf("got '%v', expected '%v' error", err, negativeCountErr)
+	}
+	dm.RPush("huge", "a", "b")
+	if items, _ := dm.LPop("huge", math.MaxInt64); fmt.Sprint(items) != "[a b]" {
+		t.Fatalf("got %v, want [a b]", items)
+	}
+	dm.RPush("huge", "a", "b")
+	if items, _ := dm.RPop("huge", math.MaxInt64); fmt.Sprint(items) != "[b a]" {
+		t.Fatalf("got %v, want [b a]", items)
+	}
+	dm.Set("str", "value")
+	if _, err := dm.LPush("str", "a"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+	if _, err := dm.LLen("str"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+}
+
+func TestMapLRangeTrim(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.RPush("list", "a", "b", "c", "d", "e")
+	cases := []struct {
+		start, stop int
+		want        string
+	}{
+		{0, 1, "[a b]"},
+		{-2, -1, "[d e]"},
+		{-100, 100, "[a b c d e]"},
+		{3, 1, "[]"},
+		{5, 10, "[]"},
+	}
+	for _, c := range cases {
+		if got, _ := dm.LRange("list", c.start, c.stop); fmt.Sprint(got) != c.want {
+			t.Fatalf("LRange(%d, %d) = %v, want %s", c.start, c.stop, got, c.want)
+		}
+	}
+	if got, err := dm.LRange("missing", 0, -1); err != nil || len(got) != 0 {
+		t.Fatalf("LRange = %v, %v, want empty list", got, err)
+	}
+	dm.LTrim("list", 1, -2)
+	if got, _ := dm.LRange("list", 0, -1); fmt.Sprint(got) != "[b c d]" {
+		t.Fatalf("got %v, want [b c d]", got)
+	}
+	dm.LTrim("list", 2, 1)
+	if n, _ := dm.LLen("list"); n != 0 {
+		t.Fatalf("got length %d, list should be removed", n)
+	}
+}
+
+func TestMapLInsertRem(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.RPush("list", "a", "x", "b", "x", "c", "x")
+	if n, _ := dm.LInsert("list", true, "b", "y"); n != 7 {
+		t.Fatalf("got length %d, want 7", n)
+	}
+	if n, _ := dm.LInsert("list", false, "c", "z"); n != 8 {
+		t.Fatalf("got length %d, want 8", n)
+	}
+	if n, _ := dm.LInsert("list", true, "missing", "y"); n != -1 {
+		t.Fatalf("got %d, want -1 for missing pivot", n)
+	}
+	if n, _ := dm.LInsert("missing", true, "a", "y"); n != 0 {
+		t.Fatalf("got %d, want 0 for missing key", n)
+	}
+	if n, _ := dm.LRem("list", -2, "x"); n != 2 {
+		t.Fatalf("got %d removed, want 2", n)
+	}
+	if got, _ := dm.LRange("list", 0, -1); fmt.Sprint(got) != "[a x y b c z]" {
+		t.Fatalf("got %v, want [a x y b c z]", got)
+	}
+	dm.RPush("list", "x")
+	if n, _ := dm.LRem("list", 0, "x"); n != 2 {
+		t.Fatalf("got %d removed, want 2", n)
+	}
+	if n, _ := dm.LRem("list", 1, "y"); n != 1 {
+		t.Fatalf("got %d removed, want 1", n)
+	}
+	if got, _ := dm.LRange("list", 0, -1); fmt.Sprint(got) != "[a b c z]" {
+		t.Fatalf("got %v, want [a b c z]", got)
+	}
+}
+
+func TestListDataHandlers(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if _, err := DataHandler(&dm, "rpush", []string{"list"}); err != fewArgsErr {
+		t.Fatalf("got '%v', want: '%v'", err, fewArgsErr)
+	}
+	if res, _ := DataHandler(&dm, "rpush", []string{"list", "a", "b", "c"}); res != "3" {
+		t.Fatalf("got %s, want 3", res)
+	}
+	if res, _ := DataHandler(&dm, "lpop", []string{"list"}); res != "a" {
+		t.Fatalf("got %s, want a", res)
+	}
+	if res, _ := DataHandler(&dm, "rpop", []string{"list", "1"}); res != "[c]" {
+		t.Fatalf("got %s, want [c]", res)
+	}
+	if res, _ := DataHandler(&dm, "lpop", []string{"missing"}); res != "(nil)" {
+		t.Fatalf("got %s, want (nil)", res)
+	}
+	if res, _ := DataHandler(&dm, "linsert", []string{"list", "after", "b", "d"}); res != "2" {
+		t.Fatalf("got %s, want 2", res)
+	}
+	if _, err := DataHandler(&dm, "linsert", []string{"list", "around", "b", "d"}); err != noPivotErr {
+		t.Fatalf("got '%v', want: '%v'", err, noPivotErr)
+	}
+	if res, _ := DataHandler(&dm, "lrange", []string{"list", "0", "-1"}); res != "[b d]" {
+		t.Fatalf("got %s, want [b d]", res)
+	}
+	if res, _ := DataHandler(&dm, "llen", []string{"list"}); res != "2" {
+		t.Fatalf("got %s, want 2", res)
+	}
+	if res, _ := DataHandler(&dm, "lget", []string{"list"}); res != "[b d]" {
+		t.Fatalf("got %s, want [b d]", res)
+	}
+}
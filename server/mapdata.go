@@ -3,35 +3,71 @@ package server
 
 import (
 	"errors"
-	"fmt"
+	"math"
 	"sync"
-	"time"
 )
 
 var keyNotExistErr = errors.New("ERROR: key not exists")
 var invalidIndexErr = errors.New("ERROR: invalid list index")
 var invalidInnerKeyErr = errors.New("ERROR: invalid inner key")
+var wrongDurationErr = errors.New("ERROR: wrong duration for ttl")
+var pastTTLErr = errors.New("ERROR: ttl must be greater than now")
 
 type DataMap struct {
-	DbId string
-	mu   sync.RWMutex
-	hash map[string]*data
+	used      int64 // estimated memory used by keys and values
+	DbId      string
+	srv       *Server // nil for databases created outside a server
+	mu        sync.RWMutex
+	hash      map[string]*data
+	keys      *scanIndex          // keys of hash in the scan order
+	volatile  map[string]struct{} // keys with ttl
+	expires   expireHeap
+	wake      chan struct{}
+	snapshots int                      // number of snapshots sharing values with hash
+	snapGen   uint64                   // generation of the latest snapshot, see unshare
+	execMu    sync.RWMutex             // held for writing by running transactions
+	blocked   map[string][]*blockedPop // clients blocked by key
+	ready     []string                 // keys with blocked clients which got items
 }
 
 // Init initializes hash map in dm.
 func (dm *DataMap) Init() {
 	dm.hash = make(map[string]*data)
+	dm.keys = newScanIndex()
+	dm.volatile = make(map[string]struct{})
+	dm.wake = make(chan struct{}, 1)
+	dm.blocked = make(map[string][]*blockedPop)
 }
 
-// Set sets string in dm by key.
+// Set sets string in dm by key removing its ttl.
 // Returns error if key contains another type.
 func (dm *DataMap) Set(key, val string) error {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
-	if _, ok := dm.hash[key]; !ok {
-		dm.hash[key] = new(data)
+	d, _, err := dm.lookupString(key)
+	if err != nil {
+		return err
+	}
+	dm.setString(key, d, val, 0, false)
+	return nil
+}
+
+// PSetEx sets string in dm by key with
+// ttl of dur milliseconds. Returns error if
+// key contains another type.
+func (dm *DataMap) PSetEx(key string, dur int64, val string) error {
+	now := nowMs()
+	if dur <= 0 || dur > math.MaxInt64-now {
+		return wrongDurationErr
 	}
-	return dm.hash[key].SSet(val)
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, _, err := dm.lookupString(key)
+	if err != nil {
+		return err
+	}
+	dm.setString(key, d, val, now+dur, false)
+	return nil
 }
 
 // Get gets string from dm by key.
@@ -39,8 +75,8 @@ func (dm *DataMap) Set(key, val string) error {
 // contains another type.
 func (dm *DataMap) Get(key string) (string, error) {
 	dm.mu.RLock()
-	val, ok := dm.hash[key]
-	dm.mu.RUnlock()
+	defer dm.mu.RUnlock()
+	val, ok := dm.lookup(key)
 	if !ok {
 		return "", keyNotExistErr
 	}
@@ -52,19 +88,28 @@ func (dm *DataMap) Get(key string) (string, error) {
 func (dm *DataMap) LSet(key string, val []string) error {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
-	if _, ok := dm.hash[key]; !ok {
-		dm.hash[key] = new(data)
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		d = dm.create(key)
+	}
+	if err := d.LSet(val); err != nil {
+		return err
+	}
+	dm.resize(key, d)
+	dm.modified(d)
+	if len(val) > 0 {
+		dm.signalReady(key)
 	}
-	return dm.hash[key].LSet(val)
+	return nil
 }
 
-// LGet gets slice from dm by key.
+// LGet gets a copy of slice from dm by key.
 // Returns error if key not exists or
 // contains another type.
 func (dm *DataMap) LGet(key string) ([]string, error) {
 	dm.mu.RLock()
-	val, ok := dm.hash[key]
-	dm.mu.RUnlock()
+	defer dm.mu.RUnlock()
+	val, ok := dm.lookup(key)
 	if !ok {
 		return nil, keyNotExistErr
 	}
@@ -76,14 +121,20 @@ func (dm *DataMap) LGet(key string) ([]string, error) {
 // Returns error if key or index is invalid
 // and if key contains another type
 func (dm *DataMap) LGetIt(key string, index int) (string, error) {
-	s, err := dm.LGet(key)
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	val, ok := dm.lookup(key)
+	if !ok {
+		return "", keyNotExistErr
+	}
+	l, err := val.ListGet()
 	if err != nil {
 		return "", err
 	}
-	if index < 0 || index >= len(s) {
+	if index < 0 || index >= l.len() {
 		return "", invalidIndexErr
 	}
-	return s[index], nil
+	return l.at(index), nil
 
 }
 
@@ -92,14 +143,24 @@ func (dm *DataMap) LGetIt(key string, index int) (string, error) {
 // Returns error if key or index is invalid
 // and if key contains another type.
 func (dm *DataMap) LUpdate(key string, index int, value string) error {
-	s, err := dm.LGet(key)
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		return keyNotExistErr
+	}
+	l, err := d.ListGet()
 	if err != nil {
 		return err
 	}
-	if index < 0 || index >= len(s) {
+	if index < 0 || index >= l.len() {
 		return invalidIndexErr
 	}
-	s[index] = value
+	dm.unshare(d)
+	l = d.value.(*list)
+	dm.grow(d, int64(len(value)-len(l.at(index))))
+	l.set(index, value)
+	dm.modified(d)
 	return nil
 }
 
@@ -109,23 +170,37 @@ func (dm *DataMap) LUpdate(key string, index int, value string) error {
 func (dm *DataMap) HSet(key string, val map[string]string) error {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
-	if _, ok := dm.hash[key]; !ok {
-		dm.hash[key] = new(data)
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		d = dm.create(key)
+	}
+	if err := d.HSet(val); err != nil {
+		return err
 	}
-	return dm.hash[key].HSet(val)
+	dm.resize(key, d)
+	dm.modified(d)
+	return nil
 }
 
-// HGet gets map from dm by key.
+// HGet gets a copy of map from dm by key.
 // Returns error if key not exists or
 // contains another type.
 func (dm *DataMap) HGet(key string) (map[string]string, error) {
 	dm.mu.RLock()
-	val, ok := dm.hash[key]
-	dm.mu.RUnlock()
+	defer dm.mu.RUnlock()
+	val, ok := dm.lookup(key)
 	if !ok {
 		return nil, keyNotExistErr
 	}
-	return val.HGet()
+	dict, err := val.HGet()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(dict))
+	for k, v := range dict {
+		res[k] = v
+	}
+	return res, nil
 }
 
 // HGetVal gets map from dm by outerKey and then
@@ -134,7 +209,13 @@ func (dm *DataMap) HGet(key string) (map[string]string, error) {
 // outerKey contains another type or
 // innerKey not exists.
 func (dm *DataMap) HGetVal(outerKey, innerKey string) (string, error) {
-	dict, err := dm.HGet(outerKey)
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	d, ok := dm.lookup(outerKey)
+	if !ok {
+		return "", keyNotExistErr
+	}
+	dict, err := d.HGet()
 	if err != nil {
 		return "", err
 	}
@@ -149,11 +230,16 @@ func (dm *DataMap) HGetVal(outerKey, innerKey string) (string, error) {
 // updates inKey value. Returns error if outKey
 // not exists.
 func (dm *DataMap) HUpdate(outKey, inKey, value string) error {
-	dict, err := dm.HGet(outKey)
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, dict, err := dm.writeHash(outKey, false)
 	if err != nil {
 		return err
 	}
-	dict[inKey] = value
+	if dict == nil {
+		return keyNotExistErr
+	}
+	dm.setField(d, dict, inKey, value)
 	return nil
 }
 
@@ -162,8 +248,26 @@ func (dm *DataMap) Keys() []string {
 	var keys []string
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
-	for key := range dm.hash {
-		keys = append(keys, key)
+	now := nowMs()
+	for key, d := range dm.hash {
+		if !d.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// KeysMatch gets all keys from dm which
+// match glob pattern.
+func (dm *DataMap) KeysMatch(pattern string) []string {
+	var keys []string
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	now := nowMs()
+	for key, d := range dm.hash {
+		if !d.expired(now) && globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
 	}
 	return keys
 }
@@ -172,40 +276,69 @@ func (dm *DataMap) Keys() []string {
 func (dm *DataMap) Remove(key string) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
-	delete(dm.hash, key)
+	dm.delete(key)
+}
+
+// clear removes all keys from dm. It must be
+// called with dm.mu held for writing.
+func (dm *DataMap) clear() {
+	for key := range dm.hash {
+		dm.delete(key)
+	}
+	dm.expires = nil
 }
 
 // Expire sets ttl for key in dm as sum of
-// current unix time + dur. Returns error
+// current unix time + dur seconds. Returns error
 // if key not exists.
 func (dm *DataMap) Expire(key string, dur int64) error {
-	if dur <= 0 {
-		return fmt.Errorf("ERROR: wrong duration for ttl")
+	if dur <= 0 || dur > math.MaxInt64/1000 {
+		return wrongDurationErr
 	}
-	ttl := time.Now().UTC().Unix() + dur
-	dm.mu.Lock()
-	defer dm.mu.Unlock()
-	data, ok := dm.hash[key]
-	if !ok {
-		return keyNotExistErr
-	}
-	data.SetTTL(ttl)
-	return nil
+	return dm.PExpire(key, dur*1000)
 }
 
-// Expireat sets ttl for key in dm.
+// PExpire sets ttl for key in dm as sum of
+// current unix time + dur milliseconds.
 // Returns error if key not exists.
+func (dm *DataMap) PExpire(key string, dur int64) error {
+	now := nowMs()
+	if dur <= 0 || dur > math.MaxInt64-now {
+		return wrongDurationErr
+	}
+	return dm.setDeadline(key, now+dur)
+}
+
+// Expireat sets ttl for key in dm as unix
+// time in seconds. Returns error if key not exists.
 func (dm *DataMap) Expireat(key string, ttl int64) error {
-	if ttl <= time.Now().UTC().Unix() {
-		return fmt.Errorf("ERROR: ttl must be greater than now")
+	if ttl > math.MaxInt64/1000 {
+		return wrongDurationErr
 	}
+	if ttl < math.MinInt64/1000 {
+		return pastTTLErr
+	}
+	return dm.PExpireat(key, ttl*1000)
+}
+
+// PExpireat sets ttl for key in dm as unix time
+// in milliseconds. Returns error if key not exists.
+func (dm *DataMap) PExpireat(key string, ttl int64) error {
+	if ttl <= nowMs() {
+		return pastTTLErr
+	}
+	return dm.setDeadline(key, ttl)
+}
+
+// setDeadline sets ttl in milliseconds for key in dm.
+func (dm *DataMap) setDeadline(key string, ttl int64) error {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
-	data, ok := dm.hash[key]
+	data, ok := dm.lookupWrite(key)
 	if !ok {
 		return keyNotExistErr
 	}
-	data.SetTTL(ttl)
+	dm.setTTL(key, data, ttl)
 	return nil
 }
 
@@ -214,27 +347,70 @@ func (dm *DataMap) Expireat(key string, ttl int64) error {
 func (dm *DataMap) Persist(key string) error {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
-	data, ok := dm.hash[key]
+	data, ok := dm.lookupWrite(key)
 	if !ok {
 		return keyNotExistErr
 	}
-	data.SetTTL(0)
+	dm.setTTL(key, data, 0)
 	return nil
 
 }
 
-// TTL gets ttl from dm by key.
-// Returns error if key not exists.
-func (dm *DataMap) TTL(key string) (string, error) {
+// TTL gets remaining time to live of key in seconds.
+// It is -1 if key has no ttl. Returns error if key not exists.
+func (dm *DataMap) TTL(key string) (int64, error) {
+	ttl, err := dm.PTTL(key)
+	if err != nil || ttl < 0 {
+		return ttl, err
+	}
+	return (ttl + 500) / 1000, nil
+}
+
+// PTTL gets remaining time to live of key in milliseconds.
+// It is -1 if key has no ttl. Returns error if key not exists.
+func (dm *DataMap) PTTL(key string) (int64, error) {
+	ttl, err := dm.PExpireTime(key)
+	if err != nil || ttl < 0 {
+		return ttl, err
+	}
+	if ttl -= nowMs(); ttl < 0 {
+		ttl = 0
+	}
+	return ttl, nil
+}
+
+// ExpireTime gets unix time in seconds when key expires.
+// It is -1 if key has no ttl. Returns error if key not exists.
+func (dm *DataMap) ExpireTime(key string) (int64, error) {
+	ttl, err := dm.PExpireTime(key)
+	if err != nil || ttl < 0 {
+		return ttl, err
+	}
+	return ttl / 1000, nil
+}
+
+// PExpireTime gets unix time in milliseconds when key expires.
+// It is -1 if key has no ttl. Returns error if key not exists.
+func (dm *DataMap) PExpireTime(key string) (int64, error) {
 	dm.mu.RLock()
-	data, ok := dm.hash[key]
-	dm.mu.RUnlock()
+	defer dm.mu.RUnlock()
+	data, ok := dm.lookup(key)
 	if !ok {
-		return "", keyNotExistErr
+		return 0, keyNotExistErr
 	}
-	ttl := data.TTL()
-	if ttl > 0 {
-		return fmt.Sprintf("%d", ttl), nil
+	if ttl := data.TTL(); ttl > 0 {
+		return ttl, nil
+	}
+	return -1, nil
+}
+
+// deadline gets ttl of key in dm in milliseconds.
+// It returns 0 if key not exists or has no ttl.
+func (dm *DataMap) deadline(key string) int64 {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	if d, ok := dm.lookup(key); ok {
+		return d.TTL()
 	}
-	return "-1", nil
+	return 0
 }
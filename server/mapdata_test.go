@@ -2,8 +2,8 @@ package server
 
 import (
 	"fmt"
+	"math"
 	"sort"
-	"strconv"
 	"testing"
 	"time"
 )
@@ -48,7 +48,7 @@ func TestMapGet(t *testing.T) {
 	}
 
 	listKey := "list"
-	dm.hash[listKey] = &data{value: []string{"hello", "world"}}
+	dm.hash[listKey] = &data{value: newList([]string{"hello", "world"})}
 	got, err = dm.Get(listKey)
 	if err != typeMismatchErr {
 		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
@@ -82,7 +82,7 @@ func TestMapLGet(t *testing.T) {
 	key := "test"
 	have := []string{"hello", "world"}
 	dm.Init()
-	dm.hash[key] = &data{value: have}
+	dm.hash[key] = &data{value: newList(have)}
 	got, err := dm.LGet(key)
 	if err != nil {
 		t.Fatalf("LGet(%s) error: %v", key, err)
@@ -101,7 +101,7 @@ func TestMapLGetIt(t *testing.T) {
 	var dm DataMap
 	dm.Init()
 	key := "test"
-	dm.hash[key] = &data{value: []string{"one", "two"}}
+	dm.hash[key] = &data{value: newList([]string{"one", "two"})}
 	if _, err := dm.LGetIt("i'm groot", 1); err != keyNotExistErr {
 		t.Fatalf("got '%v', want '%v' error for non existing key", err, keyNotExistErr)
 	}
@@ -122,7 +122,7 @@ func TestMapLUpate(t *testing.T) {
 	dm.Init()
 	key := "test"
 	want := []string{"ten", "two"}
-	dm.hash[key] = &data{value: []string{"one", "two"}}
+	dm.hash[key] = &data{value: newList([]string{"one", "two"})}
 	if err := dm.LUpdate("i'm groot", 0, "ten"); err != keyNotExistErr {
 		t.Fatalf("got '%v', want '%v' error for non existing key", err, keyNotExistErr)
 	}
@@ -216,7 +216,9 @@ func TestMapHSet(t *testing.T) {
 
 func TestMapKeys(t *testing.T) {
 	var dm DataMap
-	dm.hash = map[string]*data{"one": &data{}, "two": &data{}}
+	dm.Init()
+	dm.Set("one", "1")
+	dm.Set("two", "2")
 	want := []string{"one", "two"}
 	sort.Strings(want)
 	got := dm.Keys()
@@ -228,7 +230,9 @@ func TestMapKeys(t *testing.T) {
 
 func TestMapRemove(t *testing.T) {
 	var dm DataMap
-	dm.hash = map[string]*data{"one": &data{}, "two": &data{}}
+	dm.Init()
+	dm.Set("one", "1")
+	dm.Set("two", "2")
 	dm.Remove("one")
 	if _, err := dm.Get("one"); err != keyNotExistErr {
 		t.Fatalf("got '%v', expected '%v' error", err, keyNotExistErr)
@@ -248,6 +252,9 @@ func TestMapExpire(t *testing.T) {
 	if err := dm.Expire(key, 0); err == nil {
 		t.Error("ttl duration must be positive")
 	}
+	if err := dm.Expire(key, math.MaxInt64/1000+1); err != wrongDurationErr {
+		t.Fatalf("got '%v', want '%v' error", err, wrongDurationErr)
+	}
 	if err := dm.Expire("i'm groot", 10); err != keyNotExistErr {
 		t.Fatalf("got '%v', want '%v' error", err, keyNotExistErr)
 	}
@@ -264,6 +271,12 @@ func TestMapExpireat(t *testing.T) {
 	if err := dm.Expireat(key, time.Now().UTC().Unix()); err == nil {
 		t.Error("ttl should be in the future")
 	}
+	if err := dm.Expireat(key, math.MaxInt64/1000+1); err != wrongDurationErr {
+		t.Fatalf("got '%v', want '%v' error", err, wrongDurationErr)
+	}
+	if err := dm.Expireat(key, math.MinInt64/1000-1); err != pastTTLErr {
+		t.Fatalf("got '%v', want '%v' error", err, pastTTLErr)
+	}
 	if err := dm.Expireat("i'm groot", time.Now().UTC().Unix()+10); err != keyNotExistErr {
 		t.Fatalf("got '%v', want '%v' error", err, keyNotExistErr)
 	}
@@ -285,17 +298,76 @@ func TestMapTTL(t *testing.T) {
 	if err != nil {
 		t.Fatalf("got '%v' error, expected 'nil' error", err)
 	}
-	if ttl != "-1" {
-		t.Fatalf("got '%s' ttl, expected '-1' ttl with no expire", ttl)
+	if ttl != -1 {
+		t.Fatalf("got '%d' ttl, expected '-1' ttl with no expire", ttl)
 	}
-	want := int64(100)
-	dm.hash[key] = &data{ttl: want}
+	dm.hash[key] = &data{ttl: time.Now().UnixMilli() + 100400}
 	ttl, err = dm.TTL(key)
 	if err != nil {
 		t.Fatalf("got '%v' error, expected 'nil' error", err)
 	}
-	sWant := strconv.Itoa(int(want))
-	if ttl != sWant {
-		t.Fatalf("got '%s' ttl, expected '%s' ttl", ttl, sWant)
+	if ttl != 100 {
+		t.Fatalf("got '%d' ttl, expected '100' seconds ttl", ttl)
+	}
+}
+
+func TestMapPTTL(t *testing.T) {
+	key := "test"
+	var dm DataMap
+	dm.Init()
+	dm.hash[key] = &data{}
+	if err := dm.PExpire(key, 0); err != wrongDurationErr {
+		t.Fatalf("got '%v', want '%v' error", err, wrongDurationErr)
+	}
+	if err := dm.PExpire(key, math.MaxInt64); err != wrongDurationErr {
+		t.Fatalf("got '%v', want '%v' error", err, wrongDurationErr)
+	}
+	if ttl, _ := dm.PTTL(key); ttl != -1 {
+		t.Fatalf("got '%d' ttl after invalid duration, expected '-1'", ttl)
+	}
+	if err := dm.PExpire(key, 1500); err != nil {
+		t.Fatalf("got '%v', expected 'nil' error", err)
+	}
+	ttl, err := dm.PTTL(key)
+	if err != nil {
+		t.Fatalf("got '%v' error, expected 'nil' error", err)
+	}
+	if ttl <= 1000 || ttl > 1500 {
+		t.Fatalf("got '%d' ttl, expected ttl about 1500 milliseconds", ttl)
+	}
+	at := time.Now().UnixMilli() + 10000
+	if err := dm.PExpireat(key, at); err != nil {
+		t.Fatalf("got '%v', expected 'nil' error", err)
+	}
+	if got, _ := dm.PExpireTime(key); got != at {
+		t.Fatalf("got '%d' expire time, expected '%d'", got, at)
+	}
+	if got, _ := dm.ExpireTime(key); got != at/1000 {
+		t.Fatalf("got '%d' expire time, expected '%d'", got, at/1000)
+	}
+	if err := dm.PExpireat(key, time.Now().UnixMilli()); err != pastTTLErr {
+		t.Fatalf("got '%v', want '%v' error", err, pastTTLErr)
+	}
+}
+
+func TestMapPSetEx(t *testing.T) {
+	key := "test"
+	var dm DataMap
+	dm.Init()
+	if err := dm.PSetEx(key, 100, "value"); err != nil {
+		t.Fatalf("got '%v', expected 'nil' error", err)
+	}
+	if got, _ := dm.Get(key); got != "value" {
+		t.Fatalf("got %q, want 'value'", got)
+	}
+	if ttl, _ := dm.PTTL(key); ttl <= 0 || ttl > 100 {
+		t.Fatalf("got '%d' ttl, expected ttl about 100 milliseconds", ttl)
+	}
+	if err := dm.PSetEx(key, math.MaxInt64, "value"); err != wrongDurationErr {
+		t.Fatalf("got '%v', want '%v' error", err, wrongDurationErr)
+	}
+	dm.hash[key] = &data{value: newList([]string{"hello"})}
+	if err := dm.PSetEx(key, 100, "value"); err != typeMismatchErr {
+		t.Fatalf("got '%v', want '%v' error", err, typeMismatchErr)
 	}
 }
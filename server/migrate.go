@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMigrateTimeout = time.Second
+
+var migrateIOErr = errors.New("IOERR error or timeout connecting to the target instance")
+
+// migrate handles MIGRATE host port key|"" destination-db
+// timeout [COPY] [REPLACE] [KEYS key [key ...]] command.
+// Keys are recreated on the target instance, replacing
+// existing ones, and removed unless COPY is given or they
+// have been changed during migration.
+func (cl *client) migrate(args []string) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, fewArgsErr
+	}
+	addr, db := net.JoinHostPort(args[0], args[1]), args[3]
+	keys := []string{args[2]}
+	timeout, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return nil, wrongArgErr
+	}
+	deadline := defaultMigrateTimeout
+	if timeout > 0 {
+		deadline = time.Duration(timeout) * time.Millisecond
+	}
+	keep := false
+	for i := 5; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "copy":
+			keep = true
+		case "replace":
+			// keys are always replaced
+		case "keys":
+			if args[2] != "" {
+				return nil, syntaxErr
+			}
+			keys, i = args[i+1:], len(args)
+		default:
+			return nil, syntaxErr
+		}
+	}
+	if len(keys) == 0 || keys[0] == "" {
+		return nil, syntaxErr
+	}
+	entries, release := cl.db.snapshotKeys(keys)
+	defer release()
+	if len(entries) == 0 {
+		return statusReply("NOKEY"), nil
+	}
+
+	cmds := [][]string{{"select", db}}
+	for _, e := range entries {
+		cmds = append(cmds, []string{"remove", e.key})
+		if args := restoreCommand(e); args != nil {
+			cmds = append(cmds, args)
+			if e.ttl > 0 {
+				cmds = append(cmds, []string{"pexpireat", e.key, strconv.FormatInt(e.ttl, 10)})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	for i, args := range cmds {
+		if cl.srv.cluster != nil && i > 0 {
+			// the slot may not be served by the target yet
+			writeCommand(&buf, []string{"asking"})
+		}
+		writeCommand(&buf, args)
+	}
+	conn, err := net.DialTimeout("tcp", addr, deadline)
+	if err != nil {
+		return nil, migrateIOErr
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(deadline))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, migrateIOErr
+	}
+	r := bufio.NewReader(conn)
+	replies := len(cmds)
+	if cl.srv.cluster != nil {
+		replies += len(cmds) - 1
+	}
+	for i := 0; i < replies; i++ {
+		reply, err := readReply(r)
+		if err != nil {
+			return nil, migrateIOErr
+		}
+		if e, ok := reply.(error); ok {
+			return nil, fmt.Errorf("ERROR: Target instance replied with error: %v", e)
+		}
+	}
+	if !keep {
+		if err := cl.removeMigrated(entries); err != nil {
+			return nil, err
+		}
+	}
+	return okReply, nil
+}
+
+// removeMigrated removes keys of entries from the database of
+// cl. Keys changed since they have been copied are kept, so
+// writes made during migration aren't lost.
+func (cl *client) removeMigrated(entries []snapshotEntry) error {
+	dm := cl.db
+	if !cl.execDbs[dm] {
+		// no command can change a key between
+		// checking its version and removing it
+		dm.execMu.Lock()
+		defer dm.execMu.Unlock()
+	}
+	for _, e := range entries {
+		if dm.keyVersion(e.key) != e.version {
+			continue
+		}
+		if _, err := executeLocked(dm, "remove", []string{e.key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+// Transactions queue commands after MULTI and run them on
+// EXEC. Every command takes execMu of its database for
+// reading, while EXEC holds it for writing for all databases
+// the transaction uses, so no other command sees a half
+// applied transaction. WATCH remembers versions of keys and
+// EXEC is aborted if any of them has been changed.
+
+var nestedMultiErr = errors.New("ERROR: MULTI calls can not be nested")
+var execWithoutMultiErr = errors.New("ERROR: EXEC without MULTI")
+var discardWithoutMultiErr = errors.New("ERROR: DISCARD without MULTI")
+var watchInMultiErr = errors.New("ERROR: WATCH inside MULTI is not allowed")
+
+const queuedReply statusReply = "QUEUED"
+
+// lastVersion is the last version given to changed data.
+// Versions are unique across databases, so keys moved
+// by SWAPDB can't be taken for unchanged.
+var lastVersion uint64
+
+// watchedKey is a key watched by a client.
+type watchedKey struct {
+	db      *DataMap
+	key     string
+	version uint64
+}
+
+// modified gives d a new version, so transactions watching
+// it are aborted. It must be called with dm.mu held for writing.
+func (dm *DataMap) modified(d *data) {
+	d.version = atomic.AddUint64(&lastVersion, 1)
+}
+
+// keyVersion returns version of key in dm
+// or zero if key doesn't exist.
+func (dm *DataMap) keyVersion(key string) uint64 {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	d, ok := dm.hash[key]
+	if !ok || d.expired(nowMs()) {
+		return 0
+	}
+	return d.version
+}
+
+// transactionCommands are commands which control transactions.
+var transactionCommands = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+	"unwatch": true,
+}
+
+// transaction handles transaction commands
+// and queues other commands after MULTI.
+func (cl *client) transaction(cmd string, args []string) (interface{}, error) {
+	switch cmd {
+	case "multi":
+		if cl.multi {
+			return nil, nestedMultiErr
+		}
+		if len(args) != 0 {
+			return nil, manyArgsErr
+		}
+		cl.multi = true
+		return okReply, nil
+	case "exec":
+		if !cl.multi {
+			return nil, execWithoutMultiErr
+		}
+		return cl.exec()
+	case "discard":
+		if !cl.multi {
+			return nil, discardWithoutMultiErr
+		}
+		cl.discard()
+		return okReply, nil
+	case "watch":
+		if cl.multi {
+			return nil, watchInMultiErr
+		}
+		return cl.watch(args)
+	case "unwatch":
+		if !cl.multi {
+			cl.watched = nil
+			return okReply, nil
+		}
+	}
+	cl.queued = append(cl.queued, append([]string{cmd}, args...))
+	return queuedReply, nil
+}
+
+// watch handles WATCH key [key ...] command.
+func (cl *client) watch(keys []string) (interface{}, error) {
+	if len(keys) == 0 {
+		return nil, fewArgsErr
+	}
+	for _, key := range keys {
+		cl.watched = append(cl.watched, watchedKey{cl.db, key, cl.db.keyVersion(key)})
+	}
+	return okReply, nil
+}
+
+// discard drops queued commands and watched keys of cl.
+func (cl *client) discard() {
+	cl.multi = false
+	cl.queued = nil
+	cl.watched = nil
+}
+
+// exec runs queued commands of cl atomically. It
+// returns nil if a watched key has been changed.
+func (cl *client) exec() (interface{}, error) {
+	queued, watched := cl.queued, cl.watched
+	cl.discard()
+	dbs := cl.transactionDbs(queued)
+	for _, dm := range dbs {
+		dm.execMu.Lock()
+	}
+	defer func() {
+		for _, dm := range dbs {
+			// blocked clients see the whole transaction
+			dm.serveBlocked()
+			dm.execMu.Unlock()
+		}
+		cl.execDbs = nil
+	}()
+	for _, w := range watched {
+		if w.db.keyVersion(w.key) != w.version {
+			return nil, nil
+		}
+	}
+	cl.execDbs = make(map[*DataMap]bool, len(dbs))
+	for _, dm := range dbs {
+		cl.execDbs[dm] = true
+	}
+	res := make([]interface{}, len(queued))
+	for i, args := range queued {
+		r, err := cl.call(args[0], args[1:])
+		if err != nil {
+			res[i] = err
+		} else {
+			res[i] = r
+		}
+	}
+	return res, nil
+}
+
+// transactionDbs returns databases used by queued
+// commands sorted by id, so they are always
+// locked in the same order.
+func (cl *client) transactionDbs(queued [][]string) []*DataMap {
+	used := map[*DataMap]bool{cl.db: true}
+	for _, args := range queued {
+		if args[0] == "select" && len(args) == 2 {
+			if dm, err := cl.srv.db(args[1]); err == nil {
+				used[dm] = true
+			}
+		}
+		for _, dm := range cl.srv.targetDbs(args[0], args[1:]) {
+			used[dm] = true
+		}
+	}
+	dbs := make([]*DataMap, 0, len(used))
+	for dm := range used {
+		dbs = append(dbs, dm)
+	}
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].DbId < dbs[j].DbId })
+	return dbs
+}
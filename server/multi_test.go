@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestKeyVersion(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if v := dm.keyVersion("key"); v != 0 {
+		t.Fatalf("got %d version of missing key, want 0", v)
+	}
+	dm.Set("key", "value")
+	v := dm.keyVersion("key")
+	if v == 0 {
+		t.Fatal("existing key should have non zero version")
+	}
+	dm.Get("key")
+	if got := dm.keyVersion("key"); got != v {
+		t.Fatalf("got %d version after reading, want %d", got, v)
+	}
+	dm.Expire("key", 10)
+	if got := dm.keyVersion("key"); got == v {
+		t.Fatal("version should be changed by EXPIRE")
+	}
+	dm.Remove("key")
+	if got := dm.keyVersion("key"); got != 0 {
+		t.Fatalf("got %d version of removed key, want 0", got)
+	}
+}
+
+func TestMultiExec(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("exec"))
+	expectLines(t, r, "-ERR EXEC without MULTI")
+	fmt.Fprint(cli, respCommand("multi"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("multi"))
+	expectLines(t, r, "-ERR MULTI calls can not be nested")
+	fmt.Fprint(cli, respCommand("set", "multi-key", "value"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("lgetit", "multi-key", "0"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("get", "multi-key"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("exec"))
+	expectLines(t, r, "*3", "+OK", "-ERR types mismatch", "$5", "value")
+
+	fmt.Fprint(cli, respCommand("multi"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("set", "multi-key", "other"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("discard"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("get", "multi-key"))
+	expectLines(t, r, "$5", "value")
+}
+
+func TestMultiSelect(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("multi"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("select", "5"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("set", "key", "value"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("exec"))
+	expectLines(t, r, "*2", "+OK", "+OK")
+	if val, err := s.getDb("5").Get("key"); err != nil || val != "value" {
+		t.Fatalf("got %q, %v, want key to be set in the selected database", val, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	dm := s.getDb(defaultDbIndex)
+	dm.Set("watched", "1")
+
+	fmt.Fprint(cli, respCommand("watch", "watched"))
+	expectLines(t, r, "+OK")
+	dm.Set("watched", "2")
+	fmt.Fprint(cli, respCommand("multi"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("set", "watched", "3"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("exec"))
+	expectLines(t, r, "$-1")
+	if val, _ := dm.Get("watched"); val != "2" {
+		t.Fatalf("got %q, aborted transaction should not change data", val)
+	}
+
+	fmt.Fprint(cli, respCommand("watch", "watched"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("multi"))
+	expectLines(t, r, "+OK")
+	fmt.Fprint(cli, respCommand("watch", "watched"))
+	expectLines(t, r, "-ERR WATCH inside MULTI is not allowed")
+	fmt.Fprint(cli, respCommand("set", "watched", "3"))
+	expectLines(t, r, "+QUEUED")
+	fmt.Fprint(cli, respCommand("exec"))
+	expectLines(t, r, "*1", "+OK")
+	if val, _ := dm.Get("watched"); val != "3" {
+		t.Fatalf("got %q, want '3'", val)
+	}
+}
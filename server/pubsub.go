@@ -0,0 +1,272 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pubsubBufferSize limits number of messages waiting to be
+// written to a subscriber. Subscribers which can't keep up
+// are disconnected, so they never stall publishers.
+const pubsubBufferSize = 1024
+
+// subscribeModeCommands are commands allowed for
+// subscribed RESP2 and telnet like clients.
+var subscribeModeCommands = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+}
+
+// pubsubState holds subscribers of channels and patterns.
+type pubsubState struct {
+	mu       sync.RWMutex
+	channels map[string]map[*client]struct{}
+	patterns map[string]map[*client]struct{}
+}
+
+func newPubsubState() *pubsubState {
+	return &pubsubState{
+		channels: make(map[string]map[*client]struct{}),
+		patterns: make(map[string]map[*client]struct{}),
+	}
+}
+
+// subscribed reports whether cl is subscribed to
+// any channel or pattern.
+func (cl *client) subscribed() bool {
+	ps := cl.srv.pubsub
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(cl.channels)+len(cl.patterns) > 0
+}
+
+// subscriptions returns number of channels and
+// patterns of cl. It must be called with
+// cl.srv.pubsub.mu held.
+func (cl *client) subscriptions() int64 {
+	return int64(len(cl.channels) + len(cl.patterns))
+}
+
+// startPushes starts writing pushed messages to cl.
+func (cl *client) startPushes() {
+	cl.pushOnce.Do(func() {
+		cl.pushes = make(chan pushReply, pubsubBufferSize)
+		go cl.pushLoop(cl.pushes)
+	})
+}
+
+// pushLoop writes messages from pushes to cl
+// until the channel is closed.
+func (cl *client) pushLoop(pushes chan pushReply) {
+	for msg := range pushes {
+		cl.wmu.Lock()
+		if cl.proto == telnetProto {
+			fmt.Fprintf(cl.w, "%s\n", formatReply(msg))
+		} else {
+			writeRESP(cl.w, msg, cl.proto)
+		}
+		if len(pushes) == 0 {
+			cl.w.Flush()
+		}
+		cl.wmu.Unlock()
+	}
+}
+
+// push sends msg to cl without blocking. A client with
+// full buffer is disconnected. It must be called
+// with cl.srv.pubsub.mu held.
+func (cl *client) push(msg pushReply) bool {
+	select {
+	case cl.pushes <- msg:
+		return true
+	default:
+		log.Printf("client %d is disconnected: output buffer is full\n", cl.id)
+		cl.closeOnce.Do(func() {
+			cl.conn.Close()
+		})
+		return false
+	}
+}
+
+// subscribe handles SUBSCRIBE channel [channel ...] command.
+func (cl *client) subscribe(args []string) (interface{}, error) {
+	return cl.addSubscriptions("subscribe", args, cl.srv.pubsub.channels, &cl.channels)
+}
+
+// psubscribe handles PSUBSCRIBE pattern [pattern ...] command.
+func (cl *client) psubscribe(args []string) (interface{}, error) {
+	return cl.addSubscriptions("psubscribe", args, cl.srv.pubsub.patterns, &cl.patterns)
+}
+
+// addSubscriptions subscribes cl to names. registry holds
+// subscribers of all names, own holds names of cl.
+func (cl *client) addSubscriptions(kind string, names []string, registry map[string]map[*client]struct{},
+	own *map[string]struct{}) (interface{}, error) {
+	if len(names) == 0 {
+		return nil, fewArgsErr
+	}
+	cl.startPushes()
+	ps := cl.srv.pubsub
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if *own == nil {
+		*own = make(map[string]struct{})
+	}
+	res := make(multiReply, 0, len(names))
+	for _, name := range names {
+		if _, ok := (*own)[name]; !ok {
+			(*own)[name] = struct{}{}
+			if registry[name] == nil {
+				registry[name] = make(map[*client]struct{})
+			}
+			registry[name][cl] = struct{}{}
+		}
+		res = append(res, pushReply{kind, name, cl.subscriptions()})
+	}
+	return res, nil
+}
+
+// unsubscribe handles UNSUBSCRIBE [channel ...] command.
+func (cl *client) unsubscribe(args []string) interface{} {
+	return cl.removeSubscriptions("unsubscribe", args, cl.srv.pubsub.channels, cl.channels)
+}
+
+// punsubscribe handles PUNSUBSCRIBE [pattern ...] command.
+func (cl *client) punsubscribe(args []string) interface{} {
+	return cl.removeSubscriptions("punsubscribe", args, cl.srv.pubsub.patterns, cl.patterns)
+}
+
+// removeSubscriptions unsubscribes cl from names or
+// from everything in own if names are empty.
+func (cl *client) removeSubscriptions(kind string, names []string, registry map[string]map[*client]struct{},
+	own map[string]struct{}) interface{} {
+	ps := cl.srv.pubsub
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		return pushReply{kind, nil, cl.subscriptions()}
+	}
+	res := make(multiReply, 0, len(names))
+	for _, name := range names {
+		if _, ok := own[name]; ok {
+			delete(own, name)
+			delete(registry[name], cl)
+			if len(registry[name]) == 0 {
+				delete(registry, name)
+			}
+		}
+		res = append(res, pushReply{kind, name, cl.subscriptions()})
+	}
+	return res
+}
+
+// unsubscribeAll removes all subscriptions of cl
+// and stops writing pushed messages to it.
+func (cl *client) unsubscribeAll() {
+	ps := cl.srv.pubsub
+	ps.mu.Lock()
+	for name := range cl.channels {
+		delete(ps.channels[name], cl)
+		if len(ps.channels[name]) == 0 {
+			delete(ps.channels, name)
+		}
+	}
+	for name := range cl.patterns {
+		delete(ps.patterns[name], cl)
+		if len(ps.patterns[name]) == 0 {
+			delete(ps.patterns, name)
+		}
+	}
+	cl.channels, cl.patterns = nil, nil
+	ps.mu.Unlock()
+	cl.pushOnce.Do(func() {})
+	if cl.pushes != nil {
+		close(cl.pushes)
+	}
+}
+
+// publish sends message to subscribers of channel and
+// of matching patterns. It returns number of receivers.
+func (ps *pubsubState) publish(channel, message string) int64 {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	var n int64
+	for cl := range ps.channels[channel] {
+		if cl.push(pushReply{"message", channel, message}) {
+			n++
+		}
+	}
+	for pattern, clients := range ps.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for cl := range clients {
+			if cl.push(pushReply{"pmessage", pattern, channel, message}) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// publishCommand handles PUBLISH channel message command.
+func (s *Server) publishCommand(args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fewArgsErr
+	}
+	if len(args) > 2 {
+		return nil, manyArgsErr
+	}
+	return s.pubsub.publish(args[0], args[1]), nil
+}
+
+// pubsubCommand handles PUBSUB CHANNELS [pattern],
+// PUBSUB NUMSUB [channel ...] and PUBSUB NUMPAT commands.
+func (s *Server) pubsubCommand(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fewArgsErr
+	}
+	ps := s.pubsub
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	switch strings.ToLower(args[0]) {
+	case "channels":
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		res := []string{}
+		for name := range ps.channels {
+			if len(args) == 1 || globMatch(args[1], name) {
+				res = append(res, name)
+			}
+		}
+		sort.Strings(res)
+		return res, nil
+	case "numsub":
+		res := make(mapReply, 0, (len(args)-1)*2)
+		for _, name := range args[1:] {
+			res = append(res, name, int64(len(ps.channels[name])))
+		}
+		return res, nil
+	case "numpat":
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		return int64(len(ps.patterns)), nil
+	default:
+		return nil, unknownCmdErr
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respCommand encodes args as a RESP array.
+func respCommand(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// expectLines reads lines from r and compares them with want.
+func expectLines(t *testing.T, r *bufio.Reader, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		got, err := readLine(r)
+		if err != nil {
+			t.Fatalf("read reply error: %v", err)
+		}
+		if got != w {
+			t.Fatalf("got %q, want %q", got, w)
+		}
+	}
+}
+
+func TestSubscribePublish(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("subscribe", "sub-news"))
+	expectLines(t, r, "*3", "$9", "subscribe", "$8", "sub-news", ":1")
+	fmt.Fprint(cli, respCommand("psubscribe", "sub-*"))
+	expectLines(t, r, "*3", "$10", "psubscribe", "$5", "sub-*", ":2")
+
+	if n := s.pubsub.publish("sub-news", "hi"); n != 2 {
+		t.Fatalf("got %d receivers, want 2", n)
+	}
+	expectLines(t, r, "*3", "$7", "message", "$8", "sub-news", "$2", "hi")
+	expectLines(t, r, "*4", "$8", "pmessage", "$5", "sub-*", "$8", "sub-news", "$2", "hi")
+
+	fmt.Fprint(cli, respCommand("get", "key"))
+	got, _ := readLine(r)
+	if !strings.HasPrefix(got, "-ERR Can't execute 'get'") {
+		t.Fatalf("got %q, want error in subscribed mode", got)
+	}
+	fmt.Fprint(cli, respCommand("ping"))
+	expectLines(t, r, "*2", "$4", "pong", "$0", "")
+
+	fmt.Fprint(cli, respCommand("unsubscribe"))
+	expectLines(t, r, "*3", "$11", "unsubscribe", "$8", "sub-news", ":1")
+	fmt.Fprint(cli, respCommand("punsubscribe"))
+	expectLines(t, r, "*3", "$12", "punsubscribe", "$5", "sub-*", ":0")
+	fmt.Fprint(cli, respCommand("ping"))
+	expectLines(t, r, "+PONG")
+	if n := s.pubsub.publish("sub-news", "hi"); n != 0 {
+		t.Fatalf("got %d receivers after unsubscribe, want 0", n)
+	}
+}
+
+func TestSubscribeBeforeMessages(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for i := 0; i < 20; i++ {
+		srv, cli := net.Pipe()
+		go s.ServeConn(srv)
+		r := bufio.NewReader(cli)
+		channel := fmt.Sprintf("order-%02d", i)
+		go func() {
+			// the message is published as soon as
+			// the client is subscribed
+			for s.pubsub.publish(channel, "hi") == 0 {
+			}
+		}()
+		fmt.Fprint(cli, respCommand("subscribe", channel))
+		expectLines(t, r, "*3", "$9", "subscribe", "$8", channel, ":1")
+		expectLines(t, r, "*3", "$7", "message", "$8", channel, "$2", "hi")
+		cli.Close()
+	}
+}
+
+func TestPubsubCommand(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("subscribe", "numsub-a", "numsub-b"))
+	expectLines(t, r, "*3", "$9", "subscribe", "$8", "numsub-a", ":1")
+	expectLines(t, r, "*3", "$9", "subscribe", "$8", "numsub-b", ":2")
+
+	res, err := s.pubsubCommand([]string{"channels", "numsub-*"})
+	if err != nil {
+		t.Fatalf("PUBSUB CHANNELS error: %v", err)
+	}
+	if fmt.Sprint(res) != "[numsub-a numsub-b]" {
+		t.Fatalf("got %v channels, want [numsub-a numsub-b]", res)
+	}
+	res, _ = s.pubsubCommand([]string{"numsub", "numsub-a", "numsub-c"})
+	if fmt.Sprint(res) != "[numsub-a 1 numsub-c 0]" {
+		t.Fatalf("got %v, want [numsub-a 1 numsub-c 0]", res)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("subscribe", "slow"))
+	expectLines(t, r, "*3", "$9", "subscribe", "$4", "slow", ":1")
+
+	// the subscriber doesn't read anymore, so publishing
+	// must not block and it should be disconnected
+	done := make(chan int)
+	go func() {
+		for i := 0; ; i++ {
+			if s.pubsub.publish("slow", "message") == 0 {
+				done <- i
+				return
+			}
+		}
+	}()
+	select {
+	case n := <-done:
+		if n < pubsubBufferSize {
+			t.Fatalf("subscriber is disconnected after %d messages, want at least %d", n, pubsubBufferSize)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher is blocked by slow subscriber")
+	}
+}
@@ -0,0 +1,605 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replication works like in Redis. A replica connects to
+// its master and sends PSYNC with the replication id and
+// the offset it has processed. The master replies with
+//   - "+FULLRESYNC <id> <offset>" followed by a snapshot of
+//     all databases sent as a bulk string, or
+//   - "+CONTINUE <id>" if the replica may resume from
+//     the backlog after a short disconnect,
+//
+// and then streams every propagated command. The offset is
+// the number of bytes of the stream. Replicas acknowledge
+// the processed offset by "REPLCONF ACK <offset>" every second.
+const replicaOutputChunks = 1 << 14
+const replicaAckInterval = time.Second
+const replicaRetryInterval = time.Second
+const replicaDialTimeout = 5 * time.Second
+
+var readOnlyErr = errors.New("READONLY You can't write against a read only replica.")
+var badBacklogSizeErr = errors.New("ERROR: replication backlog size must be positive")
+
+// replication holds the replication stream of the server.
+type replication struct {
+	mu          sync.Mutex
+	id          string // replication id of the stream
+	offset      int64  // number of bytes of the stream
+	backlog     []byte // ring buffer with the tail of the stream
+	histLen     int64  // number of valid bytes in backlog
+	backlogSize int64
+	dbId        string // database selected in the stream
+	replicas    map[*replica]struct{}
+	master      *masterLink // not nil on replicas
+}
+
+func newReplication(backlogSize int64) *replication {
+	return &replication{
+		id:          newRandomId(),
+		backlogSize: backlogSize,
+		replicas:    make(map[*replica]struct{}),
+	}
+}
+
+// newRandomId returns a random id used
+// for replication ids and cluster nodes.
+func newRandomId() string {
+	buf := make([]byte, 20)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// feed sends cmds executed in dm to replicas and to the
+// backlog. It must be called with propagateMu held.
+func (r *replication) feed(dm *DataMap, cmds [][]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backlog == nil {
+		// nobody has ever asked for the stream
+		return
+	}
+	var buf bytes.Buffer
+	for _, args := range cmds {
+		if dm.DbId != r.dbId {
+			writeCommand(&buf, []string{"select", dm.DbId})
+			r.dbId = dm.DbId
+		}
+		writeCommand(&buf, args)
+	}
+	r.write(buf.Bytes())
+	for rp := range r.replicas {
+		select {
+		case rp.out <- buf.Bytes():
+		default:
+			log.Printf("replica %s is disconnected: output buffer is full\n", rp.addr)
+			r.disconnect(rp)
+		}
+	}
+}
+
+// write appends p to the backlog. It must be called with r.mu held.
+func (r *replication) write(p []byte) {
+	r.offset += int64(len(p))
+	size := int64(len(r.backlog))
+	if int64(len(p)) > size {
+		p = p[int64(len(p))-size:]
+	}
+	start := (r.offset - int64(len(p))) % size
+	n := copy(r.backlog[start:], p)
+	copy(r.backlog, p[n:])
+	if r.histLen += int64(len(p)); r.histLen > size {
+		r.histLen = size
+	}
+}
+
+// since returns the stream after offset if it is still in
+// the backlog. It must be called with r.mu held.
+func (r *replication) since(offset int64) ([]byte, bool) {
+	if r.backlog == nil || offset < r.offset-r.histLen || offset > r.offset {
+		return nil, false
+	}
+	size := int64(len(r.backlog))
+	n := r.offset - offset
+	start := offset % size
+	res := make([]byte, 0, n)
+	if start+n <= size {
+		return append(res, r.backlog[start:start+n]...), true
+	}
+	res = append(res, r.backlog[start:]...)
+	return append(res, r.backlog[:n-(size-start)]...), true
+}
+
+// disconnect stops streaming to rp and closes its
+// connection. It must be called with r.mu held.
+func (r *replication) disconnect(rp *replica) {
+	if _, ok := r.replicas[rp]; !ok {
+		return
+	}
+	delete(r.replicas, rp)
+	close(rp.out)
+	rp.cl.closeOnce.Do(func() {
+		rp.cl.conn.Close()
+	})
+}
+
+// reset starts a new stream, so replicas of the server
+// have to resynchronize fully. It is used when data
+// is replaced by a snapshot from the master.
+func (r *replication) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.id = newRandomId()
+	r.histLen = 0
+	r.dbId = ""
+	for rp := range r.replicas {
+		r.disconnect(rp)
+	}
+}
+
+// isReplica reports whether the server follows a master.
+func (r *replication) isReplica() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.master != nil
+}
+
+// role returns role of the server reported to clients.
+func (r *replication) role() string {
+	if r.isReplica() {
+		return "slave"
+	}
+	return "master"
+}
+
+// replica is a connection of a replica to this server.
+type replica struct {
+	cl   *client
+	addr string
+	out  chan []byte // the stream to send
+	ack  int64       // offset acknowledged by the replica
+}
+
+// replicationCommand handles PSYNC and REPLCONF commands
+// sent by replicas. They write replies on their own.
+func (cl *client) replicationCommand(cmd string, args []string) {
+	var err error
+	switch cmd {
+	case "psync":
+		err = cl.psync(args)
+	case "replconf":
+		if len(args) == 2 && strings.ToLower(args[0]) == "ack" {
+			// acknowledgements have no reply
+			if offset, err := strconv.ParseInt(args[1], 10, 64); err == nil && cl.replica != nil {
+				atomic.StoreInt64(&cl.replica.ack, offset)
+			}
+			return
+		}
+		if len(args)%2 != 0 {
+			err = syntaxErr
+		} else {
+			cl.reply(cmd, okReply, nil)
+		}
+	}
+	if err != nil {
+		cl.reply(cmd, nil, err)
+	}
+}
+
+// psync handles PSYNC replicationId offset command.
+// The connection of cl becomes a replication stream.
+func (cl *client) psync(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("ERROR: wrong number of arguments for 'psync' command")
+	}
+	if cl.replica != nil {
+		return errors.New("ERROR: replication is already started")
+	}
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	rp := &replica{
+		cl:   cl,
+		addr: cl.conn.RemoteAddr().String(),
+		out:  make(chan []byte, replicaOutputChunks),
+	}
+	// the snapshot and the offset must match, so
+	// no command may be propagated meanwhile
+	srv, repl := cl.srv, cl.srv.repl
+	srv.propagateMu.Lock()
+	repl.mu.Lock()
+	if repl.backlog == nil {
+		repl.backlog = make([]byte, repl.backlogSize)
+	}
+	var header string
+	var tail []byte
+	var dbs []dbSnapshot
+	ok := false
+	if args[0] == repl.id {
+		tail, ok = repl.since(offset)
+	}
+	if ok {
+		header = fmt.Sprintf("+CONTINUE %s\r\n", repl.id)
+		log.Printf("replica %s: partial resynchronization from offset %d\n", rp.addr, offset)
+	} else {
+		header = fmt.Sprintf("+FULLRESYNC %s %d\r\n", repl.id, repl.offset)
+		dbs = srv.takeSnapshot()
+		// the snapshot has no selected database
+		repl.dbId = ""
+		log.Printf("replica %s: full resynchronization\n", rp.addr)
+	}
+	atomic.StoreInt64(&rp.ack, offset)
+	repl.replicas[rp] = struct{}{}
+	repl.mu.Unlock()
+	srv.propagateMu.Unlock()
+	cl.replica = rp
+	go rp.run(header, tail, dbs)
+	return nil
+}
+
+// run writes the reply to PSYNC, the snapshot if dbs are
+// given and then the stream until rp is disconnected.
+func (rp *replica) run(header string, tail []byte, dbs []dbSnapshot) {
+	cl := rp.cl
+	if dbs != nil {
+		var buf bytes.Buffer
+		err := writeSnapshot(&buf, dbs)
+		for _, db := range dbs {
+			db.release()
+		}
+		if err != nil {
+			log.Printf("replica %s: snapshot error: %v\n", rp.addr, err)
+			cl.closeOnce.Do(func() {
+				cl.conn.Close()
+			})
+			return
+		}
+		header += fmt.Sprintf("$%d\r\n", buf.Len())
+		tail = buf.Bytes()
+	}
+	cl.wmu.Lock()
+	cl.w.WriteString(header)
+	cl.w.Write(tail)
+	cl.w.Flush()
+	cl.wmu.Unlock()
+	for p := range rp.out {
+		cl.wmu.Lock()
+		cl.w.Write(p)
+		if len(rp.out) == 0 {
+			cl.w.Flush()
+		}
+		cl.wmu.Unlock()
+	}
+}
+
+// dropReplica stops streaming to cl if it is a replica.
+func (cl *client) dropReplica() {
+	if cl.replica == nil {
+		return
+	}
+	repl := cl.srv.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	repl.disconnect(cl.replica)
+}
+
+// masterLink is a connection of this server to its master.
+type masterLink struct {
+	srv        *Server
+	host, port string
+	stop       chan struct{}
+	mu         sync.Mutex
+	conn       net.Conn
+	id         string   // replication id of the master
+	offset     int64    // processed offset of the master stream
+	up         int32    // 1 while the stream is being received
+	db         *DataMap // database selected by the stream
+}
+
+// ReplicaOf makes s a replica of master at host:port.
+// "NO ONE" makes s a master again.
+func (s *Server) ReplicaOf(host, port string) {
+	var ml *masterLink
+	if !strings.EqualFold(host, "no") || !strings.EqualFold(port, "one") {
+		ml = &masterLink{srv: s, host: host, port: port, stop: make(chan struct{}), db: s.getDb(defaultDbIndex)}
+	}
+	repl := s.repl
+	repl.mu.Lock()
+	old := repl.master
+	if old != nil && ml != nil && old.host == host && old.port == port {
+		// already following the master
+		repl.mu.Unlock()
+		return
+	}
+	repl.master = ml
+	repl.mu.Unlock()
+	if ml != nil {
+		// pops would change data of the master
+		s.unblockAll(unblockedErr)
+	}
+	if old != nil {
+		old.close()
+	}
+	if ml != nil {
+		go ml.run()
+	}
+}
+
+// replicaofCommand handles REPLICAOF host port command.
+func (s *Server) replicaofCommand(args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fewArgsErr
+	}
+	if len(args) > 2 {
+		return nil, manyArgsErr
+	}
+	if !strings.EqualFold(args[0], "no") || !strings.EqualFold(args[1], "one") {
+		if _, err := strconv.ParseUint(args[1], 10, 16); err != nil {
+			return nil, errors.New("ERROR: invalid master port")
+		}
+	}
+	s.ReplicaOf(args[0], args[1])
+	return okReply, nil
+}
+
+// close stops replication from the master.
+func (ml *masterLink) close() {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	close(ml.stop)
+	if ml.conn != nil {
+		ml.conn.Close()
+	}
+}
+
+// stopped reports whether ml has been closed.
+func (ml *masterLink) stopped() bool {
+	select {
+	case <-ml.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run connects to the master and receives the stream
+// until ml is closed. It reconnects after errors.
+func (ml *masterLink) run() {
+	for {
+		err := ml.sync()
+		if ml.stopped() {
+			return
+		}
+		log.Printf("replication from %s:%s is broken: %v\n", ml.host, ml.port, err)
+		select {
+		case <-ml.stop:
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// sync connects to the master, synchronizes data
+// and applies the stream until an error.
+func (ml *masterLink) sync() error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ml.host, ml.port), replicaDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ml.mu.Lock()
+	if ml.stopped() {
+		ml.mu.Unlock()
+		return nil
+	}
+	ml.conn = conn
+	ml.mu.Unlock()
+
+	id, offset := ml.id, atomic.LoadInt64(&ml.offset)
+	if id == "" {
+		id, offset = "?", -1
+	}
+	w := bufio.NewWriter(conn)
+	writeCommand(w, []string{"psync", id, strconv.FormatInt(offset, 10)})
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	cr := &countingReader{r: conn}
+	br := bufio.NewReader(cr)
+	line, err := readLine(br)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad reply to PSYNC: %q", line)
+		}
+		if err := ml.fullSync(br); err != nil {
+			return err
+		}
+		ml.id, ml.db = fields[1], ml.srv.getDb(defaultDbIndex)
+		atomic.StoreInt64(&ml.offset, offset)
+	case len(fields) == 2 && fields[0] == "+CONTINUE":
+		ml.id = fields[1]
+	default:
+		return fmt.Errorf("bad reply to PSYNC: %q", line)
+	}
+	log.Printf("replication from %s:%s is started\n", ml.host, ml.port)
+	atomic.StoreInt32(&ml.up, 1)
+	defer atomic.StoreInt32(&ml.up, 0)
+	done := make(chan struct{})
+	defer close(done)
+	go ml.ack(conn, done)
+
+	base, start := atomic.LoadInt64(&ml.offset), cr.n-int64(br.Buffered())
+	for {
+		args, err := readRESPCommand(br)
+		if err != nil {
+			return err
+		}
+		if len(args) > 0 {
+			if err := ml.apply(args); err != nil {
+				log.Printf("replication: command %q failed: %v\n", args, err)
+			}
+		}
+		atomic.StoreInt64(&ml.offset, base+cr.n-int64(br.Buffered())-start)
+	}
+}
+
+// fullSync reads the snapshot from the master
+// and replaces all data with it.
+func (ml *masterLink) fullSync(br *bufio.Reader) error {
+	n, err := readRESPLength(br, '$', maxBulkLen)
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return err
+	}
+	dbs, err := readSnapshot(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	s := ml.srv
+	for _, dm := range s.databases() {
+		dm.execMu.Lock()
+		dm.mu.Lock()
+		dm.clear()
+		dm.load(dbs[dm.DbId])
+		dm.mu.Unlock()
+		dm.execMu.Unlock()
+		delete(dbs, dm.DbId)
+	}
+	for id, keys := range dbs {
+		dm, err := s.db(id)
+		if err != nil {
+			return fmt.Errorf("ERROR: bad database %q in snapshot: %v", id, err)
+		}
+		dm.mu.Lock()
+		dm.load(keys)
+		dm.mu.Unlock()
+	}
+	s.repl.reset()
+	if s.aof != nil {
+		// the log doesn't contain the loaded data
+		s.propagateMu.Lock()
+		if err := s.aof.startRewrite(); err != nil {
+			log.Printf("append only file rewriting error: %v\n", err)
+		}
+		s.propagateMu.Unlock()
+	}
+	log.Printf("replication: %d bytes of snapshot loaded\n", n)
+	return nil
+}
+
+// apply executes a command from the master stream
+// and propagates it to this server's log and replicas.
+func (ml *masterLink) apply(args []string) error {
+	cmd := strings.ToLower(args[0])
+	if cmd == "select" {
+		if len(args) != 2 {
+			return fewArgsErr
+		}
+		dm, err := ml.srv.db(args[1])
+		if err != nil {
+			return err
+		}
+		ml.db = dm
+		return nil
+	}
+	dm := ml.db
+	dbs := commandDbs(dm, cmd, args[1:])
+	for _, db := range dbs {
+		db.execMu.RLock()
+	}
+	defer func() {
+		for _, db := range dbs {
+			db.execMu.RUnlock()
+		}
+	}()
+	ml.srv.propagateMu.Lock()
+	defer ml.srv.propagateMu.Unlock()
+	if err := replayCommand(&dm, args); err != nil {
+		return err
+	}
+	propagate(dm, cmd, args[1:], nil)
+	return nil
+}
+
+// ack sends the processed offset to the master
+// every second until done is closed.
+func (ml *masterLink) ack(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(replicaAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			offset := strconv.FormatInt(atomic.LoadInt64(&ml.offset), 10)
+			var buf bytes.Buffer
+			writeCommand(&buf, []string{"replconf", "ack", offset})
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func replicationInfo(s *Server) [][2]interface{} {
+	repl := s.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	var fields [][2]interface{}
+	if ml := repl.master; ml != nil {
+		status := "down"
+		if atomic.LoadInt32(&ml.up) == 1 {
+			status = "up"
+		}
+		fields = append(fields,
+			[2]interface{}{"role", "slave"},
+			[2]interface{}{"master_host", ml.host},
+			[2]interface{}{"master_port", ml.port},
+			[2]interface{}{"master_link_status", status},
+			[2]interface{}{"slave_repl_offset", atomic.LoadInt64(&ml.offset)},
+		)
+	} else {
+		fields = append(fields, [2]interface{}{"role", "master"})
+	}
+	fields = append(fields, [2]interface{}{"connected_slaves", len(repl.replicas)})
+	i := 0
+	for rp := range repl.replicas {
+		host, port, _ := net.SplitHostPort(rp.addr)
+		fields = append(fields, [2]interface{}{fmt.Sprintf("slave%d", i),
+			fmt.Sprintf("ip=%s,port=%s,state=online,offset=%d", host, port, atomic.LoadInt64(&rp.ack))})
+		i++
+	}
+	return append(fields,
+		[2]interface{}{"master_replid", repl.id},
+		[2]interface{}{"master_repl_offset", repl.offset},
+		[2]interface{}{"repl_backlog_active", boolToInt(repl.backlog != nil)},
+		[2]interface{}{"repl_backlog_size", repl.backlogSize},
+		[2]interface{}{"repl_backlog_first_byte_offset", repl.offset - repl.histLen},
+		[2]interface{}{"repl_backlog_histlen", repl.histLen},
+	)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicationBacklog(t *testing.T) {
+	r := &replication{backlog: make([]byte, 8)}
+	r.write([]byte("abcdef"))
+	r.write([]byte("ghij"))
+	if r.offset != 10 || r.histLen != 8 {
+		t.Fatalf("got %d offset and %d history, want 10 and 8", r.offset, r.histLen)
+	}
+	if got, ok := r.since(2); !ok || string(got) != "cdefghij" {
+		t.Fatalf("got %q, %v, want 'cdefghij'", got, ok)
+	}
+	if got, ok := r.since(10); !ok || len(got) != 0 {
+		t.Fatalf("got %q, %v, want empty tail", got, ok)
+	}
+	for _, offset := range []int64{1, 11} {
+		if _, ok := r.since(offset); ok {
+			t.Fatalf("offset %d should not be in the backlog", offset)
+		}
+	}
+	r.write([]byte("0123456789"))
+	if got, _ := r.since(12); string(got) != "23456789" {
+		t.Fatalf("got %q, want '23456789'", got)
+	}
+}
+
+// encodeCommands encodes cmds like the replication stream.
+func encodeCommands(cmds ...[]string) []byte {
+	var buf bytes.Buffer
+	for _, args := range cmds {
+		writeCommand(&buf, args)
+	}
+	return buf.Bytes()
+}
+
+// expectStream reads len(want) bytes from r and compares them with want.
+func expectStream(t *testing.T, r io.Reader, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("read stream error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q stream, want %q", got, want)
+	}
+}
+
+func TestPsync(t *testing.T) {
+	s := newTestServer(t, Config{})
+	dm := s.getDb("6")
+	executeAndPropagate(dm, "set", []string{"key", "value"})
+
+	srv, cli := net.Pipe()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("psync", "?", "-1"))
+	line, _ := readLine(r)
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("got %q, want full resynchronization", line)
+	}
+	id := fields[1]
+	offset, _ := strconv.ParseInt(fields[2], 10, 64)
+	n, err := readRESPLength(r, '$', maxBulkLen)
+	if err != nil {
+		t.Fatalf("read snapshot length error: %v", err)
+	}
+	dbs, err := readSnapshot(io.LimitReader(r, int64(n)))
+	if err != nil {
+		t.Fatalf("read snapshot error: %v", err)
+	}
+	if d := dbs["6"]["key"]; d == nil || d.value != "value" {
+		t.Fatalf("got %+v, want 'value' in snapshot", d)
+	}
+
+	executeAndPropagate(dm, "set", []string{"other", "value"})
+	stream := encodeCommands([]string{"select", "6"}, []string{"set", "other", "value"})
+	expectStream(t, r, stream)
+	offset += int64(len(stream))
+	cli.Close()
+
+	// the replica has missed a command while disconnected
+	executeAndPropagate(dm, "remove", []string{"other"})
+	srv, cli = net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r = bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("psync", id, strconv.FormatInt(offset, 10)))
+	expectLines(t, r, "+CONTINUE "+id)
+	expectStream(t, r, encodeCommands([]string{"remove", "other"}))
+}
+
+func TestReplicaOf(t *testing.T) {
+	s := newTestServer(t, Config{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	dm := s.getDb("7")
+	s.ReplicaOf(host, port)
+	defer s.ReplicaOf("no", "one")
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	if args, _ := readRESPCommand(r); fmt.Sprint(args) != "[psync ? -1]" {
+		t.Fatalf("got %q, want PSYNC for full resynchronization", args)
+	}
+	var snapshot bytes.Buffer
+	entries := []snapshotEntry{{key: "key", data: data{value: "value"}}}
+	writeSnapshot(&snapshot, []dbSnapshot{{id: "7", entries: entries}})
+	stream := encodeCommands([]string{"select", "7"}, []string{"set", "other", "value"})
+	fmt.Fprintf(conn, "+FULLRESYNC masterid 100\r\n$%d\r\n%s%s", snapshot.Len(), snapshot.Bytes(), stream)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if val, _ := dm.Get("other"); val == "value" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replica has not applied the stream")
+		}
+	}
+	if val, _ := dm.Get("key"); val != "value" {
+		t.Fatalf("got %q, want key from the snapshot", val)
+	}
+	if _, err := executeAndPropagate(dm, "set", []string{"key", "new"}); err != readOnlyErr {
+		t.Fatalf("got '%v', want '%v'", err, readOnlyErr)
+	}
+	info, _ := s.infoCommand([]string{"replication"})
+	offset := 100 + len(stream)
+	for _, want := range []string{"role:slave", "master_link_status:up", fmt.Sprintf("slave_repl_offset:%d", offset)} {
+		if !strings.Contains(info.(string), want) {
+			t.Fatalf("INFO replication %q doesn't contain %q", info, want)
+		}
+	}
+
+	// the replica resumes the stream after a disconnect
+	conn.Close()
+	conn, err = ln.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	if args, _ := readRESPCommand(r); fmt.Sprint(args) != fmt.Sprintf("[psync masterid %d]", offset) {
+		t.Fatalf("got %q, want PSYNC for partial resynchronization", args)
+	}
+
+	s.ReplicaOf("no", "one")
+	if _, err := executeAndPropagate(dm, "set", []string{"key", "new"}); err != nil {
+		t.Fatalf("got '%v', master should accept writes", err)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Command results are plain Go values which are rendered
+// by the protocol of a connection:
+//   - nil is a null reply
+//   - statusReply is a simple string
+//   - error is an error reply
+//   - int, int64 and bool are integers (booleans in RESP3)
+//   - float64 is a double (bulk string in RESP2)
+//   - string is a bulk string
+//   - []string and []interface{} are arrays
+//   - setReply is a set (array in RESP2)
+//   - map[string]string and mapReply are maps (flat arrays in RESP2)
+//   - pushReply is an out of band push message (array in RESP2)
+//   - multiReply is several replies sent one after another
+
+// statusReply is a reply sent as a simple string.
+type statusReply string
+
+const okReply statusReply = "OK"
+
+// mapReply is an ordered map reply. It holds keys
+// and values one after another.
+type mapReply []interface{}
+
+// setReply is an unordered collection of unique strings.
+type setReply []string
+
+// pushReply is a message pushed to a client
+// without a request, e.g. a published message.
+type pushReply []interface{}
+
+// multiReply is several replies to a single command,
+// e.g. SUBSCRIBE replies once per channel.
+type multiReply []interface{}
+
+// newMapReply converts dict to mapReply sorted by keys.
+func newMapReply(dict map[string]string) mapReply {
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	res := make(mapReply, 0, len(dict)*2)
+	for _, key := range keys {
+		res = append(res, key, dict[key])
+	}
+	return res
+}
+
+// newSetReply converts members to setReply sorted
+// to be displayed the same way every time.
+func newSetReply(members []string) setReply {
+	res := setReply(append([]string{}, members...))
+	sort.Strings(res)
+	return res
+}
+
+// formatFloat formats f in the shortest form which is
+// parsed back to the same value, infinities are
+// "inf" and "-inf".
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// formatReply formats v for telnet like API.
+func formatReply(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "(nil)"
+	case statusReply:
+		return string(x)
+	case float64:
+		return formatFloat(x)
+	case mapReply:
+		items := make([]string, 0, len(x)/2)
+		for i := 0; i+1 < len(x); i += 2 {
+			items = append(items, fmt.Sprintf("%s:%s", formatReply(x[i]), formatReply(x[i+1])))
+		}
+		return fmt.Sprintf("map[%s]", strings.Join(items, " "))
+	case []interface{}:
+		return formatList(x)
+	case pushReply:
+		return formatList(x)
+	case multiReply:
+		items := make([]string, len(x))
+		for i, item := range x {
+			items[i] = formatReply(item)
+		}
+		return strings.Join(items, "\n")
+	default:
+		return fmt.Sprintf("%v", x)
+	}
+}
+
+// formatList formats items of a list for telnet like API.
+func formatList(list []interface{}) string {
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = formatReply(item)
+	}
+	return fmt.Sprintf("[%s]", strings.Join(items, " "))
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestFormatReply(t *testing.T) {
+	cases := []struct {
+		have interface{}
+		want string
+	}{
+		{nil, "(nil)"},
+		{okReply, "OK"},
+		{int64(-1), "-1"},
+		{[]string{"a", "b"}, "[a b]"},
+		{map[string]string{"b": "2", "a": "1"}, "map[a:1 b:2]"},
+		{mapReply{"proto", int64(3)}, "map[proto:3]"},
+		{[]interface{}{"a", nil}, "[a (nil)]"},
+	}
+	for _, c := range cases {
+		if got := formatReply(c.have); got != c.want {
+			t.Fatalf("formatReply(%v) = %q, want %q", c.have, got, c.want)
+		}
+	}
+}
+
+func TestNewMapReply(t *testing.T) {
+	got := newMapReply(map[string]string{"b": "2", "a": "1"})
+	want := mapReply{"a", "1", "b", "2"}
+	if len(got) != len(want) {
+		t.Fatalf("newMapReply = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("newMapReply = %v, want %v", got, want)
+		}
+	}
+}
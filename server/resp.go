@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	telnetProto = 0
+	resp2Proto  = 2
+	resp3Proto  = 3
+)
+
+// maxBulkLen and maxMultiBulkLen limit the size of a
+// single RESP request, the same way Redis does.
+const maxBulkLen = 512 * 1024 * 1024
+const maxMultiBulkLen = 1024 * 1024
+
+var protocolErr = errors.New("ERROR: Protocol error")
+
+// readLine reads a line from r without trailing CRLF or LF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return strings.TrimRight(line, "\r"), nil
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readRESPLength reads a line with prefix byte followed
+// by a number, like "*3" or "$5".
+func readRESPLength(r *bufio.Reader, prefix byte, limit int) (int, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, fmt.Errorf("%v: expected '%c', got %q", protocolErr, prefix, line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > limit {
+		return 0, fmt.Errorf("%v: invalid length %q", protocolErr, line[1:])
+	}
+	return n, nil
+}
+
+// readRESPCommand reads a single command from r. A command
+// is either RESP array of bulk strings or an inline command.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		return dataParser(line), nil
+	}
+	n, err := readRESPLength(r, '*', maxMultiBulkLen)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		size, err := readRESPLength(r, '$', maxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%v: bulk string is not terminated by CRLF", protocolErr)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readReply reads a single RESP2 reply from r. Error
+// replies are returned as values of error type.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%v: empty reply", protocolErr)
+	}
+	switch line[0] {
+	case '+':
+		return statusReply(line[1:]), nil
+	case '-':
+		return errors.New(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid integer %q", protocolErr, line[1:])
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size > maxBulkLen {
+			return nil, fmt.Errorf("%v: invalid length %q", protocolErr, line[1:])
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxMultiBulkLen {
+			return nil, fmt.Errorf("%v: invalid length %q", protocolErr, line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%v: unexpected reply %q", protocolErr, line)
+}
+
+// respError converts err to RESP error line content.
+// Errors with our "ERROR: " prefix get the generic "ERR" code.
+func respError(err error) string {
+	msg := err.Error()
+	if strings.HasPrefix(msg, "ERROR: ") {
+		msg = "ERR " + msg[len("ERROR: "):]
+	}
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
+
+// writeRESP encodes v to w in RESP2 or RESP3 format
+// depending on proto. Types which RESP2 doesn't know
+// are downgraded to their closest RESP2 alternative.
+func writeRESP(w *bufio.Writer, v interface{}, proto int) {
+	resp3 := proto == resp3Proto
+	switch x := v.(type) {
+	case nil:
+		if resp3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case statusReply:
+		fmt.Fprintf(w, "+%s\r\n", x)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", respError(x))
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", x)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", x)
+	case bool:
+		switch {
+		case resp3 && x:
+			w.WriteString("#t\r\n")
+		case resp3:
+			w.WriteString("#f\r\n")
+		case x:
+			w.WriteString(":1\r\n")
+		default:
+			w.WriteString(":0\r\n")
+		}
+	case float64:
+		s := formatFloat(x)
+		if resp3 {
+			fmt.Fprintf(w, ",%s\r\n", s)
+		} else {
+			writeRESP(w, s, proto)
+		}
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(x), x)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(x))
+		for _, s := range x {
+			writeRESP(w, s, proto)
+		}
+	case setReply:
+		if resp3 {
+			fmt.Fprintf(w, "~%d\r\n", len(x))
+		} else {
+			fmt.Fprintf(w, "*%d\r\n", len(x))
+		}
+		for _, s := range x {
+			writeRESP(w, s, proto)
+		}
+	case map[string]string:
+		writeRESP(w, newMapReply(x), proto)
+	case mapReply:
+		if resp3 {
+			fmt.Fprintf(w, "%%%d\r\n", len(x)/2)
+		} else {
+			fmt.Fprintf(w, "*%d\r\n", len(x))
+		}
+		for _, item := range x {
+			writeRESP(w, item, proto)
+		}
+	case pushReply:
+		if resp3 {
+			fmt.Fprintf(w, ">%d\r\n", len(x))
+		} else {
+			fmt.Fprintf(w, "*%d\r\n", len(x))
+		}
+		for _, item := range x {
+			writeRESP(w, item, proto)
+		}
+	case multiReply:
+		for _, item := range x {
+			writeRESP(w, item, proto)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(x))
+		for _, item := range x {
+			writeRESP(w, item, proto)
+		}
+	default:
+		writeRESP(w, fmt.Sprintf("%v", x), proto)
+	}
+}
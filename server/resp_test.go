@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$11\r\nhello world\r\n"))
+	got, err := readRESPCommand(r)
+	if err != nil {
+		t.Fatalf("readRESPCommand error: %v", err)
+	}
+	want := []string{"set", "key", "hello world"}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	r = bufio.NewReader(strings.NewReader("get key\r\n"))
+	got, err = readRESPCommand(r)
+	if err != nil {
+		t.Fatalf("readRESPCommand error for inline command: %v", err)
+	}
+	want = []string{"get", "key"}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{"*1\r\n:3\r\n", "*x\r\n", "*1\r\n$3\r\nfoobar\r\n", "*-1\r\n", "*1\r\n$-5\r\n"} {
+		r = bufio.NewReader(strings.NewReader(bad))
+		if _, err := readRESPCommand(r); err == nil {
+			t.Fatalf("readRESPCommand(%q) expected protocol error", bad)
+		}
+	}
+}
+
+func TestWriteRESP(t *testing.T) {
+	cases := []struct {
+		have interface{}
+		want string
+	}{
+		{okReply, "+OK\r\n"},
+		{errors.New("ERROR: key not exists"), "-ERR key not exists\r\n"},
+		{int64(42), ":42\r\n"},
+		{"hello", "$5\r\nhello\r\n"},
+		{nil, "$-1\r\n"},
+		{[]string{"a", "bc"}, "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+		{map[string]string{"b": "2", "a": "1"}, "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeRESP(w, c.have, resp2Proto)
+		w.Flush()
+		if buf.String() != c.want {
+			t.Fatalf("writeRESP(%v) = %q, want %q", c.have, buf.String(), c.want)
+		}
+	}
+}
+
+func TestServeConnRESP(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	fmt.Fprint(cli, "*3\r\n$3\r\nset\r\n$4\r\nresp\r\n$5\r\nvalue\r\n*2\r\n$3\r\nget\r\n$4\r\nresp\r\n")
+	r := bufio.NewReader(cli)
+	for _, want := range []string{"+OK", "$5", "value"} {
+		got, err := readLine(r)
+		if err != nil {
+			t.Fatalf("read reply error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestServeConnNegativeLength(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, bad := range []string{"*-1\r\n", "*1\r\n$-5\r\n"} {
+		srv, cli := net.Pipe()
+		go s.ServeConn(srv)
+		fmt.Fprint(cli, bad)
+		got, err := readLine(bufio.NewReader(cli))
+		cli.Close()
+		if err != nil {
+			t.Fatalf("read reply error: %v", err)
+		}
+		if !strings.HasPrefix(got, "-ERR Protocol error") {
+			t.Fatalf("got %q, want protocol error for %q", got, bad)
+		}
+	}
+	// the server still serves new connections
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	fmt.Fprint(cli, "*1\r\n$4\r\nping\r\n")
+	if got, err := readLine(bufio.NewReader(cli)); got != "+PONG" || err != nil {
+		t.Fatalf("got %q, %v, want '+PONG'", got, err)
+	}
+}
+
+func TestServeConnTelnet(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	prompt := "test[0] "
+	buf := make([]byte, len(prompt))
+	if _, err := r.Read(buf); err != nil || string(buf) != prompt {
+		t.Fatalf("got %q prompt, want %q", buf, prompt)
+	}
+	fmt.Fprint(cli, "set telnet value\n")
+	got, err := readLine(r)
+	if err != nil {
+		t.Fatalf("read reply error: %v", err)
+	}
+	if got != "OK" {
+		t.Fatalf("got %q, want 'OK'", got)
+	}
+}
+
+func TestWriteRESP3(t *testing.T) {
+	cases := []struct {
+		have interface{}
+		want string
+	}{
+		{nil, "_\r\n"},
+		{true, "#t\r\n"},
+		{1.5, ",1.5\r\n"},
+		{math.Inf(-1), ",-inf\r\n"},
+		{map[string]string{"a": "1"}, "%1\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{setReply{"a"}, "~1\r\n$1\r\na\r\n"},
+		{pushReply{"message", "ch", "hi"}, ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeRESP(w, c.have, resp3Proto)
+		w.Flush()
+		if buf.String() != c.want {
+			t.Fatalf("writeRESP(%v) = %q, want %q", c.have, buf.String(), c.want)
+		}
+	}
+}
+
+func TestServeConnHello(t *testing.T) {
+	s := newTestServer(t, Config{})
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	fmt.Fprint(cli, "*2\r\n$5\r\nhello\r\n$1\r\n4\r\n")
+	r := bufio.NewReader(cli)
+	got, err := readLine(r)
+	if err != nil {
+		t.Fatalf("read reply error: %v", err)
+	}
+	if !strings.HasPrefix(got, "-NOPROTO") {
+		t.Fatalf("got %q, want NOPROTO error", got)
+	}
+	fmt.Fprint(cli, "*2\r\n$5\r\nhello\r\n$1\r\n3\r\n")
+	if got, _ = readLine(r); got != "%7" {
+		t.Fatalf("got %q, want RESP3 map with 7 items", got)
+	}
+	for i := 0; i < 14; i++ {
+		// skip the HELLO map, modules value is an empty array
+		if line, _ := readLine(r); line[0] == '$' {
+			readLine(r)
+		}
+	}
+	fmt.Fprint(cli, "*2\r\n$3\r\nget\r\n$7\r\nmissing\r\n")
+	if got, _ = readLine(r); got != "_" {
+		t.Fatalf("got %q, want RESP3 null", got)
+	}
+}
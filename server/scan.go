@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Cursors of SCAN like commands are stateless. Names are
+// visited in the order of their hashes and a cursor is the
+// hash of the next name to visit, so every name which exists
+// during the whole iteration is returned whatever is added
+// or removed meanwhile. Names with equal hashes are returned
+// together. The iteration starts and ends with cursor 0.
+const defaultScanCount = 10
+
+var invalidCursorErr = errors.New("ERROR: invalid cursor")
+
+// scanHash returns position of name in the scan order. It is
+// never 0 and fits in 53 bits, so it is kept exactly as the
+// score of a skip list node.
+func scanHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()>>11 + 1
+}
+
+// scanIndex keeps names in the scan order, so the cursor is
+// found in O(log n) and a call visits only names it returns.
+type scanIndex struct {
+	zsl *zskiplist
+}
+
+func newScanIndex() *scanIndex {
+	return &scanIndex{zsl: newZskiplist()}
+}
+
+// add adds name which isn't in idx.
+func (idx *scanIndex) add(name string) {
+	idx.zsl.insert(float64(scanHash(name)), name)
+}
+
+// remove removes name from idx.
+func (idx *scanIndex) remove(name string) {
+	idx.zsl.delete(float64(scanHash(name)), name)
+}
+
+// scan calls visit for names which follow the cursor of opts
+// in the scan order, about count of them, and returns the
+// next cursor.
+func (idx *scanIndex) scan(opts scanOptions, visit func(name string)) uint64 {
+	x := idx.zsl.firstInRange(scoreRange{min: float64(opts.cursor), max: math.Inf(1)})
+	for n := 0; x != nil; n++ {
+		if n >= opts.count && x.score != x.backward.score {
+			return uint64(x.score)
+		}
+		visit(x.member)
+		x = x.level[0].forward
+	}
+	return 0
+}
+
+// scanOptions are options of SCAN like commands.
+type scanOptions struct {
+	cursor uint64
+	match  string // glob pattern, empty matches everything
+	count  int    // number of names to visit
+}
+
+// parseScanArgs parses cursor [MATCH pattern] [COUNT count]
+// arguments of SCAN like commands.
+func parseScanArgs(args []string) (scanOptions, error) {
+	if len(args) == 0 {
+		return scanOptions{}, fewArgsErr
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return scanOptions{}, invalidCursorErr
+	}
+	opts := scanOptions{cursor: cursor, count: defaultScanCount}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return scanOptions{}, syntaxErr
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			opts.match = args[i+1]
+		case "count":
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return scanOptions{}, syntaxErr
+			}
+			opts.count = count
+		default:
+			return scanOptions{}, syntaxErr
+		}
+	}
+	return opts, nil
+}
+
+// matches reports whether name matches the pattern of opts.
+func (opts scanOptions) matches(name string) bool {
+	return opts.match == "" || globMatch(opts.match, name)
+}
+
+// scanReply is the reply to SCAN like commands.
+func scanReply(next uint64, items []string) []interface{} {
+	return []interface{}{strconv.FormatUint(next, 10), items}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestScanIndex(t *testing.T) {
+	idx := newScanIndex()
+	var want []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("name:%d", i)
+		idx.add(name)
+		if i%2 == 0 {
+			want = append(want, name)
+		}
+	}
+	for i := 1; i < 100; i += 2 {
+		idx.remove(fmt.Sprintf("name:%d", i))
+	}
+	sort.Slice(want, func(i, j int) bool { return scanHash(want[i]) < scanHash(want[j]) })
+	var got []string
+	opts := scanOptions{count: 7}
+	for {
+		next := idx.scan(opts, func(name string) { got = append(got, name) })
+		if next == 0 {
+			break
+		}
+		opts.cursor = next
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want names in the scan order %v", got, want)
+	}
+}
@@ -0,0 +1,430 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDbIndex is the database selected by new clients.
+const defaultDbIndex = "0"
+
+const defaultBacklogSize = 1 << 20
+const defaultAppendFilename = "appendonly.aof"
+const defaultShutdownTimeout = 10 * time.Second
+const defaultDatabases = 16
+
+// ErrServerClosed is returned by Serve after shutdown.
+var ErrServerClosed = errors.New("ERROR: server is closed")
+
+var badReplicaOfErr = errors.New("ERROR: replicaof must be \"host port\"")
+var badClusterAddrErr = errors.New("ERROR: cluster mode requires the address of the server as host:port")
+var badDatabasesErr = errors.New("ERROR: number of databases must be positive")
+var invalidDbIndexErr = errors.New("ERROR: invalid DB index")
+var dbIndexRangeErr = errors.New("ERROR: DB index is out of range")
+
+// Config holds settings of a Server. The zero value
+// is a server which keeps data only in memory.
+type Config struct {
+	// Addr is the address of the server shown in prompts
+	// and announced to other nodes of the cluster.
+	Addr string
+
+	// Databases is the number of databases, 16 by default.
+	// Their ids are numbers from 0 to Databases-1.
+	Databases int
+
+	// Dir is the directory of the snapshot and the append
+	// only file. Snapshots are disabled if DbFilename is empty.
+	Dir        string
+	DbFilename string
+
+	// AppendOnly enables the append only file which is used
+	// instead of the snapshot to restore data on start.
+	// AppendFsync is one of always, everysec (default) or no.
+	AppendOnly     bool
+	AppendFilename string
+	AppendFsync    string
+
+	// The append only file is rewritten automatically when it
+	// grows by AutoAofRewritePercentage since the last rewrite
+	// and isn't smaller than AutoAofRewriteMinSize. Zero
+	// percentage disables automatic rewrites.
+	AutoAofRewritePercentage int64
+	AutoAofRewriteMinSize    int64
+
+	// MaxMemory limits memory used by data in bytes, zero
+	// means no limit. MaxMemoryPolicy is how keys are
+	// evicted when it is reached, noeviction by default.
+	MaxMemory       int64
+	MaxMemoryPolicy string
+
+	// ReplicaOf is "host port" of the master to follow.
+	// ReplBacklogSize is 1mb by default.
+	ReplicaOf       string
+	ReplBacklogSize int64
+
+	// ClusterEnabled runs the server as a node of a cluster.
+	ClusterEnabled bool
+
+	// ShutdownTimeout limits how long SHUTDOWN command waits
+	// for running commands of clients, 10s by default.
+	ShutdownTimeout time.Duration
+}
+
+// Server is a redis-like server. It owns databases with their
+// expiry machinery, persistence, replication and cluster state,
+// so several independent servers may run in one process.
+type Server struct {
+	// statistics updated atomically
+	nextClientId     int64 // id of the last connected client
+	evictedKeys      int64
+	bgsaveInProgress int32
+	lastSave         int64
+	loading          int32 // set while the append only file is replayed
+
+	cfg       Config
+	startTime time.Time
+
+	// dbsMu guards dbs, databases are created on first use
+	dbsMu sync.RWMutex
+	dbs   map[string]*DataMap
+
+	// propagateMu keeps the order of logged
+	// commands the same as the order of execution.
+	propagateMu sync.Mutex
+	aof         *appendOnlyFile // nil if the log is disabled
+	repl        *replication
+	cluster     *clusterState // nil unless cluster mode is enabled
+	pubsub      *pubsubState
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	clients   map[*client]struct{}
+	handlers  sync.WaitGroup // running connection handlers
+	done      chan struct{}  // closed when shutdown starts
+
+	shutdownOnce sync.Once
+	stopped      chan struct{} // closed when shutdown is finished
+	shutdownErr  error
+}
+
+// New creates a server with cfg and restores its data from
+// the append only file or from the snapshot.
+func New(cfg Config) (*Server, error) {
+	if cfg.Databases == 0 {
+		cfg.Databases = defaultDatabases
+	}
+	if cfg.Databases < 0 {
+		return nil, badDatabasesErr
+	}
+	if cfg.MaxMemoryPolicy == "" {
+		cfg.MaxMemoryPolicy = policyNoEviction
+	}
+	if err := checkPolicy(cfg.MaxMemoryPolicy); err != nil {
+		return nil, err
+	}
+	if cfg.AppendFsync == "" {
+		cfg.AppendFsync = fsyncEverySec
+	}
+	if err := checkFsyncPolicy(cfg.AppendFsync); err != nil {
+		return nil, err
+	}
+	if cfg.AppendFilename == "" {
+		cfg.AppendFilename = defaultAppendFilename
+	}
+	if cfg.ReplBacklogSize == 0 {
+		cfg.ReplBacklogSize = defaultBacklogSize
+	}
+	if cfg.ReplBacklogSize < 0 {
+		return nil, badBacklogSizeErr
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+	var master []string
+	if cfg.ReplicaOf != "" {
+		if master = strings.Fields(cfg.ReplicaOf); len(master) != 2 {
+			return nil, badReplicaOfErr
+		}
+	}
+	var host, port string
+	if cfg.ClusterEnabled {
+		var err error
+		if host, port, err = net.SplitHostPort(cfg.Addr); err != nil {
+			return nil, badClusterAddrErr
+		}
+	}
+
+	s := &Server{
+		cfg:       cfg,
+		startTime: time.Now(),
+		dbs:       make(map[string]*DataMap),
+		repl:      newReplication(cfg.ReplBacklogSize),
+		pubsub:    newPubsubState(),
+		listeners: make(map[net.Listener]struct{}),
+		clients:   make(map[*client]struct{}),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	s.getDb(defaultDbIndex)
+	var err error
+	if cfg.AppendOnly {
+		err = s.loadAppendOnly()
+	} else {
+		err = s.loadSnapshot()
+	}
+	if err != nil {
+		close(s.done)
+		return nil, err
+	}
+	if master != nil {
+		s.ReplicaOf(master[0], master[1])
+	}
+	if cfg.ClusterEnabled {
+		s.cluster = newClusterState(host, port)
+		go s.cluster.gossipLoop(s.done)
+	}
+	return s, nil
+}
+
+// db returns database with id given by a client or read
+// from a file. It returns error if id isn't a number
+// from 0 to the configured number of databases.
+func (s *Server) db(id string) (*DataMap, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, invalidDbIndexErr
+	}
+	if n < 0 || n >= s.cfg.Databases {
+		return nil, dbIndexRangeErr
+	}
+	return s.getDb(strconv.Itoa(n)), nil
+}
+
+// getDb returns database with valid id. A new
+// database is created if it doesn't exist.
+func (s *Server) getDb(id string) *DataMap {
+	s.dbsMu.RLock()
+	dm, ok := s.dbs[id]
+	s.dbsMu.RUnlock()
+	if ok {
+		return dm
+	}
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	if dm, ok := s.dbs[id]; ok {
+		return dm
+	}
+	dm = &DataMap{DbId: id, srv: s}
+	dm.Init()
+	s.dbs[id] = dm
+	go dm.expireLoop(s.done)
+	return dm
+}
+
+// databases returns existing databases of s sorted by id.
+func (s *Server) databases() []*DataMap {
+	s.dbsMu.RLock()
+	dbs := make([]*DataMap, 0, len(s.dbs))
+	for _, dm := range s.dbs {
+		dbs = append(dbs, dm)
+	}
+	s.dbsMu.RUnlock()
+	sort.Slice(dbs, func(i, j int) bool {
+		a, _ := strconv.Atoi(dbs[i].DbId)
+		b, _ := strconv.Atoi(dbs[j].DbId)
+		return a < b
+	})
+	return dbs
+}
+
+// Serve accepts connections on l and serves each of them
+// in a new goroutine until the server is shut down by
+// Shutdown or SHUTDOWN command. Then it waits until
+// the shutdown is finished and returns ErrServerClosed.
+// Otherwise it returns error of l.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed() {
+		s.mu.Unlock()
+		<-s.stopped
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closed() {
+				<-s.stopped
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Print(err)
+			continue
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// closed reports whether shutdown has started.
+func (s *Server) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// addClient registers cl, so it is disconnected by Shutdown.
+// It reports false if the server is already shut down.
+func (s *Server) addClient(cl *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed() {
+		return false
+	}
+	s.clients[cl] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+// removeClient unregisters cl when its handler returns.
+func (s *Server) removeClient(cl *client) {
+	s.mu.Lock()
+	delete(s.clients, cl)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+// connectedClients returns number of connected clients.
+func (s *Server) connectedClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// Shutdown gracefully stops the server: listeners are closed,
+// background loops are stopped, blocked commands like BLPOP
+// get nil reply and clients are disconnected after their
+// running commands finish. If ctx is done earlier, clients are
+// disconnected at once without waiting for their commands and
+// ctx.Err() is returned. Then the final snapshot is saved if it
+// is configured and the append only file is flushed to disk.
+// Shutdown returns when all of it is done, concurrent calls
+// wait for the same shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.shutdown(ctx, s.snapshotPath() != "")
+}
+
+// shutdown stops the server once, saving the snapshot
+// if save is set, and waits until it is stopped.
+func (s *Server) shutdown(ctx context.Context, save bool) error {
+	s.shutdownOnce.Do(func() {
+		go func() {
+			s.shutdownErr = s.stop(ctx, save)
+			close(s.stopped)
+		}()
+	})
+	<-s.stopped
+	return s.shutdownErr
+}
+
+// stop stops the server as described by Shutdown.
+func (s *Server) stop(ctx context.Context, save bool) error {
+	s.mu.Lock()
+	close(s.done)
+	for l := range s.listeners {
+		l.Close()
+	}
+	for cl := range s.clients {
+		// idle clients stop waiting for the next command,
+		// busy ones leave when their command finishes
+		cl.conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	s.unblockAll(nil)
+
+	s.repl.mu.Lock()
+	ml := s.repl.master
+	s.repl.mu.Unlock()
+	if ml != nil {
+		ml.close()
+	}
+	finished := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.mu.Lock()
+		for cl := range s.clients {
+			cl.closeOnce.Do(func() {
+				cl.conn.Close()
+			})
+		}
+		s.mu.Unlock()
+		// handlers still running exit when their connections
+		// fail, they aren't waited for anymore
+	}
+	if save {
+		if serr := s.Save(); serr != nil {
+			log.Printf("saving on shutdown error: %v\n", serr)
+			err = serr
+		}
+	}
+	if s.aof != nil {
+		if aerr := s.aof.Close(); aerr != nil {
+			log.Printf("closing append only file error: %v\n", aerr)
+			err = aerr
+		}
+	}
+	return err
+}
+
+// shutdownCommand handles SHUTDOWN [SAVE|NOSAVE] command.
+// The server is stopped in background after the reply.
+func (s *Server) shutdownCommand(args []string) (interface{}, error) {
+	save := s.snapshotPath() != ""
+	if len(args) > 1 {
+		return nil, manyArgsErr
+	}
+	if len(args) == 1 {
+		switch strings.ToLower(args[0]) {
+		case "save":
+			if s.snapshotPath() == "" {
+				return nil, noSnapshotFileErr
+			}
+			save = true
+		case "nosave":
+			save = false
+		default:
+			return nil, syntaxErr
+		}
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+		defer cancel()
+		s.shutdown(ctx, save)
+	}()
+	return okReply, nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a server with cfg which is
+// shut down when the test finishes.
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	if cfg.Addr == "" {
+		cfg.Addr = "test"
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	t.Cleanup(func() {
+		// clients left by a failed test are disconnected
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return s
+}
+
+func TestNewConfig(t *testing.T) {
+	cases := []struct {
+		cfg Config
+		err error
+	}{
+		{Config{MaxMemoryPolicy: "sometimes"}, badPolicyErr},
+		{Config{AppendFsync: "sometimes"}, badFsyncPolicyErr},
+		{Config{ReplBacklogSize: -1}, badBacklogSizeErr},
+		{Config{ReplicaOf: "localhost"}, badReplicaOfErr},
+		{Config{ClusterEnabled: true}, badClusterAddrErr},
+		{Config{Databases: -1}, badDatabasesErr},
+	}
+	for _, c := range cases {
+		if _, err := New(c.cfg); err != c.err {
+			t.Fatalf("New(%+v) error is '%v', want '%v'", c.cfg, err, c.err)
+		}
+	}
+}
+
+func TestIndependentServers(t *testing.T) {
+	a, b := newTestServer(t, Config{}), newTestServer(t, Config{})
+	if _, err := executeAndPropagate(a.getDb(defaultDbIndex), "set", []string{"key", "a"}); err != nil {
+		t.Fatalf("SET error: %v", err)
+	}
+	if _, err := b.getDb(defaultDbIndex).Get("key"); err != keyNotExistErr {
+		t.Fatalf("got '%v', key of another server should not exist", err)
+	}
+	if a.usedMemory() == 0 || b.usedMemory() != 0 {
+		t.Fatalf("got %d and %d used memory, want only the first server to use it", a.usedMemory(), b.usedMemory())
+	}
+}
+
+func TestDatabaseRegistry(t *testing.T) {
+	s := newTestServer(t, Config{Databases: 2})
+	dbs := make(chan *DataMap, 10)
+	for i := 0; i < cap(dbs); i++ {
+		go func() {
+			dm, _ := s.db("1")
+			dbs <- dm
+		}()
+	}
+	first := <-dbs
+	for i := 1; i < cap(dbs); i++ {
+		if dm := <-dbs; dm != first {
+			t.Fatal("concurrent lookups should return the same database")
+		}
+	}
+	if dm, err := s.db("01"); err != nil || dm != first {
+		t.Fatalf("got %v, %v, want database 1", dm, err)
+	}
+	for id, want := range map[string]error{"x": invalidDbIndexErr, "2": dbIndexRangeErr, "-1": dbIndexRangeErr} {
+		if _, err := s.db(id); err != want {
+			t.Fatalf("db(%q) error is '%v', want '%v'", id, err, want)
+		}
+	}
+	if n := len(s.databases()); n != 2 {
+		t.Fatalf("got %d databases, want 2", n)
+	}
+}
+
+func TestServeAndShutdown(t *testing.T) {
+	s, err := New(Config{})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, respCommand("ping"))
+	expectLines(t, r, "+PONG")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("got '%v' from Serve, want '%v'", err, ErrServerClosed)
+	}
+	if _, err := readLine(r); err == nil {
+		t.Fatal("client should be disconnected by Shutdown")
+	}
+	if err := s.Serve(ln); err != ErrServerClosed {
+		t.Fatalf("got '%v', closed server should not serve", err)
+	}
+}
+
+func TestShutdownDrainsAndSaves(t *testing.T) {
+	cfg := Config{Dir: t.TempDir(), DbFilename: "dump.rls"}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	blocked, br := blockedClient(t, s, "drain-list", "blpop", "drain-list", "0")
+	defer blocked.Close()
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.ServeConn(srv)
+	r := bufio.NewReader(cli)
+	fmt.Fprint(cli, respCommand("set", "drain-key", "value"))
+	expectLines(t, r, "+OK")
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- s.Shutdown(ctx)
+	}()
+	// the blocked command finishes before the client is disconnected
+	expectLines(t, br, "$-1")
+	if _, err := readLine(br); err == nil {
+		t.Fatal("blocked client should be disconnected")
+	}
+	if _, err := readLine(r); err == nil {
+		t.Fatal("idle client should be disconnected")
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+	dm := newTestServer(t, cfg).getDb(defaultDbIndex)
+	if got, err := dm.Get("drain-key"); err != nil || got != "value" {
+		t.Fatalf("got %q, %v, want the key saved on shutdown", got, err)
+	}
+}
+
+func TestShutdownCommand(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, args := range [][]string{{"save"}, {"now"}, {"save", "now"}} {
+		if _, err := s.shutdownCommand(args); err == nil {
+			t.Fatalf("SHUTDOWN %v should fail", args)
+		}
+	}
+	if s.closed() {
+		t.Fatal("failed SHUTDOWN should not stop the server")
+	}
+
+	cfg := Config{Dir: t.TempDir(), DbFilename: "dump.rls"}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, respCommand("set", "key", "value"), respCommand("shutdown", "nosave"))
+	expectLines(t, r, "+OK", "+OK")
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("got '%v' from Serve, want '%v'", err, ErrServerClosed)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Dir, cfg.DbFilename)); !os.IsNotExist(err) {
+		t.Fatalf("got '%v', SHUTDOWN NOSAVE should not save the snapshot", err)
+	}
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var negativeCountErr = errors.New("ERROR: value is out of range, must be positive")
+var countRangeErr = errors.New("ERROR: value is out of range")
+
+// maxRandMembersPrealloc limits preallocation for repeated
+// random members, the reply grows as members are picked.
+const maxRandMembersPrealloc = 1024
+
+// set operations of SINTER, SUNION and SDIFF commands.
+const (
+	setInter = iota
+	setUnion
+	setDiff
+)
+
+// lookupSet gets set stored by key. A missing key is
+// an empty set. It must be called with dm.mu held
+// at least for reading.
+func (dm *DataMap) lookupSet(key string) (map[string]struct{}, error) {
+	d, ok := dm.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	return d.SetGet()
+}
+
+// SAdd adds members to set in dm by key and returns
+// the number of added members. The set is created
+// if key not exists. Returns error if key contains
+// another type.
+func (dm *DataMap) SAdd(key string, members ...string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, ok := dm.lookupWrite(key)
+	if ok {
+		if _, err := d.SetGet(); err != nil {
+			return 0, err
+		}
+		dm.unshare(d)
+	} else {
+		d = dm.create(key)
+		d.SetSet(make(map[string]struct{}, len(members)))
+	}
+	set := d.value.(map[string]struct{})
+	added := 0
+	for _, m := range members {
+		if _, ok := set[m]; !ok {
+			set[m] = struct{}{}
+			dm.grow(d, int64(len(m))+itemOverhead)
+			added++
+		}
+	}
+	if added > 0 {
+		dm.modified(d)
+	}
+	return added, nil
+}
+
+// SRem removes members from set in dm by key and
+// returns the number of removed members. An empty set
+// is removed. Returns error if key contains another type.
+func (dm *DataMap) SRem(key string, members ...string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		return 0, nil
+	}
+	if _, err := d.SetGet(); err != nil {
+		return 0, err
+	}
+	dm.unshare(d)
+	return dm.removeMembers(key, d, members), nil
+}
+
+// removeMembers removes members from set d stored by key
+// and returns the number of removed ones. It must be
+// called with dm.mu held for writing.
+func (dm *DataMap) removeMembers(key string, d *data, members []string) int {
+	set := d.value.(map[string]struct{})
+	removed := 0
+	for _, m := range members {
+		if _, ok := set[m]; ok {
+			delete(set, m)
+			dm.grow(d, -int64(len(m))-itemOverhead)
+			removed++
+		}
+	}
+	if len(set) == 0 {
+		dm.delete(key)
+	} else if removed > 0 {
+		dm.modified(d)
+	}
+	return removed
+}
+
+// SMembers gets all members of set in dm by key.
+// Returns error if key not exists or contains
+// another type.
+func (dm *DataMap) SMembers(key string) ([]string, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	d, ok := dm.lookup(key)
+	if !ok {
+		return nil, keyNotExistErr
+	}
+	set, err := d.SetGet()
+	if err != nil {
+		return nil, err
+	}
+	return setMembers(set), nil
+}
+
+// SIsMember reports whether member is in set
+// in dm by key. Returns error if key contains
+// another type.
+func (dm *DataMap) SIsMember(key, member string) (bool, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	set, err := dm.lookupSet(key)
+	if err != nil {
+		return false, err
+	}
+	_, ok := set[member]
+	return ok, nil
+}
+
+// SCard gets the number of members of set in dm by key.
+// Returns error if key contains another type.
+func (dm *DataMap) SCard(key string) (int, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	set, err := dm.lookupSet(key)
+	if err != nil {
+		return 0, err
+	}
+	return len(set), nil
+}
+
+// SRandMember gets count random members of set in dm
+// by key. Members are distinct if count is positive,
+// otherwise -count members which may repeat are returned.
+// Returns error if key contains another type or -count
+// is out of range.
+func (dm *DataMap) SRandMember(key string, count int) ([]string, error) {
+	if count < -math.MaxInt/2 {
+		return nil, countRangeErr
+	}
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	set, err := dm.lookupSet(key)
+	if err != nil || len(set) == 0 {
+		return nil, err
+	}
+	if count >= 0 {
+		return randomMembers(set, count), nil
+	}
+	res := make([]string, 0, min(-count, maxRandMembersPrealloc))
+	for len(res) < -count {
+		res = append(res, randomMembers(set, 1)...)
+	}
+	return res, nil
+}
+
+// SPop removes count random members from set in dm by
+// key and returns them. Returns error if key contains
+// another type.
+func (dm *DataMap) SPop(key string, count int) ([]string, error) {
+	if count < 0 {
+		return nil, negativeCountErr
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		return nil, nil
+	}
+	set, err := d.SetGet()
+	if err != nil {
+		return nil, err
+	}
+	members := randomMembers(set, count)
+	dm.unshare(d)
+	dm.removeMembers(key, d, members)
+	return members, nil
+}
+
+// SInter gets members of the intersection of sets in dm
+// by keys. Returns error if a key contains another type.
+func (dm *DataMap) SInter(keys ...string) ([]string, error) {
+	return dm.combine(setInter, keys)
+}
+
+// SUnion gets members of the union of sets in dm
+// by keys. Returns error if a key contains another type.
+func (dm *DataMap) SUnion(keys ...string) ([]string, error) {
+	return dm.combine(setUnion, keys)
+}
+
+// SDiff gets members of the first set in dm by keys which
+// are not in the other ones. Returns error if a key
+// contains another type.
+func (dm *DataMap) SDiff(keys ...string) ([]string, error) {
+	return dm.combine(setDiff, keys)
+}
+
+// SInterStore is like SInter, but it stores the result by
+// dst key and returns its size.
+func (dm *DataMap) SInterStore(dst string, keys ...string) (int, error) {
+	return dm.combineStore(setInter, dst, keys)
+}
+
+// SUnionStore is like SUnion, but it stores the result by
+// dst key and returns its size.
+func (dm *DataMap) SUnionStore(dst string, keys ...string) (int, error) {
+	return dm.combineStore(setUnion, dst, keys)
+}
+
+// SDiffStore is like SDiff, but it stores the result by
+// dst key and returns its size.
+func (dm *DataMap) SDiffStore(dst string, keys ...string) (int, error) {
+	return dm.combineStore(setDiff, dst, keys)
+}
+
+// combine gets members of the result of op over
+// sets by keys.
+func (dm *DataMap) combine(op int, keys []string) ([]string, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	set, err := dm.setOperation(op, keys)
+	if err != nil {
+		return nil, err
+	}
+	return setMembers(set), nil
+}
+
+// combineStore stores the result of op over sets by keys
+// by dst key. An empty result removes dst.
+func (dm *DataMap) combineStore(op int, dst string, keys []string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	set, err := dm.setOperation(op, keys)
+	if err != nil {
+		return 0, err
+	}
+	dm.delete(dst)
+	if len(set) > 0 {
+		d := dm.create(dst)
+		d.SetSet(set)
+		dm.resize(dst, d)
+		dm.modified(d)
+	}
+	return len(set), nil
+}
+
+// setOperation computes op over sets by keys into a new
+// set. It must be called with dm.mu held at least
+// for reading.
+func (dm *DataMap) setOperation(op int, keys []string) (map[string]struct{}, error) {
+	sets := make([]map[string]struct{}, len(keys))
+	for i, key := range keys {
+		set, err := dm.lookupSet(key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	res := make(map[string]struct{})
+	switch op {
+	case setInter:
+		smallest := sets[0]
+		for _, set := range sets[1:] {
+			if len(set) < len(smallest) {
+				smallest = set
+			}
+		}
+	members:
+		for m := range smallest {
+			for _, set := range sets {
+				if _, ok := set[m]; !ok {
+					continue members
+				}
+			}
+			res[m] = struct{}{}
+		}
+	case setUnion:
+		for _, set := range sets {
+			for m := range set {
+				res[m] = struct{}{}
+			}
+		}
+	case setDiff:
+		for m := range sets[0] {
+			res[m] = struct{}{}
+		}
+		for _, set := range sets[1:] {
+			for m := range set {
+				delete(res, m)
+			}
+		}
+	}
+	return res, nil
+}
+
+// setMembers returns members of set as a slice.
+func setMembers(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for m := range set {
+		res = append(res, m)
+	}
+	return res
+}
+
+// randomMembers returns count distinct members of set.
+// Like Redis, it doesn't choose them uniformly: a range
+// over a map starts at a random position.
+func randomMembers(set map[string]struct{}, count int) []string {
+	if count > len(set) {
+		count = len(set)
+	}
+	res := make([]string, 0, count)
+	for m := range set {
+		if len(res) == count {
+			break
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// setCommand runs set command cmd with key and args in dm.
+func setCommand(dm *DataMap, cmd, key string, args []string) (interface{}, error) {
+	switch cmd {
+	case "sadd", "srem":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if cmd == "sadd" {
+			return dm.SAdd(key, args...)
+		}
+		return dm.SRem(key, args...)
+	case "smembers":
+		if len(args) > 0 {
+			return nil, manyArgsErr
+		}
+		members, err := dm.SMembers(key)
+		if err != nil && err != keyNotExistErr {
+			return nil, err
+		}
+		return newSetReply(members), nil
+	case "sismember":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		ok, err := dm.SIsMember(key, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return 1, nil
+		}
+		return 0, nil
+	case "scard":
+		if len(args) > 0 {
+			return nil, manyArgsErr
+		}
+		return dm.SCard(key)
+	case "srandmember", "spop":
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		count := 1
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, wrongArgErr
+			}
+			count = n
+		}
+		var members []string
+		var err error
+		if cmd == "spop" {
+			members, err = dm.SPop(key, count)
+		} else {
+			members, err = dm.SRandMember(key, count)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 1 {
+			return append([]string{}, members...), nil
+		}
+		if len(members) == 0 {
+			return nil, nil
+		}
+		return members[0], nil
+	case "sinter", "sunion", "sdiff":
+		keys := append([]string{key}, args...)
+		var members []string
+		var err error
+		switch cmd {
+		case "sinter":
+			members, err = dm.SInter(keys...)
+		case "sunion":
+			members, err = dm.SUnion(keys...)
+		default:
+			members, err = dm.SDiff(keys...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return newSetReply(members), nil
+	case "sinterstore", "sunionstore", "sdiffstore":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		switch cmd {
+		case "sinterstore":
+			return dm.SInterStore(key, args...)
+		case "sunionstore":
+			return dm.SUnionStore(key, args...)
+		default:
+			return dm.SDiffStore(key, args...)
+		}
+	default:
+		return nil, unknownCmdErr
+	}
+}
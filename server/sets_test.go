@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestMapSAdd(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	n, err := dm.SAdd("set", "a", "b", "a")
+	if err != nil || n != 2 {
+		t.Fatalf("SAdd = %d, %v, want 2 added", n, err)
+	}
+	if n, _ = dm.SAdd("set", "b", "c"); n != 1 {
+		t.Fatalf("got %d added, want 1", n)
+	}
+	if card, _ := dm.SCard("set"); card != 3 {
+		t.Fatalf("got %d members, want 3", card)
+	}
+	if ok, _ := dm.SIsMember("set", "c"); !ok {
+		t.Fatal("'c' should be a member")
+	}
+	dm.Set("str", "value")
+	if _, err := dm.SAdd("str", "a"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+	if _, err := dm.SCard("str"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+}
+
+func TestMapSRem(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.SAdd("set", "a", "b")
+	if n, err := dm.SRem("set", "a", "c"); err != nil || n != 1 {
+		t.Fatalf("SRem = %d, %v, want 1 removed", n, err)
+	}
+	dm.SRem("set", "b")
+	if _, err := dm.SMembers("set"); err != keyNotExistErr {
+		t.Fatalf("got '%v', empty set should be removed", err)
+	}
+	if n, err := dm.SRem("missing", "a"); err != nil || n != 0 {
+		t.Fatalf("SRem = %d, %v, want 0 removed", n, err)
+	}
+}
+
+func TestMapSetOperations(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.SAdd("a", "1", "2", "3")
+	dm.SAdd("b", "2", "3", "4")
+	dm.SAdd("c", "3", "5")
+	cases := []struct {
+		cmd  string
+		args []string
+		want string
+	}{
+		{"sinter", []string{"a", "b", "c"}, "[3]"},
+		{"sinter", []string{"a", "missing"}, "[]"},
+		{"sunion", []string{"a", "b", "c"}, "[1 2 3 4 5]"},
+		{"sdiff", []string{"a", "b"}, "[1]"},
+		{"sdiff", []string{"missing", "a"}, "[]"},
+	}
+	for _, c := range cases {
+		res, err := execute(&dm, c.cmd, c.args)
+		if err != nil {
+			t.Fatalf("%s %v error: %v", c.cmd, c.args, err)
+		}
+		if got := fmt.Sprint(res); got != c.want {
+			t.Fatalf("%s %v = %s, want %s", c.cmd, c.args, got, c.want)
+		}
+	}
+	if n, err := dm.SUnionStore("dst", "a", "b"); err != nil || n != 4 {
+		t.Fatalf("SUnionStore = %d, %v, want 4", n, err)
+	}
+	dm.PExpire("dst", 100000)
+	if n, _ := dm.SInterStore("dst", "dst", "c"); n != 1 {
+		t.Fatalf("got %d members stored, want 1", n)
+	}
+	if ttl := dm.deadline("dst"); ttl != 0 {
+		t.Fatalf("got %d ttl, stored set should be persistent", ttl)
+	}
+	if n, _ := dm.SDiffStore("dst", "missing"); n != 0 {
+		t.Fatalf("got %d members stored, want 0", n)
+	}
+	if _, err := dm.SMembers("dst"); err != keyNotExistErr {
+		t.Fatal("empty result should remove destination")
+	}
+	dm.Set("str", "value")
+	if _, err := dm.SUnion("a", "str"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+}
+
+func TestMapSPop(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.SAdd("set", "a", "b", "c")
+	popped, err := dm.SPop("set", 2)
+	if err != nil || len(popped) != 2 {
+		t.Fatalf("SPop = %v, %v, want 2 members", popped, err)
+	}
+	rest, _ := dm.SMembers("set")
+	all := append(rest, popped...)
+	sort.Strings(all)
+	if fmt.Sprint(all) != "[a b c]" {
+		t.Fatalf("got %v popped and %v left", popped, rest)
+	}
+	if _, err := dm.SPop("set", -1); err != negativeCountErr {
+		t.Fatalf("got '%v', expected '%v' error", err, negativeCountErr)
+	}
+	dm.SPop("set", 5)
+	if _, err := dm.SMembers("set"); err != keyNotExistErr {
+		t.Fatal("set should be removed when all members are popped")
+	}
+}
+
+func TestMapSRandMember(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.SAdd("set", "a", "b", "c")
+	if got, _ := dm.SRandMember("set", 5); len(got) != 3 {
+		t.Fatalf("got %v, want all 3 members", got)
+	}
+	if got, _ := dm.SRandMember("set", -5); len(got) != 5 {
+		t.Fatalf("got %v, want 5 members", got)
+	}
+	if _, err := dm.SRandMember("set", math.MinInt64); err != countRangeErr {
+		t.Fatalf("got '%v', want '%v' error", err, countRangeErr)
+	}
+	res, err := DataHandler(&dm, "srandmember", []string{"set", "-9223372036854775808"})
+	if err != countRangeErr {
+		t.Fatalf("got %v, '%v', want '%v' error", res, err, countRangeErr)
+	}
+	if card, _ := dm.SCard("set"); card != 3 {
+		t.Fatalf("got %d members, SRANDMEMBER shouldn't change set", card)
+	}
+}
+
+func TestSetDataHandlers(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if _, err := DataHandler(&dm, "sadd", []string{"set"}); err != fewArgsErr {
+		t.Fatalf("got '%v', want: '%v'", err, fewArgsErr)
+	}
+	if res, _ := DataHandler(&dm, "sadd", []string{"set", "b", "a"}); res != "2" {
+		t.Fatalf("got %s, want 2", res)
+	}
+	if res, _ := DataHandler(&dm, "smembers", []string{"set"}); res != "[a b]" {
+		t.Fatalf("got %s, want [a b]", res)
+	}
+	if res, _ := DataHandler(&dm, "smembers", []string{"missing"}); res != "[]" {
+		t.Fatalf("got %s, want []", res)
+	}
+	if res, _ := DataHandler(&dm, "sismember", []string{"set", "c"}); res != "0" {
+		t.Fatalf("got %s, want 0", res)
+	}
+	if res, _ := DataHandler(&dm, "spop", []string{"missing"}); res != "(nil)" {
+		t.Fatalf("got %s, want (nil)", res)
+	}
+	res, _ := execute(&dm, "spop", []string{"set"})
+	want := [][]string{{"srem", "set", fmt.Sprint(res)}}
+	if got := aofCommands(&dm, "spop", []string{"set"}, res); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v logged, want %v", got, want)
+	}
+	if got := aofCommands(&dm, "spop", []string{"missing"}, nil); len(got) != 0 {
+		t.Fatalf("got %v logged, empty SPOP shouldn't be logged", got)
+	}
+}
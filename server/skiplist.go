@@ -0,0 +1,218 @@
+package server
+
+import (
+	"math/rand"
+)
+
+// Sorted sets keep members ordered by score and then by member
+// in a skip list, like in Redis. Every link of the list keeps
+// its span, the number of nodes it skips, so the rank of a node
+// and a node by rank are found in O(log n) as well.
+const zskiplistMaxLevel = 32
+const zskiplistP = 0.25
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int
+}
+
+type zskiplistNode struct {
+	member   string
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+type zskiplist struct {
+	header *zskiplistNode
+	tail   *zskiplistNode
+	length int
+	level  int
+}
+
+func newZskiplist() *zskiplist {
+	header := &zskiplistNode{level: make([]zskiplistLevel, zskiplistMaxLevel)}
+	return &zskiplist{header: header, level: 1}
+}
+
+// zslRandomLevel returns a level for a new node. Higher
+// levels are less likely.
+func zslRandomLevel() int {
+	level := 1
+	for level < zskiplistMaxLevel && rand.Float64() < zskiplistP {
+		level++
+	}
+	return level
+}
+
+// before reports whether n goes before score and member.
+func (n *zskiplistNode) before(score float64, member string) bool {
+	return n.score < score || n.score == score && n.member < member
+}
+
+// after reports whether n goes after score and member.
+func (n *zskiplistNode) after(score float64, member string) bool {
+	return n.score > score || n.score == score && n.member > member
+}
+
+// insert adds a new node. member must not be in zsl.
+func (zsl *zskiplist) insert(score float64, member string) *zskiplistNode {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	var rank [zskiplistMaxLevel]int
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+	x = &zskiplistNode{member: member, score: score, level: make([]zskiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// unlink removes x from zsl. update holds the last
+// node before x on every level.
+func (zsl *zskiplist) unlink(x *zskiplistNode, update []*zskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// delete removes the node with score and member.
+// It reports whether the node has been found.
+func (zsl *zskiplist) delete(score float64, member string) bool {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	zsl.unlink(x, update[:])
+	return true
+}
+
+// rank returns 1-based rank of the node with score and
+// member or 0 if there is no such node.
+func (zsl *zskiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !x.level[i].forward.after(score, member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node with 1-based rank or nil.
+func (zsl *zskiplist) byRank(rank int) *zskiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank && x != zsl.header {
+			return x
+		}
+	}
+	return nil
+}
+
+// zrange is a range of nodes, either by score or by member.
+type zrange interface {
+	empty() bool
+	gteMin(n *zskiplistNode) bool
+	lteMax(n *zskiplistNode) bool
+}
+
+// firstInRange returns the first node in r or nil.
+func (zsl *zskiplist) firstInRange(r zrange) *zskiplistNode {
+	if r.empty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange returns the last node in r or nil.
+func (zsl *zskiplist) lastInRange(r zrange) *zskiplistNode {
+	if r.empty() {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !r.gteMin(x) {
+		return nil
+	}
+	return x
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// checkSkiplist compares zsl with sorted items.
+func checkSkiplist(t *testing.T, zsl *zskiplist, items []ZItem) {
+	t.Helper()
+	if zsl.length != len(items) {
+		t.Fatalf("got %d length, want %d", zsl.length, len(items))
+	}
+	var prev *zskiplistNode
+	x := zsl.header.level[0].forward
+	for i, item := range items {
+		if x == nil || x.member != item.Member || x.score != item.Score {
+			t.Fatalf("got %v node at %d, want %v", x, i, item)
+		}
+		if x.backward != prev {
+			t.Fatalf("wrong backward link of %q", x.member)
+		}
+		if rank := zsl.rank(x.score, x.member); rank != i+1 {
+			t.Fatalf("got %d rank of %q, want %d", rank, x.member, i+1)
+		}
+		if n := zsl.byRank(i + 1); n != x {
+			t.Fatalf("got %v by rank %d, want %q", n, i+1, x.member)
+		}
+		prev, x = x, x.level[0].forward
+	}
+	if zsl.tail != prev {
+		t.Fatal("wrong tail")
+	}
+}
+
+func TestSkiplist(t *testing.T) {
+	zsl := newZskiplist()
+	var items []ZItem
+	for i := 0; i < 500; i++ {
+		item := ZItem{fmt.Sprintf("m%d", i), float64(rand.Intn(50))}
+		zsl.insert(item.Score, item.Member)
+		items = append(items, item)
+	}
+	for i := 0; i < 200; i++ {
+		j := rand.Intn(len(items))
+		if !zsl.delete(items[j].Score, items[j].Member) {
+			t.Fatalf("%v isn't deleted", items[j])
+		}
+		items = append(items[:j], items[j+1:]...)
+	}
+	if zsl.delete(-1, "missing") {
+		t.Fatal("missing node is deleted")
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		return a.Score < b.Score || a.Score == b.Score && a.Member < b.Member
+	})
+	checkSkiplist(t, zsl, items)
+	if zsl.byRank(len(items)+1) != nil || zsl.byRank(0) != nil {
+		t.Fatal("out of range rank should return nil")
+	}
+}
+
+func TestSkiplistRange(t *testing.T) {
+	zsl := newZskiplist()
+	for i, m := range []string{"a", "b", "c", "d"} {
+		zsl.insert(float64(i), m)
+	}
+	cases := []struct {
+		r           zrange
+		first, last string
+	}{
+		{scoreRange{min: 1, max: 2}, "b", "c"},
+		{scoreRange{min: 1, max: 2, minex: true, maxex: true}, "", ""},
+		{scoreRange{min: 0.5, max: 10}, "b", "d"},
+		{scoreRange{min: 5, max: 10}, "", ""},
+		{lexRange{lexBound{inf: -1}, lexBound{value: "b"}}, "a", "b"},
+		{lexRange{lexBound{value: "b", exclusive: true}, lexBound{inf: 1}}, "c", "d"},
+		{lexRange{lexBound{inf: 1}, lexBound{inf: -1}}, "", ""},
+	}
+	for _, c := range cases {
+		var first, last string
+		if n := zsl.firstInRange(c.r); n != nil {
+			first = n.member
+		}
+		if n := zsl.lastInRange(c.r); n != nil {
+			last = n.member
+		}
+		if first != c.first || last != c.last {
+			t.Fatalf("got %q-%q in %+v, want %q-%q", first, last, c.r, c.first, c.last)
+		}
+	}
+}
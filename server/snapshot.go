@@ -0,0 +1,627 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot file layout:
+//
+//	magic, version
+//	opSelectDB dbId
+//	[opExpireAt ttl] type key value
+//	...
+//	opEOF crc64
+//
+// Strings are stored as uvarint length followed by bytes,
+// numbers as little endian int64. Version 1 stored ttl
+// in seconds, since version 2 it is in milliseconds.
+// Sets are stored since version 3, sorted sets since
+// version 4 as members followed by float64 bits of scores.
+const snapshotMagic = "RLSNAP"
+const snapshotVersion = 4
+
+const (
+	typeString byte = 0
+	typeList   byte = 1
+	typeHash   byte = 2
+	typeSet    byte = 3
+	typeZSet   byte = 4
+
+	opExpireAt byte = 0xFC
+	opSelectDB byte = 0xFE
+	opEOF      byte = 0xFF
+)
+
+// maxSnapshotPrealloc limits room allocated for a string or
+// a container by its length before the items are read, as
+// lengths of a corrupted file are only checked by its CRC.
+const maxSnapshotPrealloc = 1024
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+var badSnapshotErr = errors.New("ERROR: snapshot file is corrupted")
+var bgsaveInProgressErr = errors.New("ERROR: background save already in progress")
+var noSnapshotFileErr = errors.New("ERROR: snapshot file is not configured")
+
+// snapshotPath returns full path of the snapshot
+// file of s or "" if snapshots are disabled.
+func (s *Server) snapshotPath() string {
+	if s.cfg.DbFilename == "" {
+		return ""
+	}
+	return filepath.Join(s.cfg.Dir, s.cfg.DbFilename)
+}
+
+// snapshotEntry is a copy of a key taken at snapshot time.
+type snapshotEntry struct {
+	key string
+	data
+}
+
+// snapshot copies all keys of dm with their ttl. Containers
+// aren't copied: while the snapshot is in use dm clones
+// them before any change, see unshare. release must be
+// called once the snapshot isn't needed anymore.
+func (dm *DataMap) snapshot() (entries []snapshotEntry, release func()) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	now := nowMs()
+	entries = make([]snapshotEntry, 0, len(dm.hash))
+	for key, d := range dm.hash {
+		if d.expired(now) {
+			continue
+		}
+		entries = append(entries, snapshotEntry{key: key, data: *d})
+	}
+	return entries, dm.holdSnapshot()
+}
+
+// snapshotKeys is like snapshot, but it copies
+// only keys which exist in dm.
+func (dm *DataMap) snapshotKeys(keys []string) (entries []snapshotEntry, release func()) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	now := nowMs()
+	for _, key := range keys {
+		if d, ok := dm.hash[key]; ok && !d.expired(now) {
+			entries = append(entries, snapshotEntry{key: key, data: *d})
+		}
+	}
+	return entries, dm.holdSnapshot()
+}
+
+// snapshotGens counts snapshots of all databases, so a
+// generation is never reused by another database which
+// values may be moved to.
+var snapshotGens uint64
+
+// holdSnapshot makes dm clone containers before changes until
+// release is called. It must be called with dm.mu held for writing.
+func (dm *DataMap) holdSnapshot() (release func()) {
+	dm.snapshots++
+	dm.snapGen = atomic.AddUint64(&snapshotGens, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			dm.mu.Lock()
+			dm.snapshots--
+			dm.mu.Unlock()
+		})
+	}
+}
+
+// unshare makes a private copy of a list or a map in d
+// if it may be referenced by an active snapshot. The copy
+// is made once after a snapshot, later changes go to it.
+// It must be called with dm.mu held before changing
+// the value in place.
+func (dm *DataMap) unshare(d *data) {
+	if dm.snapshots == 0 || d.cloned == dm.snapGen {
+		return
+	}
+	d.value = cloneValue(d.value)
+	d.cloned = dm.snapGen
+}
+
+// cloneValue returns a copy of value. Strings and
+// integers are immutable, so they aren't copied.
+func cloneValue(value interface{}) interface{} {
+	switch x := value.(type) {
+	case *list:
+		return x.clone()
+	case map[string]string:
+		dict := make(map[string]string, len(x))
+		for k, v := range x {
+			dict[k] = v
+		}
+		return dict
+	case map[string]struct{}:
+		set := make(map[string]struct{}, len(x))
+		for m := range x {
+			set[m] = struct{}{}
+		}
+		return set
+	case *zset:
+		return x.clone()
+	}
+	return value
+}
+
+// dbSnapshot is a point in time copy of a database.
+type dbSnapshot struct {
+	id      string
+	entries []snapshotEntry
+	release func()
+}
+
+// takeSnapshot takes a point in time copy of every database of s.
+func (s *Server) takeSnapshot() []dbSnapshot {
+	var dbs []dbSnapshot
+	for _, dm := range s.databases() {
+		entries, release := dm.snapshot()
+		dbs = append(dbs, dbSnapshot{id: dm.DbId, entries: entries, release: release})
+	}
+	return dbs
+}
+
+// snapshotWriter writes snapshot items and
+// calculates their checksum.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err != nil {
+		return
+	}
+	sw.crc = crc64.Update(sw.crc, crcTable, p)
+	_, sw.err = sw.w.Write(p)
+}
+
+func (sw *snapshotWriter) writeByte(b byte) { sw.write([]byte{b}) }
+
+func (sw *snapshotWriter) writeInt(n int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(n))
+	sw.write(buf[:])
+}
+
+func (sw *snapshotWriter) writeLen(n int) {
+	var buf [binary.MaxVarintLen64]byte
+	sw.write(buf[:binary.PutUvarint(buf[:], uint64(n))])
+}
+
+func (sw *snapshotWriter) writeString(s string) {
+	sw.writeLen(len(s))
+	sw.write([]byte(s))
+}
+
+// writeValue writes type and value of d.
+func (sw *snapshotWriter) writeValue(key string, d data) {
+	switch x := d.value.(type) {
+	case string:
+		sw.writeByte(typeString)
+		sw.writeString(key)
+		sw.writeString(x)
+	case int64:
+		sw.writeByte(typeString)
+		sw.writeString(key)
+		sw.writeString(strconv.FormatInt(x, 10))
+	case *list:
+		sw.writeByte(typeList)
+		sw.writeString(key)
+		sw.writeLen(x.len())
+		for i := 0; i < x.len(); i++ {
+			sw.writeString(x.at(i))
+		}
+	case map[string]string:
+		sw.writeByte(typeHash)
+		sw.writeString(key)
+		sw.writeLen(len(x))
+		for k, v := range x {
+			sw.writeString(k)
+			sw.writeString(v)
+		}
+	case map[string]struct{}:
+		sw.writeByte(typeSet)
+		sw.writeString(key)
+		sw.writeLen(len(x))
+		for m := range x {
+			sw.writeString(m)
+		}
+	case *zset:
+		sw.writeByte(typeZSet)
+		sw.writeString(key)
+		sw.writeLen(x.len())
+		for n := x.zsl.header.level[0].forward; n != nil; n = n.level[0].forward {
+			sw.writeString(n.member)
+			sw.writeInt(int64(math.Float64bits(n.score)))
+		}
+	}
+}
+
+// writeSnapshot encodes dbs to w.
+func writeSnapshot(w io.Writer, dbs []dbSnapshot) error {
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+	sw.write([]byte(snapshotMagic))
+	sw.writeByte(snapshotVersion)
+	for _, db := range dbs {
+		sw.writeByte(opSelectDB)
+		sw.writeString(db.id)
+		for _, e := range db.entries {
+			if e.value == nil {
+				continue
+			}
+			if e.ttl > 0 {
+				sw.writeByte(opExpireAt)
+				sw.writeInt(e.ttl)
+			}
+			sw.writeValue(e.key, e.data)
+		}
+	}
+	sw.writeByte(opEOF)
+	if sw.err != nil {
+		return sw.err
+	}
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], sw.crc)
+	if _, err := sw.w.Write(sum[:]); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// saveSnapshot writes dbs of s to path. The file is written
+// under a temporary name and then renamed, so
+// an existing snapshot is never left half written.
+func (s *Server) saveSnapshot(path string, dbs []dbSnapshot) error {
+	defer func() {
+		for _, db := range dbs {
+			db.release()
+		}
+	}()
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(f, dbs); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	atomic.StoreInt64(&s.lastSave, time.Now().UTC().Unix())
+	return nil
+}
+
+// Save synchronously saves all databases of s to the snapshot file.
+func (s *Server) Save() error {
+	path := s.snapshotPath()
+	if path == "" {
+		return noSnapshotFileErr
+	}
+	return s.saveSnapshot(path, s.takeSnapshot())
+}
+
+// BGSave saves all databases of s to the snapshot file in
+// background. Databases are locked only while their
+// keys are copied, not while the file is written.
+func (s *Server) BGSave() error {
+	path := s.snapshotPath()
+	if path == "" {
+		return noSnapshotFileErr
+	}
+	if !atomic.CompareAndSwapInt32(&s.bgsaveInProgress, 0, 1) {
+		return bgsaveInProgressErr
+	}
+	dbs := s.takeSnapshot()
+	go func() {
+		defer atomic.StoreInt32(&s.bgsaveInProgress, 0)
+		if err := s.saveSnapshot(path, dbs); err != nil {
+			log.Printf("background saving error: %v\n", err)
+			return
+		}
+		log.Printf("background saving terminated with success\n")
+	}()
+	return nil
+}
+
+// snapshotReader reads snapshot items and
+// calculates their checksum.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (sr *snapshotReader) read(n int) ([]byte, error) {
+	if n > maxSnapshotPrealloc {
+		// the buffer grows while the data is read
+		buf, err := io.ReadAll(io.LimitReader(sr.r, int64(n)))
+		if err != nil || len(buf) != n {
+			return nil, badSnapshotErr
+		}
+		sr.crc = crc64.Update(sr.crc, crcTable, buf)
+		return buf, nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, buf); err != nil {
+		return nil, badSnapshotErr
+	}
+	sr.crc = crc64.Update(sr.crc, crcTable, buf)
+	return buf, nil
+}
+
+func (sr *snapshotReader) readByte() (byte, error) {
+	buf, err := sr.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (sr *snapshotReader) readInt() (int64, error) {
+	buf, err := sr.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (sr *snapshotReader) readLen() (int, error) {
+	var n uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := sr.readByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			if n > maxBulkLen {
+				return 0, badSnapshotErr
+			}
+			return int(n), nil
+		}
+	}
+	return 0, badSnapshotErr
+}
+
+func (sr *snapshotReader) readString() (string, error) {
+	n, err := sr.readLen()
+	if err != nil {
+		return "", err
+	}
+	buf, err := sr.read(n)
+	return string(buf), err
+}
+
+// preallocLen returns capacity to allocate for n items
+// read from a snapshot.
+func preallocLen(n int) int {
+	if n > maxSnapshotPrealloc {
+		return maxSnapshotPrealloc
+	}
+	return n
+}
+
+func (sr *snapshotReader) readStrings(n int) ([]string, error) {
+	res := make([]string, 0, preallocLen(n))
+	for i := 0; i < n; i++ {
+		s, err := sr.readString()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// readValue reads a value of type t.
+func (sr *snapshotReader) readValue(t byte) (interface{}, error) {
+	switch t {
+	case typeString:
+		s, err := sr.readString()
+		if err != nil {
+			return nil, err
+		}
+		return stringValue(s), nil
+	case typeList:
+		n, err := sr.readLen()
+		if err != nil {
+			return nil, err
+		}
+		items, err := sr.readStrings(n)
+		if err != nil {
+			return nil, err
+		}
+		return newList(items), nil
+	case typeHash:
+		n, err := sr.readLen()
+		if err != nil {
+			return nil, err
+		}
+		items, err := sr.readStrings(n * 2)
+		if err != nil {
+			return nil, err
+		}
+		dict := make(map[string]string, len(items)/2)
+		for i := 0; i < len(items); i += 2 {
+			dict[items[i]] = items[i+1]
+		}
+		return dict, nil
+	case typeSet:
+		n, err := sr.readLen()
+		if err != nil {
+			return nil, err
+		}
+		members, err := sr.readStrings(n)
+		if err != nil {
+			return nil, err
+		}
+		set := make(map[string]struct{}, len(members))
+		for _, m := range members {
+			set[m] = struct{}{}
+		}
+		return set, nil
+	case typeZSet:
+		n, err := sr.readLen()
+		if err != nil {
+			return nil, err
+		}
+		z := newZset()
+		for i := 0; i < n; i++ {
+			member, err := sr.readString()
+			if err != nil {
+				return nil, err
+			}
+			bits, err := sr.readInt()
+			if err != nil {
+				return nil, err
+			}
+			z.set(member, math.Float64frombits(uint64(bits)))
+		}
+		return z, nil
+	default:
+		return nil, badSnapshotErr
+	}
+}
+
+// readSnapshot decodes databases from r.
+// Keys which are already expired are skipped.
+func readSnapshot(r io.Reader) (map[string]map[string]*data, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+	header, err := sr.read(len(snapshotMagic) + 1)
+	if err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, badSnapshotErr
+	}
+	version := header[len(snapshotMagic)]
+	if version < 1 || version > snapshotVersion {
+		return nil, fmt.Errorf("ERROR: unsupported snapshot version %d", version)
+	}
+	now := nowMs()
+	dbs := make(map[string]map[string]*data)
+	var db map[string]*data
+	var ttl int64
+	for {
+		op, err := sr.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opEOF:
+			sum := sr.crc
+			buf, err := sr.read(8)
+			if err != nil || binary.LittleEndian.Uint64(buf) != sum {
+				return nil, badSnapshotErr
+			}
+			return dbs, nil
+		case opSelectDB:
+			id, err := sr.readString()
+			if err != nil {
+				return nil, err
+			}
+			if db = dbs[id]; db == nil {
+				db = make(map[string]*data)
+				dbs[id] = db
+			}
+			continue
+		case opExpireAt:
+			if ttl, err = sr.readInt(); err != nil {
+				return nil, err
+			}
+			if version == 1 {
+				ttl *= 1000
+			}
+			continue
+		}
+		if db == nil {
+			return nil, badSnapshotErr
+		}
+		key, err := sr.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := sr.readValue(op)
+		if err != nil {
+			return nil, err
+		}
+		if ttl == 0 || ttl > now {
+			db[key] = &data{ttl: ttl, value: value}
+		}
+		ttl = 0
+	}
+}
+
+// loadSnapshot loads databases of s from the snapshot
+// file. It is not an error if the file doesn't exist.
+func (s *Server) loadSnapshot() error {
+	path := s.snapshotPath()
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dbs, err := readSnapshot(f)
+	if err != nil {
+		return err
+	}
+	for id, keys := range dbs {
+		dm, err := s.db(id)
+		if err != nil {
+			return fmt.Errorf("ERROR: bad database %q in snapshot: %v", id, err)
+		}
+		dm.mu.Lock()
+		dm.load(keys)
+		dm.mu.Unlock()
+	}
+	return nil
+}
+
+// load puts keys read from a snapshot to dm. It
+// must be called with dm.mu held for writing.
+func (dm *DataMap) load(keys map[string]*data) {
+	for key, d := range keys {
+		dm.delete(key)
+		d.atime, d.freq = nowMs(), lfuInitVal
+		dm.hash[key] = d
+		dm.keys.add(key)
+		dm.resize(key, d)
+		dm.modified(d)
+		if d.ttl > 0 {
+			dm.setTTL(key, d, d.ttl)
+		}
+	}
+}
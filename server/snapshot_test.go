@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.DbId = "test"
+	future := nowMs() + 100000
+	dm.hash["str"] = &data{value: "hello world", ttl: future}
+	dm.hash["list"] = &data{value: newList([]string{"one", "two"})}
+	dm.hash["dict"] = &data{value: map[string]string{"hello": "world"}}
+	dm.hash["set"] = &data{value: map[string]struct{}{"member": {}}}
+	zs := newZset()
+	zs.set("member", 1.5)
+	dm.hash["zset"] = &data{value: zs}
+	dm.hash["expired"] = &data{value: "bye", ttl: 1}
+	entries, release := dm.snapshot()
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, []dbSnapshot{{id: dm.DbId, entries: entries, release: release}}); err != nil {
+		t.Fatalf("writeSnapshot error: %v", err)
+	}
+	release()
+	if dm.snapshots != 0 {
+		t.Fatalf("got %d active snapshots after release, want 0", dm.snapshots)
+	}
+	dbs, err := readSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("readSnapshot error: %v", err)
+	}
+	db := dbs["test"]
+	if len(db) != 5 {
+		t.Fatalf("got %d keys, want 5", len(db))
+	}
+	if db["str"].value != "hello world" || db["str"].ttl != future {
+		t.Fatalf("got %+v for 'str' key", db["str"])
+	}
+	if fmt.Sprintf("%v", db["list"].value) != "[one two]" {
+		t.Fatalf("got %v for 'list' key", db["list"].value)
+	}
+	if fmt.Sprintf("%v", db["dict"].value) != "map[hello:world]" {
+		t.Fatalf("got %v for 'dict' key", db["dict"].value)
+	}
+	if fmt.Sprintf("%v", db["set"].value) != "map[member:{}]" {
+		t.Fatalf("got %v for 'set' key", db["set"].value)
+	}
+	if zs, ok := db["zset"].value.(*zset); !ok || zs.dict["member"] != 1.5 || zs.zsl.length != 1 {
+		t.Fatalf("got %v for 'zset' key", db["zset"].value)
+	}
+}
+
+func TestReadSnapshotExpired(t *testing.T) {
+	entries := []snapshotEntry{{key: "old", data: data{value: "bye", ttl: 1}}}
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, []dbSnapshot{{id: "0", entries: entries}}); err != nil {
+		t.Fatalf("writeSnapshot error: %v", err)
+	}
+	dbs, err := readSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("readSnapshot error: %v", err)
+	}
+	if len(dbs["0"]) != 0 {
+		t.Fatalf("expired key should be dropped on load, got %v", dbs["0"])
+	}
+}
+
+func TestReadSnapshotCorrupted(t *testing.T) {
+	entries := []snapshotEntry{{key: "str", data: data{value: "hello"}}}
+	var buf bytes.Buffer
+	writeSnapshot(&buf, []dbSnapshot{{id: "0", entries: entries}})
+	b := buf.Bytes()
+	b[len(b)-12] ^= 0xff
+	if _, err := readSnapshot(bytes.NewReader(b)); err != badSnapshotErr {
+		t.Fatalf("got '%v', want '%v'", err, badSnapshotErr)
+	}
+	if _, err := readSnapshot(bytes.NewReader([]byte("garbage"))); err != badSnapshotErr {
+		t.Fatalf("got '%v', want '%v'", err, badSnapshotErr)
+	}
+}
+
+func TestReadSnapshotHugeLength(t *testing.T) {
+	// a length of 1<<28 items or bytes which aren't there
+	huge := []byte{0x80, 0x80, 0x80, 0x80, 0x01}
+	for _, typ := range []byte{typeString, typeList, typeHash, typeSet} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		sr := &snapshotReader{r: bufio.NewReader(bytes.NewReader(huge))}
+		if _, err := sr.readValue(typ); err != badSnapshotErr {
+			t.Fatalf("got '%v' for type %d, want '%v'", err, typ, badSnapshotErr)
+		}
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Fatalf("got %d bytes allocated for type %d, want the length not trusted", n, typ)
+		}
+	}
+}
+
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.hash["list"] = &data{value: newList([]string{"one", "two"})}
+	dm.hash["dict"] = &data{value: map[string]string{"hello": "world"}}
+	entries, release := dm.snapshot()
+	defer release()
+	dm.LUpdate("list", 0, "ten")
+	dm.HUpdate("dict", "hello", "bye")
+	for _, e := range entries {
+		got := fmt.Sprintf("%v", e.value)
+		if got != "[one two]" && got != "map[hello:world]" {
+			t.Fatalf("snapshot value of %q key has been changed: %s", e.key, got)
+		}
+	}
+	// the value is cloned once after the snapshot
+	cloned := dm.hash["list"].value
+	dm.LUpdate("list", 1, "eleven")
+	if dm.hash["list"].value != cloned {
+		t.Fatal("value is cloned again by the second change")
+	}
+	_, release2 := dm.snapshot()
+	defer release2()
+	dm.LUpdate("list", 1, "twelve")
+	if dm.hash["list"].value == cloned {
+		t.Fatal("value shared by a new snapshot isn't cloned")
+	}
+	if got := fmt.Sprint(cloned); got != "[ten eleven]" {
+		t.Fatalf("snapshot value has been changed: %s", got)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	cfg := Config{Dir: t.TempDir(), DbFilename: "dump.rls"}
+	s := newTestServer(t, cfg)
+	s.getDb("8").Set("key", "value")
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save error: %v", err)
+	}
+	// the data is loaded by a new server
+	dm := newTestServer(t, cfg).getDb("8")
+	if got, err := dm.Get("key"); err != nil || got != "value" {
+		t.Fatalf("got %q, %v after load, want 'value'", got, err)
+	}
+}
@@ -0,0 +1,599 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxStringSize is the maximum length of a string value.
+const maxStringSize = 512 << 20
+
+var offsetRangeErr = errors.New("ERROR: offset is out of range")
+var stringSizeErr = errors.New("ERROR: string exceeds maximum allowed size")
+
+// lookupString gets data with string stored by key and the
+// string. It returns nil data if key not exists. It must be
+// called with dm.mu held for writing.
+func (dm *DataMap) lookupString(key string) (*data, string, error) {
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		return nil, "", nil
+	}
+	s, err := d.SGet()
+	if err != nil {
+		return nil, "", err
+	}
+	return d, s, nil
+}
+
+// putString stores value, a string or an int64, by key
+// keeping its ttl. d is data stored by key or nil. It
+// must be called with dm.mu held for writing.
+func (dm *DataMap) putString(key string, d *data, value interface{}) {
+	if d == nil {
+		d = dm.create(key)
+	}
+	d.value = value
+	dm.resize(key, d)
+	dm.modified(d)
+}
+
+// IncrBy increments integer stored in dm by key by incr and
+// returns the new value. A missing key is 0. Returns error
+// if key contains another type, the value is not an integer
+// or the result overflows.
+func (dm *DataMap) IncrBy(key string, incr int64) (int64, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, ok := dm.lookupWrite(key)
+	var n int64
+	if ok {
+		if x, isInt := d.value.(int64); isInt {
+			n = x
+		} else {
+			s, err := d.SGet()
+			if err != nil {
+				return 0, err
+			}
+			if n, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return 0, notIntegerErr
+			}
+		}
+	} else {
+		d = nil
+	}
+	if incr > 0 && n > math.MaxInt64-incr || incr < 0 && n < math.MinInt64-incr {
+		return 0, overflowErr
+	}
+	n += incr
+	dm.putString(key, d, n)
+	return n, nil
+}
+
+// IncrByFloat increments float stored in dm by key by incr
+// and returns the new value. A missing key is 0. Returns
+// error if key contains another type, the value is not a
+// float or the result is not a finite number.
+func (dm *DataMap) IncrByFloat(key string, incr float64) (float64, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, s, err := dm.lookupString(key)
+	if err != nil {
+		return 0, err
+	}
+	var f float64
+	if d != nil {
+		if f, err = strconv.ParseFloat(s, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, notFloatErr
+		}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, nanOrInfErr
+	}
+	dm.putString(key, d, stringValue(formatFloat(f)))
+	return f, nil
+}
+
+// Append appends value to string in dm by key and returns
+// the new length of the string. The string is created if
+// key not exists. Returns error if key contains another type.
+func (dm *DataMap) Append(key, value string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, s, err := dm.lookupString(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(s)+len(value) > maxStringSize {
+		return 0, stringSizeErr
+	}
+	s += value
+	dm.putString(key, d, stringValue(s))
+	return len(s), nil
+}
+
+// StrLen gets length of string in dm by key.
+// Returns error if key contains another type.
+func (dm *DataMap) StrLen(key string) (int, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	d, ok := dm.lookup(key)
+	if !ok {
+		return 0, nil
+	}
+	s, err := d.SGet()
+	return len(s), err
+}
+
+// GetRange gets substring of string in dm by key from start
+// to end inclusive. Negative offsets count from the end of
+// the string. Returns error if key contains another type.
+func (dm *DataMap) GetRange(key string, start, end int) (string, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	d, ok := dm.lookup(key)
+	if !ok {
+		return "", nil
+	}
+	s, err := d.SGet()
+	if err != nil {
+		return "", err
+	}
+	start, end, ok = listRange(start, end, len(s))
+	if !ok {
+		return "", nil
+	}
+	return s[start : end+1], nil
+}
+
+// SetRange overwrites string in dm by key from offset with
+// value and returns the new length of the string. The string
+// is padded with zero bytes if it is shorter than offset and
+// created if key not exists. Returns error if key contains
+// another type or offset is out of range.
+func (dm *DataMap) SetRange(key string, offset int, value string) (int, error) {
+	if offset < 0 {
+		return 0, offsetRangeErr
+	}
+	if offset > maxStringSize-len(value) {
+		return 0, stringSizeErr
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, s, err := dm.lookupString(key)
+	if err != nil || len(value) == 0 {
+		return len(s), err
+	}
+	b := []byte(s)
+	if end := offset + len(value); end > len(b) {
+		b = append(b, make([]byte, end-len(b))...)
+	}
+	copy(b[offset:], value)
+	dm.putString(key, d, stringValue(string(b)))
+	return len(b), nil
+}
+
+// GetDel gets string in dm by key and removes the key.
+// Returns error if key not exists or contains another type.
+func (dm *DataMap) GetDel(key string) (string, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, s, err := dm.lookupString(key)
+	if err != nil {
+		return "", err
+	}
+	if d == nil {
+		return "", keyNotExistErr
+	}
+	dm.delete(key)
+	return s, nil
+}
+
+// GetSet sets string in dm by key to value removing its ttl
+// and returns the old string. Returns error if key not
+// exists, but the string is set anyway, or if key contains
+// another type.
+func (dm *DataMap) GetSet(key, value string) (string, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, s, err := dm.lookupString(key)
+	if err != nil {
+		return "", err
+	}
+	dm.setString(key, d, value, 0, false)
+	if d == nil {
+		return "", keyNotExistErr
+	}
+	return s, nil
+}
+
+// GetEx gets string in dm by key and sets its ttl as unix
+// time in milliseconds. Zero ttl makes the key persistent,
+// negative one leaves the ttl as it is. Returns error if key
+// not exists or contains another type.
+func (dm *DataMap) GetEx(key string, ttl int64) (string, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, s, err := dm.lookupString(key)
+	if err != nil {
+		return "", err
+	}
+	if d == nil {
+		return "", keyNotExistErr
+	}
+	if ttl >= 0 {
+		dm.setTTL(key, d, ttl)
+	}
+	return s, nil
+}
+
+// parseGetExTTL parses options of GETEX key [EX seconds |
+// PX milliseconds | EXAT timestamp | PXAT timestamp |
+// PERSIST] to ttl accepted by GetEx.
+func parseGetExTTL(args []string) (int64, error) {
+	if len(args) == 0 {
+		return -1, nil
+	}
+	if strings.ToLower(args[0]) == "persist" {
+		if len(args) > 1 {
+			return 0, syntaxErr
+		}
+		return 0, nil
+	}
+	if len(args) != 2 {
+		return 0, syntaxErr
+	}
+	return parseTTL(args[0], args[1])
+}
+
+// parseTTL parses ttl option EX, PX, EXAT or PXAT with
+// its value to unix time in milliseconds.
+func parseTTL(option, value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, notIntegerErr
+	}
+	option = strings.ToLower(option)
+	switch option {
+	case "ex", "exat":
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return 0, wrongDurationErr
+		}
+		n *= 1000
+	case "px", "pxat":
+	default:
+		return 0, syntaxErr
+	}
+	now := nowMs()
+	if option == "ex" || option == "px" {
+		if n <= 0 || n > math.MaxInt64-now {
+			return 0, wrongDurationErr
+		}
+		n += now
+	}
+	if n <= now {
+		return 0, pastTTLErr
+	}
+	return n, nil
+}
+
+// setOptions are options of SET command.
+type setOptions struct {
+	ttl     int64 // unix time in milliseconds, 0 means no ttl
+	keepTTL bool  // keep the current ttl of the key
+	nx      bool  // set only if the key not exists
+	xx      bool  // set only if the key exists
+	get     bool  // return the old string
+}
+
+// parseSetOptions parses options of SET key value [NX | XX]
+// [GET] [EX seconds | PX milliseconds | EXAT timestamp |
+// PXAT timestamp | KEEPTTL].
+func parseSetOptions(args []string) (setOptions, error) {
+	var opts setOptions
+	hasTTL := false
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); option {
+		case "nx", "xx":
+			if opts.nx || opts.xx {
+				return opts, syntaxErr
+			}
+			opts.nx = option == "nx"
+			opts.xx = option == "xx"
+		case "get":
+			opts.get = true
+		case "keepttl":
+			if hasTTL {
+				return opts, syntaxErr
+			}
+			opts.keepTTL, hasTTL = true, true
+		case "ex", "px", "exat", "pxat":
+			if hasTTL || i+1 == len(args) {
+				return opts, syntaxErr
+			}
+			ttl, err := parseTTL(option, args[i+1])
+			if err != nil {
+				return opts, err
+			}
+			opts.ttl, hasTTL = ttl, true
+			i++
+		default:
+			return opts, syntaxErr
+		}
+	}
+	return opts, nil
+}
+
+// setString sets string in dm by key to value with ttl as
+// unix time in milliseconds, zero ttl makes the key
+// persistent. The current ttl is kept if keepTTL is set.
+// d is data stored by key or nil. It must be called with
+// dm.mu held for writing.
+func (dm *DataMap) setString(key string, d *data, value string, ttl int64, keepTTL bool) {
+	if d == nil {
+		d = dm.create(key)
+	}
+	dm.putString(key, d, stringValue(value))
+	if !keepTTL {
+		dm.setTTL(key, d, ttl)
+	}
+}
+
+// SetWith sets string in dm by key to value according to
+// opts. It returns the old string or nil if key not exists
+// and reports whether the string has been set. Returns
+// error if key contains another type.
+func (dm *DataMap) SetWith(key, value string, opts setOptions) (interface{}, bool, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, s, err := dm.lookupString(key)
+	exists := d != nil
+	if err == typeMismatchErr && opts.nx && !opts.get {
+		// the key exists, so nothing is set
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var old interface{}
+	if exists {
+		old = s
+	}
+	if exists && opts.nx || !exists && opts.xx {
+		return old, false, nil
+	}
+	dm.setString(key, d, value, opts.ttl, opts.keepTTL)
+	return old, true, nil
+}
+
+// MSet sets strings in dm by keys to values given as pairs
+// of keys and values. Returns error if any key contains
+// another type, nothing is set then.
+func (dm *DataMap) MSet(pairs ...string) error {
+	_, err := dm.mset(pairs, false)
+	return err
+}
+
+// MSetNX sets strings in dm by keys to values given as
+// pairs of keys and values if none of the keys exists and
+// reports whether they have been set.
+func (dm *DataMap) MSetNX(pairs ...string) (bool, error) {
+	return dm.mset(pairs, true)
+}
+
+// mset sets strings of pairs in dm, if nx is set only when
+// none of the keys exists, and reports whether they have
+// been set.
+func (dm *DataMap) mset(pairs []string, nx bool) (bool, error) {
+	if len(pairs)%2 != 0 {
+		return false, missValueErr
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for i := 0; i < len(pairs); i += 2 {
+		d, ok := dm.lookupWrite(pairs[i])
+		if ok && nx {
+			return false, nil
+		}
+		if ok {
+			if _, err := d.SGet(); err != nil {
+				return false, err
+			}
+		}
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		d, _, _ := dm.lookupString(pairs[i])
+		dm.setString(pairs[i], d, pairs[i+1], 0, false)
+	}
+	return true, nil
+}
+
+// MGet gets strings from dm by keys. Values of missing
+// keys and keys with another type are nil.
+func (dm *DataMap) MGet(keys ...string) []interface{} {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	res := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if d, ok := dm.lookup(key); ok {
+			if s, err := d.SGet(); err == nil {
+				res[i] = s
+			}
+		}
+	}
+	return res
+}
+
+// stringCommand runs string command cmd with key and args in dm.
+func stringCommand(dm *DataMap, cmd, key string, args []string) (interface{}, error) {
+	switch cmd {
+	case "incr", "decr", "strlen", "getdel":
+		if len(args) > 0 {
+			return nil, manyArgsErr
+		}
+		switch cmd {
+		case "incr":
+			return dm.IncrBy(key, 1)
+		case "decr":
+			return dm.IncrBy(key, -1)
+		case "strlen":
+			return dm.StrLen(key)
+		}
+		s, err := dm.GetDel(key)
+		if err == keyNotExistErr {
+			return nil, nil
+		}
+		return s, err
+	case "incrby", "decrby", "incrbyfloat", "append", "getset":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		switch cmd {
+		case "append":
+			return dm.Append(key, args[0])
+		case "getset":
+			s, err := dm.GetSet(key, args[0])
+			if err == keyNotExistErr {
+				return nil, nil
+			}
+			return s, err
+		case "incrbyfloat":
+			incr, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+				return nil, notFloatErr
+			}
+			f, err := dm.IncrByFloat(key, incr)
+			if err != nil {
+				return nil, err
+			}
+			return formatFloat(f), nil
+		}
+		incr, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil, notIntegerErr
+		}
+		if cmd == "decrby" {
+			if incr == math.MinInt64 {
+				return nil, overflowErr
+			}
+			incr = -incr
+		}
+		return dm.IncrBy(key, incr)
+	case "getrange", "setrange":
+		if len(args) < 2 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		if cmd == "setrange" {
+			offset, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, notIntegerErr
+			}
+			return dm.SetRange(key, offset, args[1])
+		}
+		start, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, notIntegerErr
+		}
+		end, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, notIntegerErr
+		}
+		return dm.GetRange(key, start, end)
+	case "set":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		opts, err := parseSetOptions(args[1:])
+		if err != nil {
+			return nil, err
+		}
+		old, ok, err := dm.SetWith(key, args[0], opts)
+		switch {
+		case err != nil:
+			return nil, err
+		case opts.get:
+			return old, nil
+		case ok:
+			return okReply, nil
+		}
+		return nil, nil
+	case "setnx":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		_, ok, err := dm.SetWith(key, args[0], setOptions{nx: true})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return 1, nil
+		}
+		return 0, nil
+	case "setex", "psetex":
+		if len(args) < 2 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		dur, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil, notIntegerErr
+		}
+		if cmd == "setex" {
+			if dur <= 0 || dur > math.MaxInt64/1000 {
+				return nil, wrongDurationErr
+			}
+			dur *= 1000
+		}
+		if err := dm.PSetEx(key, dur, args[1]); err != nil {
+			return nil, err
+		}
+		return okReply, nil
+	case "mset", "msetnx":
+		pairs := append([]string{key}, args...)
+		if len(pairs)%2 != 0 {
+			return nil, missValueErr
+		}
+		if cmd == "mset" {
+			if err := dm.MSet(pairs...); err != nil {
+				return nil, err
+			}
+			return okReply, nil
+		}
+		ok, err := dm.MSetNX(pairs...)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return 1, nil
+		}
+		return 0, nil
+	case "mget":
+		return dm.MGet(append([]string{key}, args...)...), nil
+	case "getex":
+		ttl, err := parseGetExTTL(args)
+		if err != nil {
+			return nil, err
+		}
+		s, err := dm.GetEx(key, ttl)
+		if err == keyNotExistErr {
+			return nil, nil
+		}
+		return s, err
+	default:
+		return nil, unknownCmdErr
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestStringValue(t *testing.T) {
+	cases := []struct {
+		s    string
+		want interface{}
+	}{
+		{"123", int64(123)},
+		{"-5", int64(-5)},
+		{"007", "007"},
+		{"+1", "+1"},
+		{"1.5", "1.5"},
+		{"", ""},
+		{"99999999999999999999", "99999999999999999999"},
+	}
+	for _, c := range cases {
+		if got := stringValue(c.s); got != c.want {
+			t.Fatalf("stringValue(%q) = %#v, want %#v", c.s, got, c.want)
+		}
+	}
+	var d data
+	d.SSet("42")
+	if s, err := d.SGet(); err != nil || s != "42" {
+		t.Fatalf("SGet = %q, %v, want 42", s, err)
+	}
+}
+
+func TestMapIncr(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if n, err := dm.IncrBy("counter", 5); err != nil || n != 5 {
+		t.Fatalf("IncrBy = %d, %v, want 5", n, err)
+	}
+	if n, _ := dm.IncrBy("counter", -7); n != -2 {
+		t.Fatalf("got %d, want -2", n)
+	}
+	if s, _ := dm.Get("counter"); s != "-2" {
+		t.Fatalf("got %q, want -2", s)
+	}
+	dm.Set("big", "9223372036854775807")
+	if _, err := dm.IncrBy("big", 1); err != overflowErr {
+		t.Fatalf("got '%v', expected '%v' error", err, overflowErr)
+	}
+	dm.Set("text", "hello")
+	if _, err := dm.IncrBy("text", 1); err != notIntegerErr {
+		t.Fatalf("got '%v', expected '%v' error", err, notIntegerErr)
+	}
+	if _, err := dm.IncrByFloat("text", 1); err != notFloatErr {
+		t.Fatalf("got '%v', expected '%v' error", err, notFloatErr)
+	}
+	dm.LSet("list", []string{"a"})
+	if _, err := dm.IncrBy("list", 1); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+	if f, err := dm.IncrByFloat("counter", 2.5); err != nil || f != 0.5 {
+		t.Fatalf("IncrByFloat = %v, %v, want 0.5", f, err)
+	}
+	if _, err := dm.IncrBy("counter", 1); err != notIntegerErr {
+		t.Fatalf("got '%v', expected '%v' error", err, notIntegerErr)
+	}
+	dm.PSetEx("ttl", 100000, "1")
+	dm.IncrBy("ttl", 1)
+	if dm.deadline("ttl") == 0 {
+		t.Fatal("INCR shouldn't reset ttl")
+	}
+}
+
+func TestMapStringRanges(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if n, _ := dm.Append("str", "Hello"); n != 5 {
+		t.Fatalf("got length %d, want 5", n)
+	}
+	if n, _ := dm.Append("str", " World"); n != 11 {
+		t.Fatalf("got length %d, want 11", n)
+	}
+	cases := []struct {
+		start, end int
+		want       string
+	}{
+		{0, 4, "Hello"},
+		{-5, -1, "World"},
+		{-100, 100, "Hello World"},
+		{5, 3, ""},
+	}
+	for _, c := range cases {
+		if got, _ := dm.GetRange("str", c.start, c.end); got != c.want {
+			t.Fatalf("GetRange(%d, %d) = %q, want %q", c.start, c.end, got, c.want)
+		}
+	}
+	if n, _ := dm.SetRange("str", 6, "Redis"); n != 11 {
+		t.Fatalf("got length %d, want 11", n)
+	}
+	if s, _ := dm.Get("str"); s != "Hello Redis" {
+		t.Fatalf("got %q, want 'Hello Redis'", s)
+	}
+	if n, _ := dm.SetRange("padded", 3, "x"); n != 4 {
+		t.Fatalf("got length %d, want 4", n)
+	}
+	if s, _ := dm.Get("padded"); s != "\x00\x00\x00x" {
+		t.Fatalf("got %q, want zero padding", s)
+	}
+	if _, err := dm.SetRange("str", -1, "x"); err != offsetRangeErr {
+		t.Fatalf("got '%v', expected '%v' error", err, offsetRangeErr)
+	}
+	if _, err := dm.SetRange("str", math.MaxInt64, "x"); err != stringSizeErr {
+		t.Fatalf("got '%v', expected '%v' error", err, stringSizeErr)
+	}
+	if n, _ := dm.SetRange("missing", 5, ""); n != 0 {
+		t.Fatalf("got length %d, want 0", n)
+	}
+	if n, _ := dm.StrLen("missing"); n != 0 {
+		t.Fatalf("got length %d, missing key shouldn't be created", n)
+	}
+	dm.Set("number", "12")
+	dm.Append("number", "3")
+	if n, _ := dm.StrLen("number"); n != 3 {
+		t.Fatalf("got length %d, want 3", n)
+	}
+}
+
+func TestMapGetAndChange(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if _, err := dm.GetSet("key", "one"); err != keyNotExistErr {
+		t.Fatalf("got '%v', expected '%v' error", err, keyNotExistErr)
+	}
+	if s, _ := dm.GetSet("key", "two"); s != "one" {
+		t.Fatalf("got %q, want 'one'", s)
+	}
+	ttl := nowMs() + 100000
+	if s, err := dm.GetEx("key", ttl); err != nil || s != "two" {
+		t.Fatalf("GetEx = %q, %v, want 'two'", s, err)
+	}
+	if dm.deadline("key") != ttl {
+		t.Fatalf("got ttl %d, want %d", dm.deadline("key"), ttl)
+	}
+	dm.GetEx("key", 0)
+	if dm.deadline("key") != 0 {
+		t.Fatal("GETEX PERSIST should reset ttl")
+	}
+	if s, _ := dm.GetDel("key"); s != "two" {
+		t.Fatalf("got %q, want 'two'", s)
+	}
+	if _, err := dm.GetDel("key"); err != keyNotExistErr {
+		t.Fatalf("got '%v', expected '%v' error", err, keyNotExistErr)
+	}
+	for _, args := range [][]string{{"ex"}, {"ex", "0"}, {"px", "x"}, {"exat", "1"}, {"keep"}} {
+		if _, err := parseGetExTTL(args); err == nil {
+			t.Fatalf("parseGetExTTL(%v) should fail", args)
+		}
+	}
+}
+
+func TestStringDataHandlers(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if res, _ := DataHandler(&dm, "incr", []string{"n"}); res != "1" {
+		t.Fatalf("got %s, want 1", res)
+	}
+	if res, _ := DataHandler(&dm, "decrby", []string{"n", "3"}); res != "-2" {
+		t.Fatalf("got %s, want -2", res)
+	}
+	if _, err := DataHandler(&dm, "decrby", []string{"n", "-9223372036854775808"}); err != overflowErr {
+		t.Fatalf("got '%v', want: '%v'", err, overflowErr)
+	}
+	if res, _ := DataHandler(&dm, "incrbyfloat", []string{"n", "0.1"}); res != "-1.9" {
+		t.Fatalf("got %s, want -1.9", res)
+	}
+	if res, _ := DataHandler(&dm, "getdel", []string{"missing"}); res != "(nil)" {
+		t.Fatalf("got %s, want (nil)", res)
+	}
+	if res, _ := DataHandler(&dm, "getrange", []string{"n", "0", "1"}); res != "-1" {
+		t.Fatalf("got %s, want -1", res)
+	}
+
+	dm.PSetEx("f", 100000, "1")
+	res, _ := execute(&dm, "incrbyfloat", []string{"f", "1.5"})
+	got := aofCommands(&dm, "incrbyfloat", []string{"f", "1.5"}, res)
+	want := [][]string{{"set", "f", "2.5"}, pexpireatCommand(&dm, "f")}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v logged, want %v", got, want)
+	}
+	res, _ = execute(&dm, "getex", []string{"f", "persist"})
+	if got := aofCommands(&dm, "getex", []string{"f", "persist"}, res); fmt.Sprint(got) != "[[persist f]]" {
+		t.Fatalf("got %v logged, want PERSIST", got)
+	}
+	res, _ = execute(&dm, "getex", []string{"f"})
+	if got := aofCommands(&dm, "getex", []string{"f"}, res); len(got) != 0 {
+		t.Fatalf("got %v logged, GETEX without options shouldn't be logged", got)
+	}
+}
+
+func TestParseSetOptions(t *testing.T) {
+	opts, err := parseSetOptions([]string{"NX", "get", "px", "1000"})
+	if err != nil || !opts.nx || !opts.get || opts.ttl <= nowMs() {
+		t.Fatalf("parseSetOptions = %+v, %v", opts, err)
+	}
+	for _, args := range [][]string{
+		{"nx", "xx"}, {"ex", "1", "px", "1"}, {"ex", "1", "keepttl"},
+		{"ex"}, {"ex", "0"}, {"pxat", "1"}, {"keep"},
+	} {
+		if _, err := parseSetOptions(args); err == nil {
+			t.Fatalf("parseSetOptions(%v) should fail", args)
+		}
+	}
+}
+
+func TestMapSetWith(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if old, ok, err := dm.SetWith("key", "one", setOptions{xx: true}); err != nil || ok || old != nil {
+		t.Fatalf("SetWith XX = %v, %v, %v, missing key shouldn't be set", old, ok, err)
+	}
+	if _, ok, _ := dm.SetWith("key", "one", setOptions{nx: true, ttl: nowMs() + 100000}); !ok {
+		t.Fatal("missing key should be set with NX")
+	}
+	if old, ok, _ := dm.SetWith("key", "two", setOptions{nx: true}); ok || old != "one" {
+		t.Fatalf("got %v, %v, existing key shouldn't be set with NX", old, ok)
+	}
+	dm.SetWith("key", "two", setOptions{keepTTL: true})
+	if dm.deadline("key") == 0 {
+		t.Fatal("KEEPTTL should keep ttl")
+	}
+	dm.Set("key", "three")
+	if dm.deadline("key") != 0 {
+		t.Fatal("SET should reset ttl")
+	}
+	dm.LSet("list", []string{"a"})
+	if _, ok, err := dm.SetWith("list", "x", setOptions{nx: true}); ok || err != nil {
+		t.Fatalf("got %v, %v, existing key shouldn't be set with NX", ok, err)
+	}
+	if _, _, err := dm.SetWith("list", "x", setOptions{get: true}); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+}
+
+func TestMapMSet(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if err := dm.MSet("a", "1", "b", "2"); err != nil {
+		t.Fatalf("MSet error: %v", err)
+	}
+	if ok, _ := dm.MSetNX("c", "3", "a", "x"); ok {
+		t.Fatal("MSETNX shouldn't set keys if any exists")
+	}
+	if res := dm.MGet("a", "b", "c"); fmt.Sprint(res) != "[1 2 <nil>]" {
+		t.Fatalf("got %v, want [1 2 <nil>]", res)
+	}
+	dm.LSet("list", []string{"a"})
+	if err := dm.MSet("d", "4", "list", "x"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+	if res := dm.MGet("d", "list"); fmt.Sprint(res) != "[<nil> <nil>]" {
+		t.Fatalf("got %v, nothing should be set", res)
+	}
+}
+
+func TestSetOptionsDataHandlers(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if res, _ := DataHandler(&dm, "set", []string{"s", "1", "nx", "get"}); res != "(nil)" {
+		t.Fatalf("got %s, want (nil)", res)
+	}
+	if res, _ := DataHandler(&dm, "set", []string{"s", "2", "xx", "get"}); res != "1" {
+		t.Fatalf("got %s, want 1", res)
+	}
+	if res, _ := DataHandler(&dm, "set", []string{"s", "3", "nx"}); res != "(nil)" {
+		t.Fatalf("got %s, want (nil)", res)
+	}
+	if res, _ := DataHandler(&dm, "setnx", []string{"s", "3"}); res != "0" {
+		t.Fatalf("got %s, want 0", res)
+	}
+	if _, err := DataHandler(&dm, "setex", []string{"s", "0", "3"}); err != wrongDurationErr {
+		t.Fatalf("got '%v', want: '%v'", err, wrongDurationErr)
+	}
+	// -2305843009213693951 * 1000 wraps to 1000
+	if _, err := DataHandler(&dm, "setex", []string{"s", "-2305843009213693951", "3"}); err != wrongDurationErr {
+		t.Fatalf("got '%v', want: '%v'", err, wrongDurationErr)
+	}
+	if _, err := DataHandler(&dm, "mset", []string{"a", "1", "b"}); err != missValueErr {
+		t.Fatalf("got '%v', want: '%v'", err, missValueErr)
+	}
+	if res, _ := DataHandler(&dm, "mget", []string{"s", "a"}); res != "[2 (nil)]" {
+		t.Fatalf("got %s, want [2 (nil)]", res)
+	}
+
+	args := []string{"s", "4", "xx", "keepttl"}
+	res, _ := execute(&dm, "psetex", []string{"s", "100000", "3"})
+	if got := aofCommands(&dm, "psetex", []string{"s", "100000", "3"}, res); len(got) != 2 {
+		t.Fatalf("got %v logged, want SET with PEXPIREAT", got)
+	}
+	res, _ = execute(&dm, "set", args)
+	want := [][]string{{"set", "s", "4"}, pexpireatCommand(&dm, "s")}
+	if got := aofCommands(&dm, "set", args, res); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v logged, want %v", got, want)
+	}
+	args = []string{"s", "5", "nx", "get"}
+	res, _ = execute(&dm, "set", args)
+	if got := aofCommands(&dm, "set", args, res); len(got) != 0 {
+		t.Fatalf("got %v logged, SET which has not set the key shouldn't be logged", got)
+	}
+}
@@ -13,6 +13,230 @@ var manyArgsErr = errors.New("ERROR: too many arguments")
 var keyNotSpecifiedErr = errors.New("ERROR: key is not specified")
 var unknownCmdErr = errors.New("ERROR: unknown command")
 var wrongArgErr = errors.New("ERROR: wrong argument type")
+var syntaxErr = errors.New("ERROR: syntax error")
+var notIntegerErr = errors.New("ERROR: value is not an integer or out of range")
+var overflowErr = errors.New("ERROR: increment or decrement would overflow")
+
+// writeCommands are commands which change data.
+// They are propagated to the append only file.
+var writeCommands = map[string]bool{
+	"set":         true,
+	"lset":        true,
+	"lupdate":     true,
+	"hset":        true,
+	"hupdate":     true,
+	"expire":      true,
+	"expireat":    true,
+	"pexpire":     true,
+	"pexpireat":   true,
+	"persist":     true,
+	"remove":      true,
+	"sadd":        true,
+	"srem":        true,
+	"spop":        true,
+	"sinterstore": true,
+	"sunionstore": true,
+	"sdiffstore":  true,
+	"zadd":        true,
+	"zincrby":     true,
+	"zrem":        true,
+	"zpopmin":     true,
+	"zpopmax":     true,
+	"zunionstore": true,
+	"zinterstore": true,
+	"lpush":       true,
+	"rpush":       true,
+	"lpop":        true,
+	"rpop":        true,
+	"ltrim":       true,
+	"linsert":     true,
+	"lrem":        true,
+	"lmove":       true,
+
+	"hdel":         true,
+	"hsetnx":       true,
+	"hincrby":      true,
+	"hincrbyfloat": true,
+
+	"incr":        true,
+	"decr":        true,
+	"incrby":      true,
+	"decrby":      true,
+	"incrbyfloat": true,
+	"append":      true,
+	"setrange":    true,
+	"getdel":      true,
+	"getex":       true,
+	"getset":      true,
+
+	"setnx":  true,
+	"setex":  true,
+	"psetex": true,
+	"mset":   true,
+	"msetnx": true,
+
+	"del":      true,
+	"unlink":   true,
+	"rename":   true,
+	"renamenx": true,
+	"copy":     true,
+	"move":     true,
+
+	"flushdb":  true,
+	"flushall": true,
+	"swapdb":   true,
+}
+
+// keyCommands are commands which use keys. Positions of keys
+// in arguments are the first key, the last key (negative
+// values count from the end) and the step between keys.
+var keyCommands = map[string][3]int{
+	"set":         {0, 0, 1},
+	"get":         {0, 0, 1},
+	"lset":        {0, 0, 1},
+	"lget":        {0, 0, 1},
+	"lgetit":      {0, 0, 1},
+	"lupdate":     {0, 0, 1},
+	"hset":        {0, 0, 1},
+	"hget":        {0, 0, 1},
+	"hgetval":     {0, 0, 1},
+	"hupdate":     {0, 0, 1},
+	"ttl":         {0, 0, 1},
+	"pttl":        {0, 0, 1},
+	"expiretime":  {0, 0, 1},
+	"pexpiretime": {0, 0, 1},
+	"expire":      {0, 0, 1},
+	"expireat":    {0, 0, 1},
+	"pexpire":     {0, 0, 1},
+	"pexpireat":   {0, 0, 1},
+	"persist":     {0, 0, 1},
+	"remove":      {0, 0, 1},
+	"sadd":        {0, 0, 1},
+	"srem":        {0, 0, 1},
+	"smembers":    {0, 0, 1},
+	"sismember":   {0, 0, 1},
+	"scard":       {0, 0, 1},
+	"srandmember": {0, 0, 1},
+	"spop":        {0, 0, 1},
+	"sinter":      {0, -1, 1},
+	"sunion":      {0, -1, 1},
+	"sdiff":       {0, -1, 1},
+	"sinterstore": {0, -1, 1},
+	"sunionstore": {0, -1, 1},
+	"sdiffstore":  {0, -1, 1},
+	"zadd":        {0, 0, 1},
+	"zincrby":     {0, 0, 1},
+	"zrem":        {0, 0, 1},
+	"zscore":      {0, 0, 1},
+	"zcard":       {0, 0, 1},
+	"zrank":       {0, 0, 1},
+	"zrevrank":    {0, 0, 1},
+	"zcount":      {0, 0, 1},
+	"zpopmin":     {0, 0, 1},
+	"zpopmax":     {0, 0, 1},
+	"zrange":      {0, 0, 1},
+	"zrevrange":   {0, 0, 1},
+
+	"zrangebyscore":    {0, 0, 1},
+	"zrevrangebyscore": {0, 0, 1},
+	"zrangebylex":      {0, 0, 1},
+	"zrevrangebylex":   {0, 0, 1},
+
+	"lpush":   {0, 0, 1},
+	"rpush":   {0, 0, 1},
+	"lpop":    {0, 0, 1},
+	"rpop":    {0, 0, 1},
+	"lrange":  {0, 0, 1},
+	"llen":    {0, 0, 1},
+	"ltrim":   {0, 0, 1},
+	"linsert": {0, 0, 1},
+	"lrem":    {0, 0, 1},
+	"lmove":   {0, 1, 1},
+	"blpop":   {0, -2, 1},
+	"brpop":   {0, -2, 1},
+	"blmove":  {0, 1, 1},
+
+	"hdel":         {0, 0, 1},
+	"hlen":         {0, 0, 1},
+	"hexists":      {0, 0, 1},
+	"hkeys":        {0, 0, 1},
+	"hvals":        {0, 0, 1},
+	"hincrby":      {0, 0, 1},
+	"hincrbyfloat": {0, 0, 1},
+	"hsetnx":       {0, 0, 1},
+	"hmget":        {0, 0, 1},
+	"hscan":        {0, 0, 1},
+
+	"incr":        {0, 0, 1},
+	"decr":        {0, 0, 1},
+	"incrby":      {0, 0, 1},
+	"decrby":      {0, 0, 1},
+	"incrbyfloat": {0, 0, 1},
+	"append":      {0, 0, 1},
+	"strlen":      {0, 0, 1},
+	"getrange":    {0, 0, 1},
+	"setrange":    {0, 0, 1},
+	"getdel":      {0, 0, 1},
+	"getex":       {0, 0, 1},
+	"getset":      {0, 0, 1},
+
+	"setnx":  {0, 0, 1},
+	"setex":  {0, 0, 1},
+	"psetex": {0, 0, 1},
+	"mset":   {0, -1, 2},
+	"msetnx": {0, -1, 2},
+	"mget":   {0, -1, 1},
+
+	"del":      {0, -1, 1},
+	"unlink":   {0, -1, 1},
+	"exists":   {0, -1, 1},
+	"touch":    {0, -1, 1},
+	"type":     {0, 0, 1},
+	"rename":   {0, 1, 1},
+	"renamenx": {0, 1, 1},
+	"copy":     {0, 1, 1},
+	"move":     {0, 0, 1},
+}
+
+// keysFuncs return keys of commands which
+// positions of keys depend on arguments.
+var keysFuncs = map[string]func(args []string) []string{
+	"zunionstore": numKeysCommandKeys,
+	"zinterstore": numKeysCommandKeys,
+}
+
+// numKeysCommandKeys returns keys of commands like
+// ZUNIONSTORE destination numkeys key [key ...] ...
+func numKeysCommandKeys(args []string) []string {
+	if len(args) < 2 {
+		return args
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 || n > len(args)-2 {
+		return args[:1]
+	}
+	return append([]string{args[0]}, args[2:2+n]...)
+}
+
+// commandKeys returns keys used by cmd with args.
+func commandKeys(cmd string, args []string) []string {
+	if keysFunc, ok := keysFuncs[cmd]; ok {
+		return keysFunc(args)
+	}
+	spec, ok := keyCommands[cmd]
+	if !ok {
+		return nil
+	}
+	first, last, step := spec[0], spec[1], spec[2]
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := first; i <= last && i < len(args); i += step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
 
 // dataParser split s by spaces except quoted substring.
 func dataParser(s string) []string {
@@ -57,198 +281,244 @@ func CommandHandler(s string) (cmd string, data []string, err error) {
 
 // DataHandler provides handlers for telnet like API.
 func DataHandler(dm *DataMap, cmd string, s []string) (string, error) {
-	switch cmd {
-	case "keys":
-		return fmt.Sprintf("%v", dm.Keys()), nil
-	}
-	key, data, err := paramsParser(s)
+	res, err := execute(dm, cmd, s)
 	if err != nil {
 		return "", err
 	}
+	return formatReply(res), nil
+}
+
+// execute runs cmd with s arguments against dm.
+// It returns a typed result which may be encoded
+// for any supported protocol.
+func execute(dm *DataMap, cmd string, s []string) (interface{}, error) {
 	switch cmd {
-	case "set":
-		if len(data) == 0 {
-			return "", fewArgsErr
+	case "keys":
+		if len(s) > 1 {
+			return nil, manyArgsErr
 		}
-		if len(data) > 1 {
-			return "", manyArgsErr
+		if len(s) == 1 {
+			return dm.KeysMatch(s[0]), nil
 		}
-		err := dm.Set(key, data[0])
+		return dm.Keys(), nil
+	case "scan":
+		opts, typ, err := parseKeyScanArgs(s)
 		if err != nil {
-			return "", err
-		} else {
-			return "OK", nil
+			return nil, err
 		}
-
+		next, keys := dm.Scan(opts, typ)
+		return scanReply(next, keys), nil
+	case "dbsize", "flushdb", "flushall", "swapdb":
+		return databaseCommand(dm, cmd, s)
+	}
+	key, data, err := paramsParser(s)
+	if err != nil {
+		return nil, err
+	}
+	switch cmd {
 	case "get":
 		if len(data) > 0 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		res, err := dm.Get(key)
+		if err == keyNotExistErr {
+			return nil, nil
+		}
 		if err != nil {
-			return "", err
+			return nil, err
 		} else {
 			return res, nil
 		}
 
 	case "lset":
 		if len(data) < 1 {
-			return "", fewArgsErr
+			return nil, fewArgsErr
 		}
 		err := dm.LSet(key, data)
 		if err != nil {
-			return "", err
+			return nil, err
 		} else {
-			return "OK", nil
+			return okReply, nil
 		}
 	case "lget":
 		if len(data) > 0 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		res, err := dm.LGet(key)
+		if err == keyNotExistErr {
+			return nil, nil
+		}
 		if err != nil {
-			return "", err
+			return nil, err
 		} else {
-			return fmt.Sprintf("%v", res), nil
+			return res, nil
 		}
 	case "lgetit":
 		if len(data) == 0 {
-			return "", fewArgsErr
+			return nil, fewArgsErr
 		}
 		if len(data) > 1 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		index, err := strconv.Atoi(data[0])
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		res, err := dm.LGetIt(key, index)
 		if err != nil {
-			return "", err
+			return nil, err
 		} else {
 			return res, nil
 		}
 	case "lupdate":
 		if len(data) < 2 {
-			return "", fewArgsErr
+			return nil, fewArgsErr
 		}
 		if len(data) > 2 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		index, err := strconv.Atoi(data[0])
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		err = dm.LUpdate(key, index, data[1])
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		return "OK", nil
+		return okReply, nil
 	case "hset":
 		dict, err := mapParser(data)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		err = dm.HSet(key, dict)
 		if err != nil {
-			return "", err
+			return nil, err
 		} else {
-			return "OK", nil
+			return okReply, nil
 		}
 	case "hget":
 		if len(data) > 0 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		dict, err := dm.HGet(key)
+		if err == keyNotExistErr {
+			return nil, nil
+		}
 		if err != nil {
-			return "", err
+			return nil, err
 		} else {
-			return fmt.Sprintf("%v", dict), nil
+			return dict, nil
 		}
 	case "hgetval":
 		if len(data) == 0 {
-			return "", fewArgsErr
+			return nil, fewArgsErr
 		}
 		if len(data) > 1 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		res, err := dm.HGetVal(key, data[0])
+		if err == keyNotExistErr || err == invalidInnerKeyErr {
+			return nil, nil
+		}
 		if err != nil {
-			return "", err
+			return nil, err
 		} else {
 			return res, nil
 		}
 	case "hupdate":
 		if len(data) < 2 {
-			return "", fewArgsErr
+			return nil, fewArgsErr
 		}
 		if len(data) > 2 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		inKey := data[0]
 		value := data[1]
 		err := dm.HUpdate(key, inKey, value)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		return "OK", nil
-	case "ttl":
+		return okReply, nil
+	case "ttl", "pttl", "expiretime", "pexpiretime":
 		if len(data) > 0 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
+		}
+		var ttl int64
+		switch cmd {
+		case "ttl":
+			ttl, err = dm.TTL(key)
+		case "pttl":
+			ttl, err = dm.PTTL(key)
+		case "expiretime":
+			ttl, err = dm.ExpireTime(key)
+		default:
+			ttl, err = dm.PExpireTime(key)
+		}
+		if err == keyNotExistErr {
+			return int64(-2), nil
 		}
-		ttl, err := dm.TTL(key)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		return ttl, nil
-	case "expire":
-		if len(data) == 0 {
-			return "", fewArgsErr
-		}
-		if len(data) > 1 {
-			return "", manyArgsErr
-		}
-		dur, err := strconv.Atoi(data[0])
-		if err != nil {
-			return "", err
-		}
-		err = dm.Expire(key, int64(dur))
-		if err != nil {
-			return "", err
-		}
-		return "OK", nil
-	case "expireat":
+	case "expire", "pexpire", "expireat", "pexpireat":
 		if len(data) == 0 {
-			return "", fewArgsErr
+			return nil, fewArgsErr
 		}
 		if len(data) > 1 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
-		ttl, err := strconv.Atoi(data[0])
+		ttl, err := strconv.ParseInt(data[0], 10, 64)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		switch cmd {
+		case "expire":
+			err = dm.Expire(key, ttl)
+		case "pexpire":
+			err = dm.PExpire(key, ttl)
+		case "expireat":
+			err = dm.Expireat(key, ttl)
+		default:
+			err = dm.PExpireat(key, ttl)
 		}
-		err = dm.Expireat(key, int64(ttl))
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		return "OK", nil
+		return okReply, nil
 	case "persist":
 		if len(data) != 0 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		if err := dm.Persist(key); err != nil {
-			return "", err
+			return nil, err
 		}
-		return "OK", nil
+		return okReply, nil
 	case "remove":
 		if len(data) != 0 {
-			return "", manyArgsErr
+			return nil, manyArgsErr
 		}
 		dm.Remove(key)
-		return "OK", nil
+		return okReply, nil
+	case "sadd", "srem", "smembers", "sismember", "scard", "srandmember", "spop",
+		"sinter", "sunion", "sdiff", "sinterstore", "sunionstore", "sdiffstore":
+		return setCommand(dm, cmd, key, data)
+	case "zadd", "zincrby", "zrem", "zscore", "zcard", "zrank", "zrevrank", "zcount",
+		"zpopmin", "zpopmax", "zunionstore", "zinterstore", "zrange", "zrevrange",
+		"zrangebyscore", "zrevrangebyscore", "zrangebylex", "zrevrangebylex":
+		return zsetCommand(dm, cmd, key, data)
+	case "lpush", "rpush", "lpop", "rpop", "lrange", "llen", "ltrim", "linsert", "lrem", "lmove":
+		return listCommand(dm, cmd, key, data)
+	case "hdel", "hlen", "hexists", "hkeys", "hvals", "hincrby", "hincrbyfloat", "hsetnx", "hmget", "hscan":
+		return hashCommand(dm, cmd, key, data)
+	case "incr", "decr", "incrby", "decrby", "incrbyfloat", "append", "strlen",
+		"getrange", "setrange", "getdel", "getex", "getset", "set", "setnx", "setex",
+		"psetex", "mset", "msetnx", "mget":
+		return stringCommand(dm, cmd, key, data)
+	case "del", "unlink", "exists", "touch", "type", "rename", "renamenx", "copy", "move":
+		return keyspaceCommand(dm, cmd, key, data)
 	default:
-		return "", unknownCmdErr
+		return nil, unknownCmdErr
 	}
-	return "", fmt.Errorf("unhandled error")
 }
@@ -8,7 +8,7 @@ import (
 func TestMapParser(t *testing.T) {
 	slice := []string{"one"}
 	if _, err := mapParser(slice); err != fewArgsErr {
-		t.Error("slice with len < 2 should not be allowed: %v", slice)
+		t.Errorf("slice with len < 2 should not be allowed: %v", slice)
 	}
 	slice = []string{"one", "two", "three"}
 	if _, err := mapParser(slice); err != missValueErr {
@@ -73,8 +73,8 @@ func TestSetDataHandler(t *testing.T) {
 	if _, err := DataHandler(&dm, cmd, []string{"key"}); err != fewArgsErr {
 		t.Fatalf("got '%v', want: '%v'", err, fewArgsErr)
 	}
-	if _, err := DataHandler(&dm, cmd, []string{"key", "hello", "world"}); err != manyArgsErr {
-		t.Fatalf("got '%v', want: '%v'", err, manyArgsErr)
+	if _, err := DataHandler(&dm, cmd, []string{"key", "hello", "world"}); err != syntaxErr {
+		t.Fatalf("got '%v', want: '%v'", err, syntaxErr)
 	}
 	key := "test"
 	dm.hash[key] = &data{value: ""}
@@ -106,7 +106,7 @@ func TestLSetDataHandler(t *testing.T) {
 		t.Fatalf("got '%v', want '%v'", err, fewArgsErr)
 	}
 	key := "test"
-	dm.hash[key] = &data{value: []string{}}
+	dm.hash[key] = &data{value: newList([]string{})}
 	if _, err := DataHandler(&dm, cmd, []string{key, "hello", "world"}); err != nil {
 		t.Fatalf("got '%v', expected 'nil' error", err)
 	}
@@ -120,7 +120,7 @@ func TestLGetDataHandler(t *testing.T) {
 		t.Fatalf("got '%v', expected '%v' error", err, manyArgsErr)
 	}
 	key := "test"
-	dm.hash[key] = &data{value: []string{"hello", "world"}}
+	dm.hash[key] = &data{value: newList([]string{"hello", "world"})}
 	if _, err := DataHandler(&dm, cmd, []string{key}); err != nil {
 		t.Fatalf("got '%v', expected 'nil' error", err)
 	}
@@ -137,7 +137,7 @@ func TestLGetItDataHandler(t *testing.T) {
 		t.Fatalf("got '%v', expected '%v' error for not enough args", err, manyArgsErr)
 	}
 	key := "test"
-	dm.hash[key] = &data{value: []string{"hello", "world"}}
+	dm.hash[key] = &data{value: newList([]string{"hello", "world"})}
 	have := "world"
 	got, err := DataHandler(&dm, cmd, []string{key, "1"})
 	if err != nil {
@@ -160,7 +160,7 @@ func TestLUpdateDataHandler(t *testing.T) {
 		t.Fatalf("got '%v', expected '%v' error for not enough args", err, manyArgsErr)
 	}
 	key := "test"
-	dm.hash[key] = &data{value: []string{"hello", "world"}}
+	dm.hash[key] = &data{value: newList([]string{"hello", "world"})}
 	have := "bye"
 	_, err := DataHandler(&dm, cmd, []string{key, "1", have})
 	if err != nil {
@@ -246,3 +246,29 @@ func TestHUpdateDataHandler(t *testing.T) {
 		t.Fatalf("got %q, want %q", got, have)
 	}
 }
+
+func TestTTLDataHandler(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if got, _ := DataHandler(&dm, "ttl", []string{"i'm groot"}); got != "-2" {
+		t.Fatalf("got %q, want '-2' for non existing key", got)
+	}
+	if _, err := DataHandler(&dm, "set", []string{"key", "value", "ex", "ten"}); err == nil {
+		t.Fatal("non numeric ttl should not be allowed")
+	}
+	if _, err := DataHandler(&dm, "set", []string{"key", "value", "xx", "10"}); err != syntaxErr {
+		t.Fatalf("got '%v', want '%v'", err, syntaxErr)
+	}
+	if _, err := DataHandler(&dm, "set", []string{"key", "value", "px", "10000"}); err != nil {
+		t.Fatalf("got '%v', expected 'nil' error", err)
+	}
+	if got, _ := DataHandler(&dm, "ttl", []string{"key"}); got != "10" {
+		t.Fatalf("got %q, want '10' seconds", got)
+	}
+	if _, err := DataHandler(&dm, "pexpire", []string{"key", "2500"}); err != nil {
+		t.Fatalf("got '%v', expected 'nil' error", err)
+	}
+	if got, _ := DataHandler(&dm, "ttl", []string{"key"}); got != "3" {
+		t.Fatalf("got %q, want '3' seconds", got)
+	}
+}
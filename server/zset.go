@@ -0,0 +1,957 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var notFloatErr = errors.New("ERROR: value is not a valid float")
+var nanScoreErr = errors.New("ERROR: resulting score is not a number (NaN)")
+var nxAndXXErr = errors.New("ERROR: XX and NX options at the same time are not compatible")
+var gtLtNXErr = errors.New("ERROR: GT, LT, and/or NX options at the same time are not compatible")
+var incrPairErr = errors.New("ERROR: INCR option supports a single increment-element pair")
+var minMaxFloatErr = errors.New("ERROR: min or max is not a float")
+var minMaxLexErr = errors.New("ERROR: min or max not valid string range item")
+var limitErr = errors.New("ERROR: syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+var withScoresByLexErr = errors.New("ERROR: syntax error, WITHSCORES not supported in combination with BYLEX")
+var noInputKeysErr = errors.New("ERROR: at least 1 input key is needed")
+var weightErr = errors.New("ERROR: weight value is not a float")
+
+// ZItem is a member of a sorted set with its score.
+type ZItem struct {
+	Member string
+	Score  float64
+}
+
+// ZAddFlags are options of ZAdd and ZIncrBy.
+type ZAddFlags struct {
+	NX bool // only add new members
+	XX bool // only update existing members
+	GT bool // only update scores to greater ones
+	LT bool // only update scores to lower ones
+	CH bool // count changed members as well as added ones
+}
+
+// ZRangeBy is how ZRange selects members of a sorted set.
+type ZRangeBy int
+
+const (
+	ZRangeByIndex ZRangeBy = iota
+	ZRangeByScore
+	ZRangeByLex
+)
+
+// ZRangeSpec selects members of a sorted set. Start and Stop
+// are indexes, scores like "1.5", "(1.5" or "-inf", or members
+// like "[a", "(a", "-" or "+". With Reverse members are
+// returned from the greatest one and Start is the upper
+// bound of scores and members. Offset and Count limit
+// members selected by score or member, negative Count
+// means no limit.
+type ZRangeSpec struct {
+	By            ZRangeBy
+	Start, Stop   string
+	Reverse       bool
+	Offset, Count int
+}
+
+// zset is a sorted set: members with their scores
+// and the skip list ordered by scores.
+type zset struct {
+	dict map[string]float64
+	zsl  *zskiplist
+}
+
+func newZset() *zset {
+	return &zset{dict: make(map[string]float64), zsl: newZskiplist()}
+}
+
+// zitemSize estimates memory used by member of a sorted set.
+func zitemSize(member string) int64 {
+	return int64(len(member)) + itemOverhead*2 + 8
+}
+
+func (z *zset) len() int { return len(z.dict) }
+
+// clone returns a copy of z.
+func (z *zset) clone() *zset {
+	c := newZset()
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		c.set(x.member, x.score)
+	}
+	return c
+}
+
+// set sets score of member in z and reports
+// whether member has been added.
+func (z *zset) set(member string, score float64) bool {
+	old, ok := z.dict[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	}
+	z.dict[member] = score
+	z.zsl.insert(score, member)
+	return !ok
+}
+
+// remove removes member from z and reports
+// whether it has been found.
+func (z *zset) remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	delete(z.dict, member)
+	z.zsl.delete(score, member)
+	return true
+}
+
+// rank returns 0-based rank of member.
+func (z *zset) rank(member string, reverse bool) (int, bool) {
+	score, ok := z.dict[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.zsl.rank(score, member)
+	if reverse {
+		return z.len() - rank, true
+	}
+	return rank - 1, true
+}
+
+// query returns members of z selected by spec.
+func (z *zset) query(spec ZRangeSpec) ([]ZItem, error) {
+	if spec.By == ZRangeByIndex {
+		start, err := strconv.Atoi(spec.Start)
+		if err != nil {
+			return nil, wrongArgErr
+		}
+		stop, err := strconv.Atoi(spec.Stop)
+		if err != nil {
+			return nil, wrongArgErr
+		}
+		n := z.len()
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+		if start > stop || start >= n {
+			return []ZItem{}, nil
+		}
+		if stop >= n {
+			stop = n - 1
+		}
+		rank := start + 1
+		if spec.Reverse {
+			rank = n - start
+		}
+		return collectItems(z.zsl.byRank(rank), nil, stop-start+1, spec.Reverse), nil
+	}
+	min, max := spec.Start, spec.Stop
+	if spec.Reverse {
+		min, max = max, min
+	}
+	r, err := parseZRange(spec.By, min, max)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Offset < 0 {
+		return []ZItem{}, nil
+	}
+	var x *zskiplistNode
+	if spec.Reverse {
+		x = z.zsl.lastInRange(r)
+	} else {
+		x = z.zsl.firstInRange(r)
+	}
+	for i := 0; i < spec.Offset && x != nil; i++ {
+		x = x.next(spec.Reverse)
+	}
+	return collectItems(x, r, spec.Count, spec.Reverse), nil
+}
+
+// count returns the number of members in r.
+func (z *zset) count(r zrange) int {
+	first := z.zsl.firstInRange(r)
+	if first == nil {
+		return 0
+	}
+	last := z.zsl.lastInRange(r)
+	return z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+}
+
+// next returns the next node in order or
+// the previous one if reverse is set.
+func (n *zskiplistNode) next(reverse bool) *zskiplistNode {
+	if reverse {
+		return n.backward
+	}
+	return n.level[0].forward
+}
+
+// collectItems returns up to count items in r starting
+// from x. Negative count means no limit, nil r means
+// the rest of items.
+func collectItems(x *zskiplistNode, r zrange, count int, reverse bool) []ZItem {
+	res := []ZItem{}
+	for ; x != nil && count != 0; x = x.next(reverse) {
+		if r != nil && (reverse && !r.gteMin(x) || !reverse && !r.lteMax(x)) {
+			break
+		}
+		res = append(res, ZItem{x.member, x.score})
+		count--
+	}
+	return res
+}
+
+// scoreRange is a range of scores, bounds may be exclusive.
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r scoreRange) empty() bool {
+	return r.min > r.max || r.min == r.max && (r.minex || r.maxex)
+}
+
+func (r scoreRange) gteMin(n *zskiplistNode) bool {
+	if r.minex {
+		return n.score > r.min
+	}
+	return n.score >= r.min
+}
+
+func (r scoreRange) lteMax(n *zskiplistNode) bool {
+	if r.maxex {
+		return n.score < r.max
+	}
+	return n.score <= r.max
+}
+
+// lexBound is a bound of a range of members. inf is -1
+// for "-" which is less than any member and 1 for "+".
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int
+}
+
+// compare compares member s with b.
+func (b lexBound) compare(s string) int {
+	if b.inf != 0 {
+		return -b.inf
+	}
+	return strings.Compare(s, b.value)
+}
+
+// lexRange is a range of members of a sorted set
+// which members have the same score.
+type lexRange struct {
+	min, max lexBound
+}
+
+func (r lexRange) empty() bool {
+	if r.min.inf == 1 || r.max.inf == -1 {
+		return true
+	}
+	if r.min.inf != 0 || r.max.inf != 0 {
+		return false
+	}
+	c := strings.Compare(r.min.value, r.max.value)
+	return c > 0 || c == 0 && (r.min.exclusive || r.max.exclusive)
+}
+
+func (r lexRange) gteMin(n *zskiplistNode) bool {
+	c := r.min.compare(n.member)
+	return c > 0 || c == 0 && !r.min.exclusive
+}
+
+func (r lexRange) lteMax(n *zskiplistNode) bool {
+	c := r.max.compare(n.member)
+	return c < 0 || c == 0 && !r.max.exclusive
+}
+
+// parseScore parses a score of a sorted set
+// including "inf", "+inf" and "-inf".
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, notFloatErr
+	}
+	return f, nil
+}
+
+// parseScoreBound parses a score like "1.5" or
+// exclusive one like "(1.5".
+func parseScoreBound(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	f, err := parseScore(s)
+	if err != nil {
+		return 0, false, minMaxFloatErr
+	}
+	return f, exclusive, nil
+}
+
+// parseLexBound parses a member like "[a", "(a", "-" or "+".
+func parseLexBound(s string) (lexBound, error) {
+	switch {
+	case s == "-":
+		return lexBound{inf: -1}, nil
+	case s == "+":
+		return lexBound{inf: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, nil
+	}
+	return lexBound{}, minMaxLexErr
+}
+
+// parseZRange parses min and max bounds of a range by score or by member.
+func parseZRange(by ZRangeBy, min, max string) (zrange, error) {
+	if by == ZRangeByLex {
+		var r lexRange
+		var err error
+		if r.min, err = parseLexBound(min); err != nil {
+			return nil, err
+		}
+		if r.max, err = parseLexBound(max); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	var r scoreRange
+	var err error
+	if r.min, r.minex, err = parseScoreBound(min); err != nil {
+		return nil, err
+	}
+	if r.max, r.maxex, err = parseScoreBound(max); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lookupZset gets sorted set stored by key or nil if key
+// not exists. It must be called with dm.mu held
+// at least for reading.
+func (dm *DataMap) lookupZset(key string) (*zset, error) {
+	d, ok := dm.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	return d.ZSetGet()
+}
+
+// writeZset gets sorted set stored by key to change it.
+// A missing set is created if create is set, otherwise
+// nil is returned. It must be called with dm.mu held
+// for writing.
+func (dm *DataMap) writeZset(key string, create bool) (*data, *zset, error) {
+	d, ok := dm.lookupWrite(key)
+	if !ok {
+		if !create {
+			return nil, nil, nil
+		}
+		d = dm.create(key)
+		d.ZSetSet(newZset())
+		return d, d.value.(*zset), nil
+	}
+	if _, err := d.ZSetGet(); err != nil {
+		return nil, nil, err
+	}
+	dm.unshare(d)
+	return d, d.value.(*zset), nil
+}
+
+// zsetChanged finishes a change of sorted set z stored
+// in d by key. An empty set is removed. It must be
+// called with dm.mu held for writing.
+func (dm *DataMap) zsetChanged(key string, d *data, z *zset, changed bool) {
+	if z.len() == 0 {
+		dm.delete(key)
+	} else if changed {
+		dm.modified(d)
+	}
+}
+
+// zaddItem sets score of member in z stored in d unless
+// flags forbid it. It returns whether member has been
+// added, whether its score has been changed and whether
+// flags allowed the change.
+func (dm *DataMap) zaddItem(d *data, z *zset, flags ZAddFlags, member string, score float64) (added, changed, ok bool) {
+	old, exists := z.dict[member]
+	switch {
+	case exists && (flags.NX || flags.GT && score <= old || flags.LT && score >= old):
+		return false, false, false
+	case !exists && flags.XX:
+		return false, false, false
+	case exists:
+		z.set(member, score)
+		return false, old != score, true
+	}
+	z.set(member, score)
+	dm.grow(d, zitemSize(member))
+	return true, false, true
+}
+
+// ZAdd adds members with scores to sorted set in dm by
+// key or updates their scores. It returns the number of
+// added members, or changed ones as well with CH flag.
+// Returns error if key contains another type.
+func (dm *DataMap) ZAdd(key string, flags ZAddFlags, items ...ZItem) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, z, err := dm.writeZset(key, !flags.XX)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	added, changed := 0, 0
+	for _, item := range items {
+		a, c, _ := dm.zaddItem(d, z, flags, item.Member, item.Score)
+		if a {
+			added++
+		}
+		if c {
+			changed++
+		}
+	}
+	dm.zsetChanged(key, d, z, added+changed > 0)
+	if flags.CH {
+		return added + changed, nil
+	}
+	return added, nil
+}
+
+// ZIncrBy increments score of member of sorted set in dm
+// by key. A missing member is added with incr score. It
+// returns the new score or false if flags forbid the change.
+// Returns error if key contains another type.
+func (dm *DataMap) ZIncrBy(key string, flags ZAddFlags, incr float64, member string) (float64, bool, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, z, err := dm.writeZset(key, !flags.XX)
+	if err != nil || z == nil {
+		return 0, false, err
+	}
+	score := incr
+	if old, ok := z.dict[member]; ok {
+		score += old
+	}
+	if math.IsNaN(score) {
+		dm.zsetChanged(key, d, z, false)
+		return 0, false, nanScoreErr
+	}
+	added, changed, ok := dm.zaddItem(d, z, flags, member, score)
+	dm.zsetChanged(key, d, z, added || changed)
+	return score, ok, nil
+}
+
+// ZRem removes members from sorted set in dm by key
+// and returns the number of removed members.
+// Returns error if key contains another type.
+func (dm *DataMap) ZRem(key string, members ...string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, z, err := dm.writeZset(key, false)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	removed := 0
+	for _, m := range members {
+		if z.remove(m) {
+			dm.grow(d, -zitemSize(m))
+			removed++
+		}
+	}
+	dm.zsetChanged(key, d, z, removed > 0)
+	return removed, nil
+}
+
+// ZPopMin removes count members with the lowest scores
+// from sorted set in dm by key and returns them.
+// Returns error if key contains another type.
+func (dm *DataMap) ZPopMin(key string, count int) ([]ZItem, error) {
+	return dm.zpop(key, count, false)
+}
+
+// ZPopMax removes count members with the greatest scores
+// from sorted set in dm by key and returns them.
+// Returns error if key contains another type.
+func (dm *DataMap) ZPopMax(key string, count int) ([]ZItem, error) {
+	return dm.zpop(key, count, true)
+}
+
+func (dm *DataMap) zpop(key string, count int, max bool) ([]ZItem, error) {
+	if count < 0 {
+		return nil, negativeCountErr
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, z, err := dm.writeZset(key, false)
+	if err != nil || z == nil {
+		return []ZItem{}, err
+	}
+	first := z.zsl.header.level[0].forward
+	if max {
+		first = z.zsl.tail
+	}
+	items := collectItems(first, nil, count, max)
+	for _, item := range items {
+		z.remove(item.Member)
+		dm.grow(d, -zitemSize(item.Member))
+	}
+	dm.zsetChanged(key, d, z, len(items) > 0)
+	return items, nil
+}
+
+// ZScore gets score of member of sorted set in dm by key.
+// It returns false if key or member not exists.
+// Returns error if key contains another type.
+func (dm *DataMap) ZScore(key, member string) (float64, bool, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	z, err := dm.lookupZset(key)
+	if err != nil || z == nil {
+		return 0, false, err
+	}
+	score, ok := z.dict[member]
+	return score, ok, nil
+}
+
+// ZCard gets the number of members of sorted set in dm
+// by key. Returns error if key contains another type.
+func (dm *DataMap) ZCard(key string) (int, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	z, err := dm.lookupZset(key)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	return z.len(), nil
+}
+
+// ZRank gets 0-based rank of member of sorted set in dm
+// by key, from the greatest score if reverse is set. It
+// returns false if key or member not exists. Returns
+// error if key contains another type.
+func (dm *DataMap) ZRank(key, member string, reverse bool) (int, bool, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	z, err := dm.lookupZset(key)
+	if err != nil || z == nil {
+		return 0, false, err
+	}
+	rank, ok := z.rank(member, reverse)
+	return rank, ok, nil
+}
+
+// ZRange gets members of sorted set in dm by key selected
+// by spec. Returns error if key contains another type
+// or spec is invalid.
+func (dm *DataMap) ZRange(key string, spec ZRangeSpec) ([]ZItem, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	z, err := dm.lookupZset(key)
+	if err != nil {
+		return nil, err
+	}
+	if z == nil {
+		z = newZset()
+	}
+	return z.query(spec)
+}
+
+// ZCount gets the number of members of sorted set in dm by
+// key which scores are between min and max, e.g. "(1" or
+// "+inf". Returns error if key contains another type.
+func (dm *DataMap) ZCount(key, min, max string) (int, error) {
+	r, err := parseZRange(ZRangeByScore, min, max)
+	if err != nil {
+		return 0, err
+	}
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	z, err := dm.lookupZset(key)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	return z.count(r), nil
+}
+
+// ZUnionStore stores the union of sorted sets in dm by keys
+// by dst key and returns its size. Scores are multiplied by
+// weights (all 1 if nil) and then aggregated as "sum", "min"
+// or "max". Sets are sorted sets with score 1. Returns error
+// if a key contains another type.
+func (dm *DataMap) ZUnionStore(dst string, keys []string, weights []float64, aggregate string) (int, error) {
+	return dm.zstore(setUnion, dst, keys, weights, aggregate)
+}
+
+// ZInterStore is like ZUnionStore, but it stores
+// the intersection of sorted sets.
+func (dm *DataMap) ZInterStore(dst string, keys []string, weights []float64, aggregate string) (int, error) {
+	return dm.zstore(setInter, dst, keys, weights, aggregate)
+}
+
+func (dm *DataMap) zstore(op int, dst string, keys []string, weights []float64, aggregate string) (int, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	inputs := make([]map[string]float64, len(keys))
+	for i, key := range keys {
+		d, ok := dm.lookup(key)
+		if !ok {
+			continue
+		}
+		switch x := d.value.(type) {
+		case *zset:
+			inputs[i] = x.dict
+		case map[string]struct{}:
+			scores := make(map[string]float64, len(x))
+			for m := range x {
+				scores[m] = 1
+			}
+			inputs[i] = scores
+		default:
+			return 0, typeMismatchErr
+		}
+	}
+	scores := make(map[string]float64)
+	seen := make(map[string]int)
+	for i, input := range inputs {
+		weight := 1.0
+		if weights != nil {
+			weight = weights[i]
+		}
+		for m, score := range input {
+			if score *= weight; math.IsNaN(score) {
+				score = 0
+			}
+			seen[m]++
+			if old, ok := scores[m]; ok {
+				score = aggregateScores(aggregate, old, score)
+			}
+			scores[m] = score
+		}
+	}
+	z := newZset()
+	for m, score := range scores {
+		if op == setUnion || seen[m] == len(inputs) {
+			z.set(m, score)
+		}
+	}
+	dm.delete(dst)
+	if z.len() > 0 {
+		d := dm.create(dst)
+		d.ZSetSet(z)
+		dm.resize(dst, d)
+		dm.modified(d)
+	}
+	return z.len(), nil
+}
+
+// aggregateScores aggregates scores a and b of a member
+// by "sum", "min" or "max" function.
+func aggregateScores(aggregate string, a, b float64) float64 {
+	switch aggregate {
+	case "min":
+		return math.Min(a, b)
+	case "max":
+		return math.Max(a, b)
+	}
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+// zitemsReply converts items to a reply. Scores follow
+// their members if withScores is set.
+func zitemsReply(items []ZItem, withScores bool) interface{} {
+	if !withScores {
+		res := make([]string, len(items))
+		for i, item := range items {
+			res[i] = item.Member
+		}
+		return res
+	}
+	res := make([]interface{}, 0, len(items)*2)
+	for _, item := range items {
+		res = append(res, item.Member, item.Score)
+	}
+	return res
+}
+
+// zsetCommand runs sorted set command cmd with key and args in dm.
+func zsetCommand(dm *DataMap, cmd, key string, args []string) (interface{}, error) {
+	switch cmd {
+	case "zadd":
+		return zaddCommand(dm, key, args)
+	case "zincrby":
+		if len(args) < 2 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		incr, err := parseScore(args[0])
+		if err != nil {
+			return nil, err
+		}
+		score, _, err := dm.ZIncrBy(key, ZAddFlags{}, incr, args[1])
+		if err != nil {
+			return nil, err
+		}
+		return score, nil
+	case "zrem":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		return dm.ZRem(key, args...)
+	case "zscore":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		score, ok, err := dm.ZScore(key, args[0])
+		if err != nil || !ok {
+			return nil, err
+		}
+		return score, nil
+	case "zcard":
+		if len(args) > 0 {
+			return nil, manyArgsErr
+		}
+		return dm.ZCard(key)
+	case "zrank", "zrevrank":
+		if len(args) == 0 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		rank, ok, err := dm.ZRank(key, args[0], cmd == "zrevrank")
+		if err != nil || !ok {
+			return nil, err
+		}
+		return rank, nil
+	case "zcount":
+		if len(args) < 2 {
+			return nil, fewArgsErr
+		}
+		if len(args) > 2 {
+			return nil, manyArgsErr
+		}
+		return dm.ZCount(key, args[0], args[1])
+	case "zpopmin", "zpopmax":
+		if len(args) > 1 {
+			return nil, manyArgsErr
+		}
+		count := 1
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, wrongArgErr
+			}
+			count = n
+		}
+		var items []ZItem
+		var err error
+		if cmd == "zpopmin" {
+			items, err = dm.ZPopMin(key, count)
+		} else {
+			items, err = dm.ZPopMax(key, count)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return zitemsReply(items, true), nil
+	case "zunionstore", "zinterstore":
+		return zstoreCommand(dm, cmd, key, args)
+	default:
+		return zrangeCommand(dm, cmd, key, args)
+	}
+}
+
+// zaddCommand handles ZADD key [NX|XX] [GT|LT] [CH] [INCR]
+// score member [score member ...] command.
+func zaddCommand(dm *DataMap, key string, args []string) (interface{}, error) {
+	var flags ZAddFlags
+	incr := false
+	i := 0
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			flags.NX = true
+		case "xx":
+			flags.XX = true
+		case "gt":
+			flags.GT = true
+		case "lt":
+			flags.LT = true
+		case "ch":
+			flags.CH = true
+		case "incr":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 {
+		return nil, fewArgsErr
+	}
+	if len(pairs)%2 != 0 {
+		return nil, syntaxErr
+	}
+	if flags.NX && flags.XX {
+		return nil, nxAndXXErr
+	}
+	if flags.GT && flags.LT || (flags.GT || flags.LT) && flags.NX {
+		return nil, gtLtNXErr
+	}
+	if incr && len(pairs) != 2 {
+		return nil, incrPairErr
+	}
+	items := make([]ZItem, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := parseScore(pairs[i])
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, ZItem{pairs[i+1], score})
+	}
+	if incr {
+		score, ok, err := dm.ZIncrBy(key, flags, items[0].Score, items[0].Member)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return score, nil
+	}
+	return dm.ZAdd(key, flags, items...)
+}
+
+// zrangeCommand handles ZRANGE key start stop [BYSCORE|BYLEX]
+// [REV] [LIMIT offset count] [WITHSCORES] command and its
+// older forms like ZREVRANGE and ZRANGEBYSCORE.
+func zrangeCommand(dm *DataMap, cmd, key string, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fewArgsErr
+	}
+	spec := ZRangeSpec{Start: args[0], Stop: args[1], Count: -1}
+	switch cmd {
+	case "zrange":
+	case "zrevrange":
+		spec.Reverse = true
+	case "zrangebyscore":
+		spec.By = ZRangeByScore
+	case "zrevrangebyscore":
+		spec.By, spec.Reverse = ZRangeByScore, true
+	case "zrangebylex":
+		spec.By = ZRangeByLex
+	case "zrevrangebylex":
+		spec.By, spec.Reverse = ZRangeByLex, true
+	default:
+		return nil, unknownCmdErr
+	}
+	withScores, limit := false, false
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case cmd == "zrange" && opt == "byscore":
+			spec.By = ZRangeByScore
+		case cmd == "zrange" && opt == "bylex":
+			spec.By = ZRangeByLex
+		case cmd == "zrange" && opt == "rev":
+			spec.Reverse = true
+		case opt == "withscores" && cmd != "zrangebylex" && cmd != "zrevrangebylex":
+			withScores = true
+		case opt == "limit" && cmd != "zrevrange" && i+2 < len(args):
+			offset, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return nil, wrongArgErr
+			}
+			count, err := strconv.Atoi(args[i+2])
+			if err != nil {
+				return nil, wrongArgErr
+			}
+			spec.Offset, spec.Count, limit = offset, count, true
+			i += 2
+		default:
+			return nil, syntaxErr
+		}
+	}
+	if limit && spec.By == ZRangeByIndex {
+		return nil, limitErr
+	}
+	if withScores && spec.By == ZRangeByLex {
+		return nil, withScoresByLexErr
+	}
+	items, err := dm.ZRange(key, spec)
+	if err != nil {
+		return nil, err
+	}
+	return zitemsReply(items, withScores), nil
+}
+
+// zstoreCommand handles ZUNIONSTORE and ZINTERSTORE destination
+// numkeys key [key ...] [WEIGHTS weight [weight ...]]
+// [AGGREGATE SUM|MIN|MAX] commands.
+func zstoreCommand(dm *DataMap, cmd, dst string, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fewArgsErr
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, wrongArgErr
+	}
+	if numKeys < 1 {
+		return nil, noInputKeysErr
+	}
+	if numKeys > len(args)-1 {
+		return nil, syntaxErr
+	}
+	keys := args[1 : numKeys+1]
+	var weights []float64
+	aggregate := "sum"
+	for i := numKeys + 1; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "weights" && i+numKeys < len(args):
+			weights = make([]float64, numKeys)
+			for j := range weights {
+				w, err := parseScore(args[i+1+j])
+				if err != nil {
+					return nil, weightErr
+				}
+				weights[j] = w
+			}
+			i += numKeys
+		case opt == "aggregate" && i+1 < len(args):
+			aggregate = strings.ToLower(args[i+1])
+			if aggregate != "sum" && aggregate != "min" && aggregate != "max" {
+				return nil, syntaxErr
+			}
+			i++
+		default:
+			return nil, syntaxErr
+		}
+	}
+	if cmd == "zunionstore" {
+		return dm.ZUnionStore(dst, keys, weights, aggregate)
+	}
+	return dm.ZInterStore(dst, keys, weights, aggregate)
+}
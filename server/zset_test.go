@@ -0,0 +1,236 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestMapZAdd(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	n, err := dm.ZAdd("z", ZAddFlags{}, ZItem{"a", 1}, ZItem{"b", 2})
+	if err != nil || n != 2 {
+		t.Fatalf("ZAdd = %d, %v, want 2 added", n, err)
+	}
+	cases := []struct {
+		flags ZAddFlags
+		item  ZItem
+		want  int
+		score float64
+	}{
+		{ZAddFlags{NX: true}, ZItem{"a", 5}, 0, 1},
+		{ZAddFlags{XX: true}, ZItem{"c", 5}, 0, 0},
+		{ZAddFlags{XX: true, CH: true}, ZItem{"a", 3}, 1, 3},
+		{ZAddFlags{GT: true, CH: true}, ZItem{"a", 2}, 0, 3},
+		{ZAddFlags{LT: true, CH: true}, ZItem{"a", 2}, 1, 2},
+		{ZAddFlags{GT: true}, ZItem{"d", 1}, 1, 1},
+	}
+	for _, c := range cases {
+		n, err := dm.ZAdd("z", c.flags, c.item)
+		if err != nil || n != c.want {
+			t.Fatalf("ZAdd(%+v, %v) = %d, %v, want %d", c.flags, c.item, n, err, c.want)
+		}
+		if score, _, _ := dm.ZScore("z", c.item.Member); score != c.score {
+			t.Fatalf("got %v score of %q, want %v", score, c.item.Member, c.score)
+		}
+	}
+	if _, err := dm.ZAdd("missing", ZAddFlags{XX: true}, ZItem{"a", 1}); err != nil || dm.deadline("missing") != 0 {
+		t.Fatalf("got '%v', XX shouldn't create key", err)
+	}
+	if _, err := dm.ZCard("missing"); err != nil {
+		t.Fatalf("got '%v' for missing key", err)
+	}
+	dm.Set("str", "value")
+	if _, err := dm.ZAdd("str", ZAddFlags{}, ZItem{"a", 1}); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+}
+
+func TestMapZIncrBy(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	if score, ok, _ := dm.ZIncrBy("z", ZAddFlags{}, 1.5, "a"); !ok || score != 1.5 {
+		t.Fatalf("got %v score, want 1.5", score)
+	}
+	if score, _, _ := dm.ZIncrBy("z", ZAddFlags{}, 2, "a"); score != 3.5 {
+		t.Fatalf("got %v score, want 3.5", score)
+	}
+	if _, ok, _ := dm.ZIncrBy("z", ZAddFlags{LT: true}, 1, "a"); ok {
+		t.Fatal("LT should forbid greater score")
+	}
+	dm.ZAdd("z", ZAddFlags{}, ZItem{"inf", math.Inf(1)})
+	if _, _, err := dm.ZIncrBy("z", ZAddFlags{}, math.Inf(-1), "inf"); err != nanScoreErr {
+		t.Fatalf("got '%v', expected '%v' error", err, nanScoreErr)
+	}
+	if _, _, err := dm.ZIncrBy("nan", ZAddFlags{}, math.NaN(), "a"); err != nanScoreErr {
+		t.Fatalf("got '%v', expected '%v' error", err, nanScoreErr)
+	}
+	if _, err := dm.ZRange("nan", ZRangeSpec{Start: "0", Stop: "-1"}); err != nil || len(dm.Keys()) != 1 {
+		t.Fatalf("got %v keys, failed increment shouldn't create key", dm.Keys())
+	}
+}
+
+func TestMapZRange(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.ZAdd("z", ZAddFlags{}, ZItem{"a", 1}, ZItem{"b", 2}, ZItem{"c", 3}, ZItem{"d", 4}, ZItem{"e", 5})
+	dm.ZAdd("lex", ZAddFlags{}, ZItem{"a", 0}, ZItem{"b", 0}, ZItem{"c", 0}, ZItem{"d", 0})
+	cases := []struct {
+		key  string
+		spec ZRangeSpec
+		want string
+	}{
+		{"z", ZRangeSpec{Start: "0", Stop: "-1"}, "a b c d e"},
+		{"z", ZRangeSpec{Start: "1", Stop: "2"}, "b c"},
+		{"z", ZRangeSpec{Start: "-2", Stop: "100"}, "d e"},
+		{"z", ZRangeSpec{Start: "3", Stop: "1"}, ""},
+		{"z", ZRangeSpec{Start: "0", Stop: "1", Reverse: true}, "e d"},
+		{"z", ZRangeSpec{By: ZRangeByScore, Start: "2", Stop: "(4", Count: -1}, "b c"},
+		{"z", ZRangeSpec{By: ZRangeByScore, Start: "-inf", Stop: "+inf", Offset: 1, Count: 2}, "b c"},
+		{"z", ZRangeSpec{By: ZRangeByScore, Start: "+inf", Stop: "(3", Reverse: true, Count: -1}, "e d"},
+		{"z", ZRangeSpec{By: ZRangeByScore, Start: "4", Stop: "2", Count: -1}, ""},
+		{"lex", ZRangeSpec{By: ZRangeByLex, Start: "-", Stop: "[b", Count: -1}, "a b"},
+		{"lex", ZRangeSpec{By: ZRangeByLex, Start: "(b", Stop: "+", Count: -1}, "c d"},
+		{"lex", ZRangeSpec{By: ZRangeByLex, Start: "+", Stop: "[b", Reverse: true, Count: 1}, "d"},
+		{"missing", ZRangeSpec{Start: "0", Stop: "-1"}, ""},
+	}
+	for _, c := range cases {
+		items, err := dm.ZRange(c.key, c.spec)
+		if err != nil {
+			t.Fatalf("ZRange(%s, %+v) error: %v", c.key, c.spec, err)
+		}
+		var got []string
+		for _, item := range items {
+			got = append(got, item.Member)
+		}
+		if fmt.Sprint(got) != "["+c.want+"]" {
+			t.Fatalf("ZRange(%s, %+v) = %v, want [%s]", c.key, c.spec, got, c.want)
+		}
+	}
+	if _, err := dm.ZRange("z", ZRangeSpec{By: ZRangeByScore, Start: "a", Stop: "1"}); err != minMaxFloatErr {
+		t.Fatalf("got '%v', expected '%v' error", err, minMaxFloatErr)
+	}
+	if _, err := dm.ZRange("z", ZRangeSpec{By: ZRangeByLex, Start: "a", Stop: "+"}); err != minMaxLexErr {
+		t.Fatalf("got '%v', expected '%v' error", err, minMaxLexErr)
+	}
+	if n, _ := dm.ZCount("z", "(1", "4"); n != 3 {
+		t.Fatalf("got %d members in (1, 4], want 3", n)
+	}
+	if rank, _, _ := dm.ZRank("z", "b", false); rank != 1 {
+		t.Fatalf("got %d rank, want 1", rank)
+	}
+	if rank, _, _ := dm.ZRank("z", "b", true); rank != 3 {
+		t.Fatalf("got %d reverse rank, want 3", rank)
+	}
+	if _, ok, _ := dm.ZRank("z", "missing", false); ok {
+		t.Fatal("missing member shouldn't have rank")
+	}
+}
+
+func TestMapZPop(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.ZAdd("z", ZAddFlags{}, ZItem{"a", 1}, ZItem{"b", 2}, ZItem{"c", 3})
+	if items, _ := dm.ZPopMin("z", 2); fmt.Sprint(items) != "[{a 1} {b 2}]" {
+		t.Fatalf("got %v, want a and b", items)
+	}
+	if items, _ := dm.ZPopMax("z", 5); fmt.Sprint(items) != "[{c 3}]" {
+		t.Fatalf("got %v, want c", items)
+	}
+	if len(dm.Keys()) != 0 {
+		t.Fatal("empty sorted set should be removed")
+	}
+	if n, _ := dm.ZRem("z", "a"); n != 0 {
+		t.Fatalf("got %d removed from missing key", n)
+	}
+}
+
+func TestMapZStore(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	dm.ZAdd("a", ZAddFlags{}, ZItem{"x", 1}, ZItem{"y", 2})
+	dm.ZAdd("b", ZAddFlags{}, ZItem{"y", 3}, ZItem{"z", 4})
+	dm.SAdd("s", "y")
+	cases := []struct {
+		union     bool
+		keys      []string
+		weights   []float64
+		aggregate string
+		want      string
+	}{
+		{true, []string{"a", "b"}, nil, "sum", "[{x 1} {z 4} {y 5}]"},
+		{true, []string{"a", "b"}, []float64{2, 1}, "max", "[{x 2} {y 4} {z 4}]"},
+		{false, []string{"a", "b"}, nil, "min", "[{y 2}]"},
+		{false, []string{"a", "b", "s"}, []float64{1, 1, 10}, "sum", "[{y 15}]"},
+		{false, []string{"a", "missing"}, nil, "sum", "[]"},
+	}
+	for _, c := range cases {
+		var n int
+		var err error
+		if c.union {
+			n, err = dm.ZUnionStore("dst", c.keys, c.weights, c.aggregate)
+		} else {
+			n, err = dm.ZInterStore("dst", c.keys, c.weights, c.aggregate)
+		}
+		if err != nil {
+			t.Fatalf("store %v error: %v", c.keys, err)
+		}
+		items, _ := dm.ZRange("dst", ZRangeSpec{Start: "0", Stop: "-1"})
+		if got := fmt.Sprint(items); got != c.want || n != len(items) {
+			t.Fatalf("got %d, %s stored from %v, want %s", n, got, c.keys, c.want)
+		}
+	}
+	dm.Set("str", "value")
+	if _, err := dm.ZUnionStore("dst", []string{"a", "str"}, nil, "sum"); err != typeMismatchErr {
+		t.Fatalf("got '%v', expected '%v' error", err, typeMismatchErr)
+	}
+}
+
+func TestZSetDataHandlers(t *testing.T) {
+	var dm DataMap
+	dm.Init()
+	cases := []struct {
+		cmd  string
+		args []string
+		want string
+		err  error
+	}{
+		{"zadd", []string{"z", "1", "a", "2"}, "", syntaxErr},
+		{"zadd", []string{"z", "nx", "xx", "1", "a"}, "", nxAndXXErr},
+		{"zadd", []string{"z", "gt", "nx", "1", "a"}, "", gtLtNXErr},
+		{"zadd", []string{"z", "incr", "1", "a", "2", "b"}, "", incrPairErr},
+		{"zadd", []string{"z", "nan", "a"}, "", notFloatErr},
+		{"zadd", []string{"z", "1", "a", "2.5", "b", "-inf", "c"}, "3", nil},
+		{"zadd", []string{"z", "xx", "incr", "1", "a"}, "2", nil},
+		{"zadd", []string{"z", "nx", "incr", "1", "a"}, "(nil)", nil},
+		{"zincrby", []string{"z", "0.5", "a"}, "2.5", nil},
+		{"zscore", []string{"z", "c"}, "-inf", nil},
+		{"zscore", []string{"z", "missing"}, "(nil)", nil},
+		{"zrank", []string{"z", "b"}, "2", nil},
+		{"zrange", []string{"z", "0", "-1", "withscores"}, "[c -inf a 2.5 b 2.5]", nil},
+		{"zrange", []string{"z", "0", "1", "limit", "0", "1"}, "", limitErr},
+		{"zrange", []string{"z", "2.5", "-inf", "byscore", "rev"}, "[b a c]", nil},
+		{"zrangebyscore", []string{"z", "0", "+inf", "limit", "1", "5"}, "[b]", nil},
+		{"zrevrangebyscore", []string{"z", "+inf", "0", "withscores"}, "[b 2.5 a 2.5]", nil},
+		{"zrevrange", []string{"z", "0", "0"}, "[b]", nil},
+		{"zrangebylex", []string{"z", "-", "+", "withscores"}, "", syntaxErr},
+		{"zcount", []string{"z", "-inf", "(2.5"}, "1", nil},
+		{"zpopmax", []string{"z"}, "[b 2.5]", nil},
+		{"zunionstore", []string{"dst", "0", "z"}, "", noInputKeysErr},
+		{"zunionstore", []string{"dst", "2", "z"}, "", syntaxErr},
+		{"zunionstore", []string{"dst", "1", "z", "weights", "x"}, "", weightErr},
+		{"zunionstore", []string{"dst", "1", "z", "weights", "2", "aggregate", "max"}, "2", nil},
+		{"zrange", []string{"dst", "0", "-1", "withscores"}, "[c -inf a 5]", nil},
+	}
+	for _, c := range cases {
+		res, err := DataHandler(&dm, c.cmd, c.args)
+		if err != c.err || res != c.want {
+			t.Fatalf("%s %v = %q, '%v', want %q, '%v'", c.cmd, c.args, res, err, c.want, c.err)
+		}
+	}
+	want := []string{"dst", "z"}
+	if got := commandKeys("zinterstore", []string{"dst", "1", "z", "weights", "2"}); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v keys, want %v", got, want)
+	}
+}